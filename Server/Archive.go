@@ -0,0 +1,187 @@
+package main
+
+import (
+	"Farnsworth/Server/hls"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits applied to uploaded archives, overridable with MAX_ARCHIVE_BYTES and MAX_ARCHIVE_FILES
+var MaxArchiveBytes int64 = 64 << 30
+var MaxArchiveFiles = 100000
+
+// Only this many problems are listed back to the client
+const maxArchiveProblems = 20
+
+// ArchiveError is returned when an archive is refused before anything is extracted
+type ArchiveError struct {
+	Problems []string
+}
+
+func (e *ArchiveError) Error() string {
+	return "Archive rejected:\n- " + strings.Join(e.Problems, "\n- ")
+}
+
+func (e *ArchiveError) add(problem string) {
+	if len(e.Problems) < maxArchiveProblems {
+		e.Problems = append(e.Problems, problem)
+	} else if len(e.Problems) == maxArchiveProblems {
+		e.Problems = append(e.Problems, "further problems omitted")
+	}
+}
+
+// safeJoin joins name onto dest and reports whether the result stays inside dest
+func safeJoin(dest, name string) (string, bool) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	target := filepath.Join(dest, name)
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// validateArchive checks every entry before extraction so a bad archive never touches the disk
+func validateArchive(files []*zip.File, dest string) error {
+	problems := &ArchiveError{}
+	var totalSize uint64
+	fileCount := 0
+	for _, f := range files {
+		if _, ok := safeJoin(dest, f.Name); !ok {
+			problems.add(fmt.Sprintf("%q escapes the target directory", f.Name))
+		}
+		mode := f.Mode()
+		if mode&os.ModeSymlink != 0 {
+			problems.add(fmt.Sprintf("%q is a symlink", f.Name))
+			continue
+		}
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			problems.add(fmt.Sprintf("%q is not a regular file", f.Name))
+			continue
+		}
+		fileCount++
+		totalSize += f.UncompressedSize64
+	}
+	if fileCount > MaxArchiveFiles {
+		problems.add(fmt.Sprintf("archive contains %d files, the limit is %d", fileCount, MaxArchiveFiles))
+	}
+	if totalSize > uint64(MaxArchiveBytes) {
+		problems.add(fmt.Sprintf("archive expands to %d bytes, the limit is %d", totalSize, MaxArchiveBytes))
+	}
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// checkArchive validates the entries of the zip at src without extracting
+// anything, so an upload can be rejected before it is queued
+func checkArchive(src string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return &ArchiveError{Problems: []string{fmt.Sprintf("not a readable zip file: %v", err)}}
+	}
+	defer r.Close()
+	return validateArchive(r.File, filepath.Clean("./media/unpack"))
+}
+
+// unzip extracts src into dest. It stops early if ctx is cancelled and reports
+// progress, as a percentage of the uncompressed size, when progress is not nil
+func unzip(ctx context.Context, src, dest string, progress func(float64)) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return &ArchiveError{Problems: []string{fmt.Sprintf("not a readable zip file: %v", err)}}
+	}
+	defer r.Close()
+
+	dest = filepath.Clean(dest)
+	if err := validateArchive(r.File, dest); err != nil {
+		return err
+	}
+
+	var totalSize, extracted uint64
+	for _, f := range r.File {
+		totalSize += f.UncompressedSize64
+	}
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fPath, _ := safeJoin(dest, f.Name)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(fPath, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fPath), os.ModePerm); err != nil {
+			return err
+		}
+
+		perm := f.Mode().Perm()
+		if perm == 0 {
+			perm = 0644
+		}
+		outFile, err := os.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			outFile.Close()
+			return err
+		}
+
+		// Never trust the size in the header, stop one byte past it
+		size := int64(f.UncompressedSize64)
+		written, err := io.CopyN(outFile, rc, size+1)
+		if err == io.EOF {
+			err = nil
+		}
+
+		outFile.Close()
+		rc.Close()
+
+		if err != nil {
+			return err
+		}
+		if written > size {
+			return &ArchiveError{Problems: []string{fmt.Sprintf("%q is larger than its header claims", f.Name)}}
+		}
+		extracted += uint64(written)
+		if progress != nil && totalSize > 0 {
+			progress(float64(extracted) / float64(totalSize) * 100)
+		}
+	}
+	return nil
+}
+
+// validateHLSPackage checks that an extracted archive is a playable HLS package and
+// returns its entry point playlist, relative to dir, and its duration in seconds
+func validateHLSPackage(dir string) (string, float64, error) {
+	entry, err := hls.FindEntryPoint(dir)
+	if err != nil {
+		return "", 0, &ArchiveError{Problems: []string{err.Error()}}
+	}
+	duration, problems := hls.Check(dir, entry)
+	if len(problems) > 0 {
+		archiveErr := &ArchiveError{}
+		for _, problem := range problems {
+			archiveErr.add(problem)
+		}
+		return "", 0, archiveErr
+	}
+	return entry, duration, nil
+}
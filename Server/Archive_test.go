@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type archiveFile struct {
+	name string
+	mode os.FileMode
+	body string
+}
+
+func buildArchive(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range files {
+		header := &zip.FileHeader{Name: f.name, Method: zip.Store}
+		header.SetMode(f.mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestValidateArchive(t *testing.T) {
+	maxFiles, maxBytes := MaxArchiveFiles, MaxArchiveBytes
+	MaxArchiveFiles, MaxArchiveBytes = 3, 100
+	defer func() { MaxArchiveFiles, MaxArchiveBytes = maxFiles, maxBytes }()
+
+	tests := []struct {
+		name     string
+		files    []archiveFile
+		problems []string
+	}{
+		{
+			name: "valid",
+			files: []archiveFile{
+				{name: "show/", mode: os.ModeDir | 0755},
+				{name: "show/output.m3u8", mode: 0644, body: "#EXTM3U\n"},
+				{name: "show/segment0.ts", mode: 0644, body: "ts"},
+			},
+		},
+		{
+			name:     "parent directory",
+			files:    []archiveFile{{name: "../evil.ts", mode: 0644}},
+			problems: []string{`"../evil.ts" escapes the target directory`},
+		},
+		{
+			name:     "nested parent directory",
+			files:    []archiveFile{{name: "show/../../evil.ts", mode: 0644}},
+			problems: []string{`"show/../../evil.ts" escapes the target directory`},
+		},
+		{
+			name:     "absolute path",
+			files:    []archiveFile{{name: "/etc/passwd", mode: 0644}},
+			problems: []string{`"/etc/passwd" escapes the target directory`},
+		},
+		{
+			name:     "symlink",
+			files:    []archiveFile{{name: "link", mode: os.ModeSymlink | 0777, body: "/etc/passwd"}},
+			problems: []string{`"link" is a symlink`},
+		},
+		{
+			name:     "device",
+			files:    []archiveFile{{name: "null", mode: os.ModeDevice | os.ModeCharDevice | 0644}},
+			problems: []string{`"null" is not a regular file`},
+		},
+		{
+			name: "too many files",
+			files: []archiveFile{
+				{name: "a", mode: 0644}, {name: "b", mode: 0644}, {name: "c", mode: 0644}, {name: "d", mode: 0644},
+			},
+			problems: []string{"archive contains 4 files, the limit is 3"},
+		},
+		{
+			name:     "too large",
+			files:    []archiveFile{{name: "big", mode: 0644, body: strings.Repeat("x", 101)}},
+			problems: []string{"archive expands to 101 bytes, the limit is 100"},
+		},
+		{
+			name: "every problem is listed",
+			files: []archiveFile{
+				{name: "../a", mode: 0644},
+				{name: "b", mode: os.ModeSymlink | 0777},
+			},
+			problems: []string{`"../a" escapes the target directory`, `"b" is a symlink`},
+		},
+	}
+	for _, tt := range tests {
+		data := buildArchive(t, tt.files)
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		err = validateArchive(r.File, filepath.Join(t.TempDir(), "dest"))
+		if tt.problems == nil {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		var archiveErr *ArchiveError
+		if !errors.As(err, &archiveErr) {
+			t.Errorf("%v: got %v, want an ArchiveError", tt.name, err)
+			continue
+		}
+		if strings.Join(archiveErr.Problems, "\n") != strings.Join(tt.problems, "\n") {
+			t.Errorf("%v: got problems %q, want %q", tt.name, archiveErr.Problems, tt.problems)
+		}
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.zip")
+	os.WriteFile(valid, buildArchive(t, []archiveFile{
+		{name: "show/", mode: os.ModeDir | 0755},
+		{name: "show/output.m3u8", mode: 0644, body: "#EXTM3U\n"},
+	}), 0644)
+	dest := filepath.Join(dir, "valid")
+	if err := unzip(context.Background(), valid, dest, func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "show", "output.m3u8")); err != nil || string(data) != "#EXTM3U\n" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	// A rejected archive leaves nothing behind, not even its valid files
+	unsafe := filepath.Join(dir, "unsafe.zip")
+	os.WriteFile(unsafe, buildArchive(t, []archiveFile{
+		{name: "output.m3u8", mode: 0644},
+		{name: "../evil.ts", mode: 0644},
+	}), 0644)
+	dest = filepath.Join(dir, "unsafe")
+	var archiveErr *ArchiveError
+	if err := unzip(context.Background(), unsafe, dest, func(float64) {}); !errors.As(err, &archiveErr) {
+		t.Fatalf("got %v, want an ArchiveError", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("rejected archive created %v", dest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.ts")); !os.IsNotExist(err) {
+		t.Errorf("rejected archive wrote outside its directory")
+	}
+
+	garbage := filepath.Join(dir, "garbage.zip")
+	os.WriteFile(garbage, []byte("not a zip"), 0644)
+	if err := unzip(context.Background(), garbage, filepath.Join(dir, "garbage"), func(float64) {}); !errors.As(err, &archiveErr) {
+		t.Errorf("not a zip: got %v, want an ArchiveError", err)
+	}
+}
+
+func TestValidateHLSPackage(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "show"), 0755)
+	os.WriteFile(filepath.Join(dir, "show", "output.m3u8"), []byte("#EXTM3U\n#EXTINF:6.5,\nsegment0.ts\n#EXT-X-ENDLIST\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "show", "segment0.ts"), []byte("ts"), 0644)
+	entry, duration, err := validateHLSPackage(dir)
+	if err != nil || entry != "show/output.m3u8" || duration != 6.5 {
+		t.Fatalf("got %q, %v, %v", entry, duration, err)
+	}
+
+	os.Remove(filepath.Join(dir, "show", "segment0.ts"))
+	var archiveErr *ArchiveError
+	if _, _, err := validateHLSPackage(dir); !errors.As(err, &archiveErr) {
+		t.Errorf("missing segment: got %v, want an ArchiveError", err)
+	}
+	if _, _, err := validateHLSPackage(t.TempDir()); !errors.As(err, &archiveErr) {
+		t.Errorf("no playlist: got %v, want an ArchiveError", err)
+	}
+}
+
+func TestCheckArchive(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.zip")
+	os.WriteFile(valid, buildArchive(t, []archiveFile{{name: "output.m3u8", mode: 0644}}), 0644)
+	unsafe := filepath.Join(dir, "unsafe.zip")
+	os.WriteFile(unsafe, buildArchive(t, []archiveFile{{name: "../output.m3u8", mode: 0644}}), 0644)
+	garbage := filepath.Join(dir, "garbage.zip")
+	os.WriteFile(garbage, []byte("not a zip"), 0644)
+
+	tests := []struct {
+		name     string
+		path     string
+		rejected bool
+	}{
+		{"valid", valid, false},
+		{"unsafe", unsafe, true},
+		{"not a zip", garbage, true},
+		{"missing", filepath.Join(dir, "missing.zip"), true},
+	}
+	for _, tt := range tests {
+		err := checkArchive(tt.path)
+		var archiveErr *ArchiveError
+		if tt.rejected != errors.As(err, &archiveErr) || (!tt.rejected && err != nil) {
+			t.Errorf("%v: got %v", tt.name, err)
+		}
+	}
+}
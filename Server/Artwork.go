@@ -0,0 +1,250 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"Farnsworth/Server/hls"
+	"Farnsworth/Server/subtitle"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const JobArtwork = "artwork"
+
+// Sprite sheet geometry. Thumbnails are taken every spriteMinInterval seconds,
+// or further apart for long videos so a sheet never holds more than spriteMaxThumbnails
+const (
+	spriteColumns       = 10
+	spriteThumbWidth    = 160
+	spriteThumbHeight   = 90
+	spriteMinInterval   = 10.0
+	spriteMaxThumbnails = 300
+)
+
+// The only files served by the artwork route
+var artworkFiles = map[string]bool{
+	"poster.jpg": true,
+	"sprite.jpg": true,
+}
+
+// queueArtwork schedules poster and sprite extraction for a video entry
+func queueArtwork(mie MediaIndexEntry, owner string) {
+	if mie.MediaType != "video" || Jobs == nil {
+		return
+	}
+	_, err := Jobs.Submit(db.Job{
+		Kind:     JobArtwork,
+		Owner:    owner,
+		Metadata: db.MediaIndexEntry(mie),
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("Unable to queue artwork for %v: %v", mie.Title, err))
+	}
+}
+
+// artworkInputs picks the media playlists to grab frames from: the sharpest
+// rendition for the poster and the smallest one for the sprite sheet
+func artworkInputs(mie MediaIndexEntry) (string, string, error) {
+	entry := filepath.Join(mie.Location, filepath.FromSlash(mie.Playlist))
+	p, err := hls.ParseFile(entry)
+	if err != nil {
+		return "", "", err
+	}
+	if !p.Master {
+		return entry, entry, nil
+	}
+	// Audio only variants have no RESOLUTION, unless no variant says either way
+	hasResolution := false
+	for _, v := range p.Variants {
+		hasResolution = hasResolution || v.Attributes["RESOLUTION"] != ""
+	}
+	var best, smallest *hls.Variant
+	for i := range p.Variants {
+		v := &p.Variants[i]
+		if hasResolution && v.Attributes["RESOLUTION"] == "" {
+			continue
+		}
+		if best == nil || v.Bandwidth() > best.Bandwidth() {
+			best = v
+		}
+		if smallest == nil || v.Bandwidth() < smallest.Bandwidth() {
+			smallest = v
+		}
+	}
+	if best == nil {
+		return "", "", fmt.Errorf("no video rendition in %v", mie.Playlist)
+	}
+	resolve := func(v *hls.Variant) (string, error) {
+		target, ok := hls.Resolve(mie.Playlist, v.URI)
+		if !ok {
+			return "", fmt.Errorf("variant %q is not inside the package", v.URI)
+		}
+		return filepath.Join(mie.Location, filepath.FromSlash(target)), nil
+	}
+	poster, err := resolve(best)
+	if err != nil {
+		return "", "", err
+	}
+	sprite, err := resolve(smallest)
+	return poster, sprite, err
+}
+
+// generateArtwork is the JobArtwork runner. It writes poster.jpg and sprite.jpg
+// beside the segments and records them on the entry
+func generateArtwork(ctx context.Context, catalog db.MediaRepository, job db.Job, progress func(float64)) (MediaIndexEntry, error) {
+	mie := MediaIndexEntry(job.Metadata)
+	if mie.Duration <= 0 {
+		return mie, fmt.Errorf("entry has no duration")
+	}
+	posterInput, spriteInput, err := artworkInputs(mie)
+	if err != nil {
+		return mie, err
+	}
+
+	// The poster comes from a tenth of the way in, past any cold open black frames
+	err = runFFmpeg(ctx, []string{"-hide_banner", "-nostdin", "-y",
+		"-ss", fmt.Sprintf("%.3f", mie.Duration*0.1), "-i", posterInput,
+		"-frames:v", "1", "-vf", "scale=-2:720", "-q:v", "3",
+		filepath.Join(mie.Location, "poster.jpg"),
+	}, 0, nil)
+	if err != nil {
+		return mie, err
+	}
+	progress(5)
+
+	interval := math.Max(spriteMinInterval, mie.Duration/spriteMaxThumbnails)
+	// The fps filter takes a frame at 0 and every interval after it, up to the end
+	count := int(math.Floor(mie.Duration/interval)) + 1
+	rows := (count + spriteColumns - 1) / spriteColumns
+	// Every cell is padded to the same size so clients can address thumbnails by index
+	filter := fmt.Sprintf("fps=1/%g,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		interval, spriteThumbWidth, spriteThumbHeight, spriteThumbWidth, spriteThumbHeight, spriteColumns, rows)
+	err = runFFmpeg(ctx, []string{"-hide_banner", "-nostdin", "-y",
+		"-i", spriteInput, "-an", "-vf", filter, "-frames:v", "1", "-q:v", "5",
+		filepath.Join(mie.Location, "sprite.jpg"),
+	}, mie.Duration, func(percent float64) {
+		progress(5 + percent*0.95)
+	})
+	if err != nil {
+		return mie, err
+	}
+
+	sprite := db.SpriteSheet{
+		URI:      "sprite.jpg",
+		Columns:  spriteColumns,
+		Rows:     rows,
+		Width:    spriteThumbWidth,
+		Height:   spriteThumbHeight,
+		Count:    count,
+		Interval: interval,
+	}
+	if err := writeThumbnailTrack(filepath.Join(mie.Location, "thumbnails.vtt"), sprite, mie.Duration); err != nil {
+		return mie, err
+	}
+
+	entry, err := catalog.UpdateEntry(CTX, mie.MediaType, mie.ID, func(entry *db.MediaIndexEntry) error {
+		entry.Poster = "poster.jpg"
+		entry.Sprite = &sprite
+		entry.Thumbnails = "thumbnails.vtt"
+		return nil
+	})
+	if err != nil {
+		return mie, err
+	}
+	return MediaIndexEntry(entry), nil
+}
+
+// writeThumbnailTrack writes a WebVTT track with one cue per sprite cell, each
+// pointing at its cell through a media fragment so players can show seek
+// previews. A cell taken right at the end has no time left to cover and no cue
+func writeThumbnailTrack(name string, sprite db.SpriteSheet, duration float64) error {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < sprite.Count; i++ {
+		start := float64(i) * sprite.Interval
+		end := math.Min(start+sprite.Interval, duration)
+		if start >= end {
+			break
+		}
+		x := (i % sprite.Columns) * sprite.Width
+		y := (i / sprite.Columns) * sprite.Height
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			subtitle.FormatTimestamp(start), subtitle.FormatTimestamp(end), sprite.URI, x, y, sprite.Width, sprite.Height)
+	}
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// ArtworkHandler serves an entry's poster and sprite sheet without touching the stream
+//
+//	GET  /artwork/<type>/<id>/poster.jpg
+//	GET  /artwork/<type>/<id>/sprite.jpg
+//	POST /artwork/<type>/<id>             regenerate the artwork, uploaders only
+func ArtworkHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/artwork/"), "/"), "/")
+		if len(parts) < 2 || (parts[0] != "video" && parts[0] != "audio") || !validID(parts[1]) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		mediaType, id := parts[0], parts[1]
+
+		switch {
+		case len(parts) == 3 && r.Method == http.MethodGet:
+			if !artworkFiles[parts[2]] {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			// Artwork never changes under the same name until it is regenerated
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+			http.ServeFile(w, r, filepath.Join("./media", mediaType, id, parts[2]))
+		case len(parts) == 2 && r.Method == http.MethodPost:
+			user, _ := currentUser(r)
+			if roleRank[user.Role] < roleRank[RoleUploader] {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			mie, err := lookupEntry(catalog, mediaType, id)
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "Entry not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if mie.MediaType != "video" {
+				http.Error(w, "Artwork is only generated for video", http.StatusBadRequest)
+				return
+			}
+			job, err := Jobs.Submit(db.Job{Kind: JobArtwork, Owner: user.Username, Metadata: db.MediaIndexEntry(mie)})
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Unable to queue artwork", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// lookupEntry finds an entry in the catalog
+func lookupEntry(catalog db.MediaRepository, mediaType, id string) (MediaIndexEntry, error) {
+	entry, err := catalog.GetEntry(CTX, mediaType, id)
+	return MediaIndexEntry(entry), err
+}
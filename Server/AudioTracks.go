@@ -0,0 +1,327 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"Farnsworth/Server/hls"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const JobAudioTrack = "audiotrack"
+
+const (
+	audioGroup     = "aud"
+	audioTracksDir = "tracks"
+)
+
+// audioTracks lists the audio renditions of a master playlist
+func audioTracks(master *hls.Playlist, masterRel string) []db.AudioTrack {
+	var tracks []db.AudioTrack
+	for _, r := range master.Renditions {
+		if r.Type() != "AUDIO" {
+			continue
+		}
+		track := db.AudioTrack{
+			Language: r.Attributes["LANGUAGE"],
+			Name:     r.Attributes["NAME"],
+			Default:  r.Attributes["DEFAULT"] == "YES",
+		}
+		if r.URI() != "" {
+			uri, ok := hls.Resolve(masterRel, r.URI())
+			if !ok {
+				continue
+			}
+			track.URI = uri
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// audioOnly reports whether a variant carries nothing but audio, so there is no
+// video to pair an alternate audio track with
+func audioOnly(v hls.Variant) bool {
+	codecs := v.Attributes["CODECS"]
+	return v.Attributes["RESOLUTION"] == "" && strings.HasPrefix(codecs, "mp4a") && !strings.Contains(codecs, ",")
+}
+
+// ffmpegAudioTrackArgs builds the ffmpeg command line that turns the first audio
+// stream of source into an AAC rendition at out/index.m3u8, segmented like the video
+func ffmpegAudioTrackArgs(source, out string) []string {
+	return []string{"-hide_banner", "-nostdin", "-y", "-i", source,
+		"-map", "0:a:0", "-vn", "-c:a", "aac", "-b:a", fmt.Sprint(AudioBitrate), "-ac", "2",
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(out, "segment%d.ts"),
+		filepath.Join(out, "index.m3u8"),
+	}
+}
+
+// addAudioTrack is the JobAudioTrack runner. It encodes the job's source into
+// tracks/<language>/ beside the master playlist and adds it to the entry's
+// audio group. The first alternate also turns the audio muxed into the video
+// variants into a rendition of its own so players can switch back to it
+func addAudioTrack(ctx context.Context, catalog db.MediaRepository, job db.Job, progress func(float64)) (MediaIndexEntry, error) {
+	if job.Track == nil {
+		return MediaIndexEntry(job.Metadata), fmt.Errorf("job has no track")
+	}
+	track := *job.Track
+	// Look the entry up again, its playlist may have been rewritten since the job was queued
+	mie, err := lookupEntry(catalog, job.Metadata.MediaType, job.Metadata.ID)
+	if err != nil {
+		return MediaIndexEntry(job.Metadata), err
+	}
+	probe, err := probeMedia(ctx, job.Source)
+	if err != nil {
+		return mie, err
+	}
+	if !probe.HasAudio {
+		return mie, fmt.Errorf("source has no audio stream")
+	}
+
+	renditionMutex.Lock()
+	_, masterRel, err := masterPlaylist(mie)
+	renditionMutex.Unlock()
+	if err != nil {
+		return mie, err
+	}
+	rel := path.Join(path.Dir(masterRel), audioTracksDir, track.Language)
+	dir := filepath.Join(mie.Location, filepath.FromSlash(rel))
+	workDir := dir + ".tmp"
+	os.RemoveAll(workDir)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return mie, err
+	}
+	defer os.RemoveAll(workDir)
+	if err := runFFmpeg(ctx, ffmpegAudioTrackArgs(job.Source, workDir), probe.Duration, progress); err != nil {
+		return mie, err
+	}
+
+	renditionMutex.Lock()
+	defer renditionMutex.Unlock()
+	// Encoding takes a while, pick up any rewrite that happened in the meantime
+	master, masterRel, err := masterPlaylist(mie)
+	if err != nil {
+		return mie, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return mie, err
+	}
+	if err := os.Rename(workDir, dir); err != nil {
+		return mie, err
+	}
+
+	hasGroup := false
+	for _, r := range master.Renditions {
+		hasGroup = hasGroup || r.Type() == "AUDIO"
+	}
+	if !hasGroup {
+		master.Renditions = append(master.Renditions, hls.Rendition{Attributes: map[string]string{
+			"TYPE":       "AUDIO",
+			"GROUP-ID":   audioGroup,
+			"NAME":       "Original",
+			"DEFAULT":    "YES",
+			"AUTOSELECT": "YES",
+		}})
+		for _, v := range master.Variants {
+			if !audioOnly(v) {
+				v.Attributes["AUDIO"] = audioGroup
+			}
+		}
+	}
+	master.Renditions = removeRenditions(master.Renditions, "AUDIO", track.Language)
+	if track.Default {
+		for _, r := range master.Renditions {
+			if r.Type() == "AUDIO" {
+				r.Attributes["DEFAULT"] = "NO"
+			}
+		}
+	}
+	attributes := map[string]string{
+		"TYPE":       "AUDIO",
+		"GROUP-ID":   audioGroup,
+		"LANGUAGE":   track.Language,
+		"NAME":       track.Name,
+		"DEFAULT":    "NO",
+		"AUTOSELECT": "YES",
+		"CHANNELS":   "2",
+		"URI":        path.Join(audioTracksDir, track.Language, "index.m3u8"),
+	}
+	if track.Default {
+		attributes["DEFAULT"] = "YES"
+	}
+	master.Renditions = append(master.Renditions, hls.Rendition{Attributes: attributes})
+	ensureDefaultRendition(master, "AUDIO")
+	if err := master.WriteFile(filepath.Join(mie.Location, filepath.FromSlash(masterRel))); err != nil {
+		return mie, err
+	}
+	return saveRenditions(catalog, withRenditions(mie, master, masterRel))
+}
+
+// receiveSource streams the "file" part of a multipart request to a new
+// ./chunks/source-<id>/ directory and returns the path it was written to
+func receiveSource(r *http.Request) (string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", fmt.Errorf("expected a multipart upload")
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", fmt.Errorf("missing file")
+		}
+		if err != nil {
+			return "", err
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(part.FileName()))
+		if !transcodeExtensions[ext] {
+			return "", fmt.Errorf("unsupported file type %q", ext)
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			return "", err
+		}
+		dir := filepath.Join("./chunks", "source-"+id)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		source := filepath.Join(dir, "source"+ext)
+		f, err := os.Create(source)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		n, err := io.Copy(f, io.LimitReader(part, MaxArchiveBytes+1))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && n > MaxArchiveBytes {
+			err = fmt.Errorf("file is larger than %d bytes", MaxArchiveBytes)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		return source, nil
+	}
+}
+
+// AudioTracksHandler manages the alternate audio tracks of a video. Viewers can
+// list them, changing them needs the uploader role
+//
+//	GET    /audiotracks/video/<id>           list the tracks
+//	POST   /audiotracks/video/<id>/<lang>    multipart "file", any audio or video file
+//	DELETE /audiotracks/video/<id>/<lang>
+//
+// POST also takes ?name= for the label players show and ?default=true. Adding a
+// track is queued as a job and answered with 202 and the job
+func AudioTracksHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/audiotracks/"), "/"), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] != "video" || !validID(parts[1]) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		language := ""
+		if len(parts) == 3 {
+			language = parts[2]
+			if !languagePattern.MatchString(language) {
+				http.Error(w, "Invalid language tag", http.StatusBadRequest)
+				return
+			}
+		}
+		user, _ := currentUser(r)
+		if r.Method != http.MethodGet && roleRank[user.Role] < roleRank[RoleUploader] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mie, err := lookupEntry(catalog, parts[0], parts[1])
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && language == "":
+			master, masterRel, err := masterPlaylist(mie)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Unable to read the playlist", http.StatusInternalServerError)
+				return
+			}
+			tracks := audioTracks(master, masterRel)
+			if tracks == nil {
+				tracks = []db.AudioTrack{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tracks)
+		case r.Method == http.MethodPost && language != "":
+			source, err := receiveSource(r)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			isDefault, _ := strconv.ParseBool(r.URL.Query().Get("default"))
+			track := &db.AudioTrack{Language: language, Name: r.URL.Query().Get("name"), Default: isDefault}
+			if track.Name == "" {
+				track.Name = language
+			}
+			job, err := Jobs.Submit(db.Job{
+				Kind:     JobAudioTrack,
+				Owner:    user.Username,
+				Metadata: db.MediaIndexEntry(mie),
+				Track:    track,
+				Source:   source,
+			})
+			if err != nil {
+				os.RemoveAll(filepath.Dir(source))
+				Log.Error(err.Error())
+				http.Error(w, "Unable to queue the track", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+		case r.Method == http.MethodDelete && language != "":
+			mie, err = detachRendition(mie, "AUDIO", audioTracksDir, language)
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "No audio track for that language", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Unable to remove the track", http.StatusInternalServerError)
+				return
+			}
+			mie, err = saveRenditions(catalog, mie)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Unable to update the entry", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mie)
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		}
+	}
+}
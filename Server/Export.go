@@ -0,0 +1,254 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// exportList is what a playlist file is rendered from
+type exportList struct {
+	Name    string
+	Entries []db.MediaIndexEntry
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location"`
+	Title      string `xml:"title"`
+	Annotation string `xml:"annotation,omitempty"`
+	Duration   int64  `xml:"duration,omitempty"`
+	Image      string `xml:"image,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// m3uText keeps a title on its #EXTINF line
+func m3uText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// renderM3U writes an extended M3U. Durations are whole seconds, -1 when unknown
+func renderM3U(list exportList, prefix string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%v\n", m3uText(list.Name))
+	for _, entry := range list.Entries {
+		duration := int64(-1)
+		if entry.Duration > 0 {
+			duration = int64(math.Round(entry.Duration))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%v\n", duration, m3uText(entry.Title))
+		fmt.Fprintf(&b, "%v\n", entryFileURL(prefix, entry, entryPlaylist(entry)))
+	}
+	return b.String()
+}
+
+// renderXSPF writes an XSPF playlist. Durations are in milliseconds
+func renderXSPF(list exportList, prefix string) ([]byte, error) {
+	playlist := xspfPlaylist{Version: "1", Title: list.Name, Tracks: []xspfTrack{}}
+	for _, entry := range list.Entries {
+		track := xspfTrack{
+			Location:   entryFileURL(prefix, entry, entryPlaylist(entry)),
+			Title:      entry.Title,
+			Annotation: entry.Description,
+			Duration:   int64(math.Round(entry.Duration * 1000)),
+		}
+		if entry.Poster != "" {
+			track.Image = entryFileURL(prefix, entry, entry.Poster)
+		}
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+	data, err := xml.MarshalIndent(playlist, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// exportEntries collects the entries to export. A saved playlist is taken from
+// ?playlist=, anything else is a query of ?mType= using the /dir/ parameters,
+// narrowed to a folder and its subfolders by ?folder=
+func exportEntries(catalog db.MediaRepository, user db.User, r *http.Request) (exportList, int, error) {
+	params := r.URL.Query()
+	if id := params.Get("playlist"); id != "" {
+		playlist, err := Playlists.GetPlaylist(CTX, id)
+		if err == nil && playlist.Owner != user.Username && user.Role != RoleAdmin {
+			err = db.ErrNotFound
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			return exportList{}, http.StatusNotFound, errors.New("Playlist not found")
+		}
+		if err == nil {
+			playlist, err = expandPlaylist(catalog, playlist)
+		}
+		if err != nil {
+			return exportList{}, http.StatusInternalServerError, err
+		}
+		list := exportList{Name: playlist.Name}
+		for _, item := range playlist.Items {
+			if item.Entry != nil {
+				list.Entries = append(list.Entries, *item.Entry)
+			}
+		}
+		return list, http.StatusOK, nil
+	}
+
+	mediaType := params.Get("mType")
+	if mediaType != "video" && mediaType != "audio" {
+		return exportList{}, http.StatusBadRequest, errors.New("Invalid media type")
+	}
+	folder, ok := cleanFolder(params.Get("folder"))
+	if !ok {
+		return exportList{}, http.StatusBadRequest, errors.New("Invalid folder")
+	}
+	query := db.EntryQuery{
+		Text:      params.Get("q"),
+		Genre:     params.Get("genre"),
+		Tag:       params.Get("tag"),
+		Directory: params.Get("directory"),
+		Sort:      params.Get("sort"),
+	}
+	if query.Sort == "" {
+		query.Sort = "title"
+	}
+	entries, _, err := catalog.QueryEntries(CTX, mediaType, query)
+	if errors.Is(err, db.ErrInvalidQuery) {
+		return exportList{}, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return exportList{}, http.StatusInternalServerError, err
+	}
+	list := exportList{Name: "Farnsworth " + mediaType}
+	if folder != "" {
+		list.Name = folder
+	}
+	for _, entry := range entries {
+		dir, _ := cleanFolder(entry.Directory)
+		if inFolder(dir, folder) {
+			list.Entries = append(list.Entries, entry)
+		}
+	}
+	return list, http.StatusOK, nil
+}
+
+// ExportHandler renders a saved playlist, a folder or a search as a playlist
+// file for players such as VLC and mpv. The media URLs in it carry a token
+// that can only fetch the files of the listed entries
+//
+//	GET /export/?format=m3u8&playlist=<id>
+//	GET /export/?format=xspf&mType=audio&folder=Lectures/Physics
+//	GET /export/?format=m3u&mType=video&q=star&genre=&tag=&directory=&sort=
+//
+// format is m3u, m3u8 or xspf, m3u8 being the default
+func ExportHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "m3u8"
+		}
+		if format != "m3u" && format != "m3u8" && format != "xspf" {
+			http.Error(w, "format must be m3u, m3u8 or xspf", http.StatusBadRequest)
+			return
+		}
+		user, _ := currentUser(r)
+		list, status, err := exportEntries(catalog, user, r)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				Log.Error(err.Error())
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if len(list.Entries) > MaxPlaylistItems {
+			http.Error(w, fmt.Sprintf("Cannot export more than %d entries", MaxPlaylistItems), http.StatusBadRequest)
+			return
+		}
+
+		prefix := publicBaseURL(r) + "/stream/"
+		if len(list.Entries) > 0 {
+			scope := make([]string, 0, len(list.Entries))
+			for _, entry := range list.Entries {
+				scope = append(scope, entry.MediaType+"/"+entry.ID)
+			}
+			token, _, err := NewMediaToken(CTX, user.Username, scope)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			prefix += token
+		}
+
+		filename := strings.NewReplacer(`"`, "", "/", "-", `\`, "-").Replace(list.Name) + "." + format
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, filename))
+		if format == "xspf" {
+			data, err := renderXSPF(list, prefix)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/xspf+xml")
+			w.Write(data)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		w.Write([]byte(renderM3U(list, prefix)))
+	}
+}
+
+// ServeStreamHandler serves /stream/<token>/<type>/<id>/<file> for the media
+// tokens in exported playlists. The token sits in the path so the relative
+// segment and rendition URLs inside the HLS playlists keep working
+func ServeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/stream/"), "/", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	token, mediaType, id := parts[0], parts[1], parts[2]
+	session, ok := ValidateSession(CTX, token)
+	if !ok || !streamAllowed(session, mediaType, id) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Removing the user, or taking away their role, cuts off their tokens too
+	user, err := Users.GetUser(CTX, session.Username)
+	if err != nil || roleRank[user.Role] < roleRank[RoleViewer] {
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			Log.Error(err.Error())
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	serveMedia(w, r, filepath.Join("./media", mediaType, id, filepath.FromSlash(path.Clean("/"+parts[3]))))
+}
+
+// streamAllowed reports whether a media token covers an entry
+func streamAllowed(session db.Session, mediaType, id string) bool {
+	if !validID(id) {
+		return false
+	}
+	for _, scope := range session.Scope {
+		if scope == mediaType+"/"+id {
+			return true
+		}
+	}
+	return false
+}
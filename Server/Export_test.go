@@ -0,0 +1,188 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamAllowed(t *testing.T) {
+	session := db.Session{Scope: []string{"video/abc", "audio/def"}}
+	tests := []struct {
+		name      string
+		session   db.Session
+		mediaType string
+		id        string
+		want      bool
+	}{
+		{"in scope", session, "video", "abc", true},
+		{"second scope", session, "audio", "def", true},
+		{"other entry", session, "video", "xyz", false},
+		{"other type", session, "audio", "abc", false},
+		{"unscoped session", db.Session{}, "video", "abc", false},
+		{"traversal", db.Session{Scope: []string{"video/.."}}, "video", "..", false},
+		{"empty id", db.Session{Scope: []string{"video/"}}, "video", "", false},
+		{"slash in id", db.Session{Scope: []string{"video/abc/def"}}, "video", "abc/def", false},
+	}
+	for _, tt := range tests {
+		if got := streamAllowed(tt.session, tt.mediaType, tt.id); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderM3U(t *testing.T) {
+	list := exportList{Name: "Mix\nTape", Entries: []db.MediaIndexEntry{
+		{ID: "a1", Title: "Show  One", MediaType: "video", Duration: 61.6},
+		{ID: "b 2", Title: "Song", MediaType: "audio", Playlist: "master.m3u8"},
+	}}
+	want := "#EXTM3U\n#PLAYLIST:Mix Tape\n" +
+		"#EXTINF:62,Show One\nhttp://host/stream/tok/video/a1/output.m3u8\n" +
+		"#EXTINF:-1,Song\nhttp://host/stream/tok/audio/b%202/master.m3u8\n"
+	if got := renderM3U(list, "http://host/stream/tok"); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRenderXSPF(t *testing.T) {
+	list := exportList{Name: "Mix", Entries: []db.MediaIndexEntry{
+		{ID: "a1", Title: "Show & Tell", Description: "<b>", MediaType: "video", Duration: 1.5, Poster: "poster.jpg"},
+	}}
+	data, err := renderXSPF(list, "http://host/stream/tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var playlist xspfPlaylist
+	if err := xml.Unmarshal(data, &playlist); err != nil {
+		t.Fatal(err)
+	}
+	if playlist.Title != "Mix" || len(playlist.Tracks) != 1 {
+		t.Fatalf("got %+v", playlist)
+	}
+	track := playlist.Tracks[0]
+	if track.Title != "Show & Tell" || track.Annotation != "<b>" || track.Duration != 1500 ||
+		track.Location != "http://host/stream/tok/video/a1/output.m3u8" || track.Image != "http://host/stream/tok/video/a1/poster.jpg" {
+		t.Errorf("got %+v", track)
+	}
+}
+
+// exportedURLs returns the media URLs of an M3U playlist
+func exportedURLs(m3u string) []string {
+	var urls []string
+	for _, line := range strings.Split(m3u, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls
+}
+
+func TestExportHandler(t *testing.T) {
+	setupUsers(t)
+	catalog := setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "Beta", MediaType: "audio", Directory: "Lectures/Physics"},
+		db.MediaIndexEntry{ID: "b2", Title: "Alpha", MediaType: "audio", Directory: "Lectures/Physics/Extra"},
+		db.MediaIndexEntry{ID: "c3", Title: "Gamma", MediaType: "audio", Directory: "Music"},
+	)
+	os.WriteFile(filepath.Join("media", "audio", "a1", "output.m3u8"), []byte("#EXTM3U\n"), 0644)
+	os.WriteFile(filepath.Join("media", "audio", "c3", "output.m3u8"), []byte("#EXTM3U\n"), 0644)
+	store, err := newFilePlaylistStore(filepath.Join(t.TempDir(), "playlists.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Playlists = store
+	store.AddPlaylist(CTX, db.Playlist{ID: "p1", Owner: RoleViewer, Name: "Mine", Items: []db.PlaylistItem{
+		{MediaType: "audio", EntryID: "c3"}, {MediaType: "audio", EntryID: "deleted"},
+	}})
+	store.AddPlaylist(CTX, db.Playlist{ID: "p2", Owner: RoleAdmin, Name: "Theirs"})
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		urls  int
+	}{
+		{"folder and subfolders by title", "?format=m3u&mType=audio&folder=Lectures/Physics", http.StatusOK, 2},
+		{"search", "?mType=audio&q=gamma", http.StatusOK, 1},
+		{"nothing found", "?mType=audio&folder=Empty", http.StatusOK, 0},
+		{"bad format", "?format=pls&mType=audio", http.StatusBadRequest, 0},
+		{"bad media type", "?mType=image", http.StatusBadRequest, 0},
+		{"bad folder", "?mType=audio&folder=../x", http.StatusBadRequest, 0},
+		{"bad sort", "?mType=audio&sort=rating", http.StatusBadRequest, 0},
+		{"playlist without deleted entries", "?format=xspf&playlist=p1", http.StatusOK, 0},
+		{"unknown playlist", "?playlist=nope", http.StatusNotFound, 0},
+		{"playlist of another user", "?playlist=p2", http.StatusNotFound, 0},
+	}
+	var urls []string
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/export/"+tt.query, nil)
+		w := serveAs(t, RoleViewer, RequireRole(RoleViewer, ExportHandler(catalog)), r)
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		if strings.Contains(tt.query, "xspf") {
+			var playlist xspfPlaylist
+			if err := xml.Unmarshal(w.Body.Bytes(), &playlist); err != nil || playlist.Title != "Mine" || len(playlist.Tracks) != 1 {
+				t.Errorf("%v: got %+v, %v", tt.name, playlist, err)
+			}
+			continue
+		}
+		got := exportedURLs(w.Body.String())
+		if len(got) != tt.urls {
+			t.Errorf("%v: got %v", tt.name, got)
+		}
+		if tt.name == "folder and subfolders by title" {
+			urls = got
+		}
+	}
+	if len(urls) != 2 || !strings.Contains(urls[0], "/audio/b2/") || !strings.Contains(urls[1], "/audio/a1/") {
+		t.Fatalf("got %v, want b2 then a1", urls)
+	}
+
+	// The token in the URLs reaches the exported entries and nothing else
+	token := strings.Split(strings.TrimPrefix(urls[1], "http://example.com/stream/"), "/")[0]
+	streams := []struct {
+		name string
+		path string
+		code int
+	}{
+		{"exported entry", "/stream/" + token + "/audio/a1/output.m3u8", http.StatusOK},
+		{"other entry", "/stream/" + token + "/audio/c3/output.m3u8", http.StatusUnauthorized},
+		{"other media type", "/stream/" + token + "/video/a1/output.m3u8", http.StatusUnauthorized},
+		{"unknown token", "/stream/nope/audio/a1/output.m3u8", http.StatusUnauthorized},
+		{"no file", "/stream/" + token + "/audio/a1/", http.StatusBadRequest},
+	}
+	for _, tt := range streams {
+		w := httptest.NewRecorder()
+		ServeStreamHandler(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+
+	// A media token is not a session
+	r := httptest.NewRequest(http.MethodGet, "/export/?mType=audio", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	CheckToken(ExportHandler(catalog))(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a media token opened the API: got %d", w.Code)
+	}
+
+	// Nor does it outlive the user's access
+	Users.DeleteUser(CTX, RoleViewer)
+	w = httptest.NewRecorder()
+	ServeStreamHandler(w, httptest.NewRequest(http.MethodGet, "/stream/"+token+"/audio/a1/output.m3u8", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a token of a deleted user: got %d", w.Code)
+	}
+}
@@ -6,19 +6,22 @@ import (
 	"fmt"
 	"github.com/joho/godotenv"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 var DBClient *db.MongoClient
 var CTX context.Context
-var ExpectedUser string
-var ExpectedKey string
 var DBConnected bool
 var DevelopmentCORS bool
 var Log *Logger
 
 func main() {
 	var err error
+	CTX = context.Background()
 	Log, err = NewLogger("./logs/app.log", 500)
 	if err != nil {
 		fmt.Println("Error initializing logger:", err)
@@ -28,18 +31,12 @@ func main() {
 	if err != nil {
 		Log.Info("Error loading .env file. This is normal for production server")
 	}
-	ExpectedUser = os.Getenv("EXPECTED_USER")
-	ExpectedKey = os.Getenv("EXPECTED_KEY")
-	if ExpectedUser == "" || ExpectedKey == "" {
-		Log.Error("FATAL: Credentials not set in env")
-		log.Fatal("Credentials not set in env")
-	}
 	mongoURI := os.Getenv("MONGODB_URI")
 	dbName := os.Getenv("MONGODB_DB_NAME")
 	DevelopmentCORS = os.Getenv("DevCORS") == "true"
 	Log.Info(fmt.Sprintf("Development CORS enabled: %v", DevelopmentCORS))
 	if mongoURI == "" || dbName == "" {
-		Log.Error(fmt.Sprintf("MongoDB connection information not set in env. Client will not load. Limited functionality"))
+		Log.Error(fmt.Sprintf("MongoDB connection information not set in env. Client will not load. Using local stores"))
 
 	} else {
 		DBClient, err = db.NewMongoClient(mongoURI, dbName)
@@ -51,5 +48,293 @@ func main() {
 		}
 	}
 
-	Route()
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		SessionTTL, err = time.ParseDuration(ttl)
+		if err != nil || SessionTTL <= 0 {
+			Log.Error("FATAL: SESSION_TTL is not a valid duration")
+			log.Fatal("SESSION_TTL is not a valid duration")
+		}
+	}
+	if ttl := os.Getenv("MEDIA_TOKEN_TTL"); ttl != "" {
+		MediaTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil || MediaTokenTTL <= 0 {
+			Log.Error("FATAL: MEDIA_TOKEN_TTL is not a valid duration")
+			log.Fatal("MEDIA_TOKEN_TTL is not a valid duration")
+		}
+	}
+	if v := os.Getenv("MAX_ARCHIVE_BYTES"); v != "" {
+		MaxArchiveBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || MaxArchiveBytes <= 0 {
+			Log.Error("FATAL: MAX_ARCHIVE_BYTES is not a positive integer")
+			log.Fatal("MAX_ARCHIVE_BYTES is not a positive integer")
+		}
+	}
+	if v := os.Getenv("MAX_ARCHIVE_FILES"); v != "" {
+		MaxArchiveFiles, err = strconv.Atoi(v)
+		if err != nil || MaxArchiveFiles <= 0 {
+			Log.Error("FATAL: MAX_ARCHIVE_FILES is not a positive integer")
+			log.Fatal("MAX_ARCHIVE_FILES is not a positive integer")
+		}
+	}
+
+	if v := os.Getenv("MAX_CHUNK_BYTES"); v != "" {
+		MaxChunkBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || MaxChunkBytes <= 0 {
+			Log.Error("FATAL: MAX_CHUNK_BYTES is not a positive integer")
+			log.Fatal("MAX_CHUNK_BYTES is not a positive integer")
+		}
+	}
+
+	if DBConnected {
+		// Entries used to be keyed by title, give any left from then an id before indexing
+		err = migrateEntryIDs()
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to migrate entries to ids: %v", err))
+			log.Fatal(err)
+		}
+		err = DBClient.BackfillAddedDates(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureMediaIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureSessionIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureUserIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureJobIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureProgressIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsurePlaylistIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureFeedIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		err = DBClient.EnsureShareIndexes(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+		}
+		Sessions = DBClient
+		Users = DBClient
+		WatchProgress = DBClient
+		Playlists = DBClient
+		Feeds = DBClient
+		Shares = DBClient
+	} else {
+		Sessions, err = newFileSessionStore("./data/sessions.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load session store: %v", err))
+			log.Fatal(err)
+		}
+		Users, err = newFileUserStore("./data/users.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load user store: %v", err))
+			log.Fatal(err)
+		}
+		WatchProgress, err = newFileProgressStore("./data/progress.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load progress store: %v", err))
+			log.Fatal(err)
+		}
+		Playlists, err = newFilePlaylistStore("./data/playlists.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load playlist store: %v", err))
+			log.Fatal(err)
+		}
+		Feeds, err = newFileFeedStore("./data/feeds.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load feed store: %v", err))
+			log.Fatal(err)
+		}
+		Shares, err = newFileShareStore("./data/shares.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load share store: %v", err))
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("WATCHED_THRESHOLD"); v != "" {
+		WatchedThreshold, err = strconv.ParseFloat(v, 64)
+		if err != nil || WatchedThreshold <= 0 || WatchedThreshold > 1 {
+			Log.Error("FATAL: WATCHED_THRESHOLD is not a fraction between 0 and 1")
+			log.Fatal("WATCHED_THRESHOLD is not a fraction between 0 and 1")
+		}
+	}
+	if v := os.Getenv("PUBLIC_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			Log.Error("FATAL: PUBLIC_URL is not an http or https URL")
+			log.Fatal("PUBLIC_URL is not an http or https URL")
+		}
+		PublicURL = v
+	}
+	TrustProxy = os.Getenv("TRUST_PROXY") == "true"
+	if PublicURL == "" {
+		Log.Error(fmt.Sprintf("PUBLIC_URL is not set, links handed out are built on the request's host (trusting X-Forwarded headers: %v)", TrustProxy))
+	}
+	if v := os.Getenv("SHARE_SECRET"); v != "" {
+		ShareKey = []byte(v)
+	} else {
+		ShareKey, err = loadShareKey("./data/share.key")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load share key: %v", err))
+			log.Fatal(err)
+		}
+	}
+	if ttl := os.Getenv("SHARE_MAX_TTL"); ttl != "" {
+		MaxShareTTL, err = time.ParseDuration(ttl)
+		if err != nil || MaxShareTTL <= 0 {
+			Log.Error("FATAL: SHARE_MAX_TTL is not a valid duration")
+			log.Fatal("SHARE_MAX_TTL is not a valid duration")
+		}
+		if DefaultShareTTL > MaxShareTTL {
+			DefaultShareTTL = MaxShareTTL
+		}
+	}
+	go pruneSessionsPeriodically(CTX, time.Hour)
+	go pruneSharesPeriodically(CTX, time.Hour)
+
+	// The first admin comes from the credentials the server used to run with
+	err = SeedAdmin(CTX, os.Getenv("EXPECTED_USER"), os.Getenv("EXPECTED_KEY"))
+	if err != nil {
+		Log.Error(fmt.Sprintf("FATAL: Unable to seed admin account: %v", err))
+		log.Fatal(err)
+	}
+
+	if v := os.Getenv("FFMPEG_PATH"); v != "" {
+		FFmpegPath = v
+	}
+	if v := os.Getenv("FFPROBE_PATH"); v != "" {
+		FFprobePath = v
+	}
+	if v := os.Getenv("TRANSCODE_LADDER"); v != "" {
+		TranscodeLadder, err = ParseLadder(v)
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: TRANSCODE_LADDER is invalid: %v", err))
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("TRANSCODE_AUDIO_BITRATE"); v != "" {
+		AudioBitrate, err = ParseBitrate(v)
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: TRANSCODE_AUDIO_BITRATE is invalid: %v", err))
+			log.Fatal(err)
+		}
+	}
+	workers := 1
+	if v := os.Getenv("TRANSCODE_WORKERS"); v != "" {
+		workers, err = strconv.Atoi(v)
+		if err != nil || workers <= 0 {
+			Log.Error("FATAL: TRANSCODE_WORKERS is not a positive integer")
+			log.Fatal("TRANSCODE_WORKERS is not a positive integer")
+		}
+	}
+	var jobStore JobStore = DBClient
+	if !DBConnected {
+		jobStore, err = newFileJobStore("./data/jobs.json")
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to load job store: %v", err))
+			log.Fatal(err)
+		}
+	}
+	catalog, err := openCatalog(os.Getenv("CATALOG_BACKEND"))
+	if err != nil {
+		Log.Error(fmt.Sprintf("FATAL: Unable to open the catalog: %v", err))
+		log.Fatal(err)
+	}
+	removeWorkDirectories()
+	Jobs = NewJobQueue(jobStore, catalog)
+	err = Jobs.Start(workers)
+	if err != nil {
+		Log.Error(fmt.Sprintf("FATAL: Unable to recover jobs: %v", err))
+		log.Fatal(err)
+	}
+	go Jobs.pruneJobSourcesPeriodically(CTX, time.Hour)
+
+	if dir := os.Getenv("INBOX_DIR"); dir != "" {
+		interval := 30 * time.Second
+		if v := os.Getenv("INBOX_INTERVAL"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval <= 0 {
+				Log.Error("FATAL: INBOX_INTERVAL is not a valid duration")
+				log.Fatal("INBOX_INTERVAL is not a valid duration")
+			}
+		}
+		inbox, err := newInboxWatcher(dir)
+		if err != nil {
+			Log.Error(fmt.Sprintf("FATAL: Unable to watch INBOX_DIR: %v", err))
+			log.Fatal(err)
+		}
+		Log.Info(fmt.Sprintf("Watching %v for new media every %v", dir, interval))
+		go inbox.watch(CTX, interval)
+	}
+	if v := os.Getenv("SCAN_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			Log.Error("FATAL: SCAN_INTERVAL is not a valid duration")
+			log.Fatal("SCAN_INTERVAL is not a valid duration")
+		}
+		go scanMediaPeriodically(CTX, catalog, interval)
+	}
+
+	resetUploadSessions()
+	pruneUploadSessions()
+	go pruneUploadSessionsPeriodically(CTX, time.Hour)
+
+	Route(catalog)
+}
+
+// openCatalog opens the media catalog named by CATALOG_BACKEND: "mongo", "bolt"
+// or "memory". Without a backend set the catalog lives in MongoDB when it is
+// connected and in ./data/catalog.db otherwise. The local backends are scanned
+// on startup, they start out empty or may have been copied without the media
+func openCatalog(backend string) (db.MediaRepository, error) {
+	if backend == "" {
+		backend = "bolt"
+		if DBConnected {
+			backend = "mongo"
+		}
+	}
+	var catalog db.MediaRepository
+	switch backend {
+	case "mongo":
+		if !DBConnected {
+			return nil, fmt.Errorf("CATALOG_BACKEND is mongo but MongoDB is not connected")
+		}
+		return DBClient, nil
+	case "bolt":
+		path := os.Getenv("CATALOG_PATH")
+		if path == "" {
+			path = "./data/catalog.db"
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		bolt, err := db.NewBoltRepository(path)
+		if err != nil {
+			return nil, err
+		}
+		catalog = bolt
+	case "memory":
+		catalog = db.NewMemoryRepository()
+	default:
+		return nil, fmt.Errorf("unknown CATALOG_BACKEND %q", backend)
+	}
+	Log.Info(fmt.Sprintf("Using the %v catalog", backend))
+	report, err := scanMedia(catalog)
+	logScan(report)
+	return catalog, err
 }
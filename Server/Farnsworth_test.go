@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "farnsworth-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	Log, err = NewLogger(filepath.Join(dir, "test.log"), 500)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	CTX = context.Background()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useTempDir makes a temporary directory the working directory of a test, so
+// ./media, ./data and ./chunks start out empty
+func useTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FeedStore persists podcast feeds. *db.MongoClient implements it when the
+// database is connected, fileFeedStore otherwise
+type FeedStore interface {
+	AddFeed(ctx context.Context, feed db.Feed) error
+	GetFeed(ctx context.Context, id string) (db.Feed, error)
+	ListFeeds(ctx context.Context, owner string) ([]db.Feed, error)
+	UpdateFeed(ctx context.Context, feed db.Feed) error
+	DeleteFeed(ctx context.Context, id string) error
+}
+
+var Feeds FeedStore
+
+const JobPodcast = "podcast"
+
+// episodeFile is the single file audio entries are remuxed into for podcast
+// apps, which cannot play HLS. It is kept in the entry's directory
+const episodeFile = "podcast.m4a"
+
+// episodeLocks holds a mutex per entry so two jobs never remux the same one at once
+var episodeLocks sync.Map
+
+// queuedEpisodes holds the entries with an episode job waiting or running, so
+// fetching a feed does not queue them again. A failed one stays until its job
+// is retried or the server restarts
+var queuedEpisodes = map[string]bool{}
+var queuedEpisodesMutex sync.Mutex
+
+type feedRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Directory   string `json:"directory"`
+	Tag         string `json:"tag"`
+	Order       string `json:"order"`
+}
+
+// feedSubscription is a feed with the URL to subscribe to. The URL holds the
+// secret, so it is only given out when the secret is made
+type feedSubscription struct {
+	db.Feed
+	URL string `json:"url"`
+}
+
+type rssImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Description string       `xml:"description"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+	Duration    int64        `xml:"itunes:duration,omitempty"`
+	Episode     int          `xml:"itunes:episode,omitempty"`
+	Image       *rssImage    `xml:"itunes:image,omitempty"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          rssLink   `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Author        string    `xml:"itunes:author"`
+	Type          string    `xml:"itunes:type"`
+	Explicit      string    `xml:"itunes:explicit"`
+	Image         *rssImage `xml:"itunes:image,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// checkFeed validates a feed request. A feed has to be narrowed to a directory
+// or a tag so the whole audio library is never published by accident
+func checkFeed(req feedRequest) (feedRequest, error) {
+	req.Title = strings.TrimSpace(req.Title)
+	req.Tag = strings.TrimSpace(req.Tag)
+	if req.Title == "" {
+		return req, fmt.Errorf("title cannot be empty")
+	}
+	directory, ok := cleanFolder(req.Directory)
+	if !ok {
+		return req, fmt.Errorf("invalid directory")
+	}
+	req.Directory = directory
+	if req.Directory == "" && req.Tag == "" {
+		return req, fmt.Errorf("a feed needs a directory or a tag")
+	}
+	if req.Order == "" {
+		req.Order = "title"
+	}
+	if req.Order != "title" && req.Order != "added" {
+		return req, fmt.Errorf("order must be title or added")
+	}
+	return req, nil
+}
+
+// newFeedSecret makes a secret for a feed's URL and the hash stored in its
+// place, hashed the same way as session tokens
+func newFeedSecret() (string, string, error) {
+	secret, err := randomHex(20)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, sessionID(secret), nil
+}
+
+// feedPrefix is the URL the files of a feed are served below
+func feedPrefix(r *http.Request, feed db.Feed, secret string) string {
+	return fmt.Sprintf("%v/podcast/%v/%v", publicBaseURL(r), feed.ID, secret)
+}
+
+// feedIncludes reports whether an entry belongs in a feed
+func feedIncludes(feed db.Feed, entry db.MediaIndexEntry) bool {
+	if entry.MediaType != "audio" || entry.Missing {
+		return false
+	}
+	dir, _ := cleanFolder(entry.Directory)
+	if !inFolder(dir, feed.Directory) {
+		return false
+	}
+	return feed.Tag == "" || slices.Contains(entry.Tags, feed.Tag)
+}
+
+// feedEntries lists the entries of a feed in the feed's order
+func feedEntries(catalog db.MediaRepository, feed db.Feed) ([]db.MediaIndexEntry, error) {
+	query := db.EntryQuery{Tag: feed.Tag, Sort: "title"}
+	if feed.Order == "added" {
+		query.Sort = "-added"
+	}
+	entries, _, err := catalog.QueryEntries(CTX, "audio", query)
+	if err != nil {
+		return nil, err
+	}
+	included := []db.MediaIndexEntry{}
+	for _, entry := range entries {
+		if feedIncludes(feed, entry) {
+			included = append(included, entry)
+		}
+	}
+	return included, nil
+}
+
+func episodePath(entry db.MediaIndexEntry) string {
+	return filepath.Join(mediaLocation(MediaIndexEntry(entry)), episodeFile)
+}
+
+// episodeLength is the size of an entry's remuxed episode, 0 until its job has
+// made it
+func episodeLength(entry db.MediaIndexEntry) int64 {
+	info, err := os.Stat(episodePath(entry))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// renderFeed writes an RSS 2.0 feed with the iTunes tags podcast apps look for.
+// A feed in title order is a serial with numbered episodes. Entries whose
+// episode has not been made yet are left out until it has
+func renderFeed(feed db.Feed, entries []db.MediaIndexEntry, prefix, link string) ([]byte, error) {
+	channel := rssChannel{
+		Title:         feed.Title,
+		Link:          link,
+		Description:   feed.Description,
+		Self:          rssLink{Href: prefix + "/feed.xml", Rel: "self", Type: "application/rss+xml"},
+		LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+		Author:        "Farnsworth",
+		Type:          "episodic",
+		Explicit:      "false",
+		Items:         []rssItem{},
+	}
+	if feed.Order == "title" {
+		channel.Type = "serial"
+	}
+	for i, entry := range entries {
+		length := episodeLength(entry)
+		if length == 0 {
+			continue
+		}
+		added := entry.Added
+		if added.IsZero() {
+			added = feed.Created
+		}
+		item := rssItem{
+			Title:       entry.Title,
+			Description: entry.Description,
+			GUID:        rssGUID{IsPermaLink: "false", Value: "farnsworth:" + entry.MediaType + "/" + entry.ID},
+			PubDate:     added.UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{
+				URL:    fmt.Sprintf("%v/%v/%v", prefix, entry.ID, episodeFile),
+				Length: length,
+				Type:   "audio/mp4",
+			},
+			Duration: int64(math.Round(entry.Duration)),
+		}
+		if feed.Order == "title" {
+			item.Episode = i + 1
+		}
+		if entry.Poster != "" {
+			item.Image = &rssImage{Href: fmt.Sprintf("%v/%v/%v", prefix, entry.ID, entry.Poster)}
+			if channel.Image == nil {
+				channel.Image = item.Image
+			}
+		}
+		channel.Items = append(channel.Items, item)
+	}
+	data, err := xml.MarshalIndent(rssFeed{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: channel,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// queueEpisode queues the job that makes an entry's episode, unless it has
+// been made or is already queued
+func queueEpisode(entry db.MediaIndexEntry, owner string) {
+	if entry.MediaType != "audio" || Jobs == nil {
+		return
+	}
+	if _, err := os.Stat(episodePath(entry)); err == nil {
+		return
+	}
+	queuedEpisodesMutex.Lock()
+	defer queuedEpisodesMutex.Unlock()
+	if queuedEpisodes[entry.ID] {
+		return
+	}
+	if _, err := Jobs.Submit(db.Job{Kind: JobPodcast, Owner: owner, Metadata: entry}); err != nil {
+		Log.Error(fmt.Sprintf("Unable to queue podcast episode for %v: %v", entry.Title, err))
+		return
+	}
+	queuedEpisodes[entry.ID] = true
+}
+
+// queueFeedEpisodes queues the episodes of a feed that have not been made yet
+func queueFeedEpisodes(catalog db.MediaRepository, feed db.Feed) {
+	entries, err := feedEntries(catalog, feed)
+	if err != nil {
+		Log.Error(err.Error())
+		return
+	}
+	for _, entry := range entries {
+		queueEpisode(entry, feed.Owner)
+	}
+}
+
+// queueNewEpisode queues the episode of an entry that was just added when a
+// feed includes it
+func queueNewEpisode(mie MediaIndexEntry, owner string) {
+	if mie.MediaType != "audio" || Feeds == nil {
+		return
+	}
+	feeds, err := Feeds.ListFeeds(CTX, "")
+	if err != nil {
+		Log.Error(err.Error())
+		return
+	}
+	for _, feed := range feeds {
+		if feedIncludes(feed, db.MediaIndexEntry(mie)) {
+			queueEpisode(db.MediaIndexEntry(mie), owner)
+			return
+		}
+	}
+}
+
+// preparePodcastEpisode is the JobPodcast runner. It remuxes an entry's HLS
+// audio into a single m4a, or encodes it to AAC when it is in a codec the
+// ipod muxer cannot take as is
+func preparePodcastEpisode(ctx context.Context, catalog db.MediaRepository, job db.Job, progress func(float64)) (MediaIndexEntry, error) {
+	mie := MediaIndexEntry(job.Metadata)
+	lock, _ := episodeLocks.LoadOrStore(mie.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	location := mediaLocation(mie)
+	out := filepath.Join(location, episodeFile)
+	if _, err := os.Stat(out); err != nil {
+		input := filepath.Join(location, entryPlaylist(job.Metadata))
+		probe, err := probeMedia(ctx, input)
+		if err != nil {
+			return mie, err
+		}
+		if !probe.HasAudio {
+			return mie, fmt.Errorf("entry has no audio")
+		}
+		codec := []string{"-c:a", "copy"}
+		if probe.AudioCodec != "aac" {
+			codec = []string{"-c:a", "aac", "-b:a", fmt.Sprint(AudioBitrate)}
+		}
+		tmp := out + ".tmp"
+		args := append([]string{"-hide_banner", "-nostdin", "-y", "-i", input, "-map", "0:a:0", "-vn"}, codec...)
+		args = append(args, "-movflags", "+faststart", "-f", "ipod", tmp)
+		if err := runFFmpeg(ctx, args, mie.Duration, progress); err != nil {
+			os.Remove(tmp)
+			return mie, err
+		}
+		if err := os.Rename(tmp, out); err != nil {
+			return mie, err
+		}
+	}
+
+	queuedEpisodesMutex.Lock()
+	delete(queuedEpisodes, mie.ID)
+	queuedEpisodesMutex.Unlock()
+	return mie, nil
+}
+
+// FeedsHandler manages the signed in user's podcast feeds. Admins can open,
+// change and delete anyone's
+//
+//	GET    /feeds/              the user's feeds
+//	POST   /feeds/              {"title": "", "description": "", "directory": "a/b", "tag": "", "order": "title"}
+//	GET    /feeds/<id>          one feed
+//	PUT    /feeds/<id>          replace the title, description, directory, tag and order
+//	DELETE /feeds/<id>          delete the feed, its URL stops working
+//	POST   /feeds/<id>/rotate   give the feed a new secret, the old URL stops working
+//
+// Creating and rotating answer with the feed's URL, which is not shown again.
+// Creating and changing a feed queues the episodes it is missing
+func FeedsHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := currentUser(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/feeds"), "/"), "/")
+
+		switch {
+		case parts[0] == "" && r.Method == http.MethodGet:
+			feeds, err := Feeds.ListFeeds(CTX, user.Username)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(feeds)
+			return
+		case parts[0] == "" && r.Method == http.MethodPost:
+			var req feedRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, "Invalid feed JSON", http.StatusBadRequest)
+				return
+			}
+			req, err := checkFeed(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := randomHex(12)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			secret, hash, err := newFeedSecret()
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			feed := db.Feed{
+				ID:          id,
+				Owner:       user.Username,
+				Title:       req.Title,
+				Description: req.Description,
+				Directory:   req.Directory,
+				Tag:         req.Tag,
+				Order:       req.Order,
+				SecretHash:  hash,
+				Created:     time.Now().UTC().Truncate(time.Millisecond),
+			}
+			if err := Feeds.AddFeed(CTX, feed); err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			queueFeedEpisodes(catalog, feed)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(feedSubscription{Feed: feed, URL: feedPrefix(r, feed, secret) + "/feed.xml"})
+			return
+		}
+
+		feed, err := Feeds.GetFeed(CTX, parts[0])
+		if err == nil && feed.Owner != user.Username && user.Role != RoleAdmin {
+			err = db.ErrNotFound
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var response any = feed
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+		case len(parts) == 1 && r.Method == http.MethodPut:
+			var req feedRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, "Invalid feed JSON", http.StatusBadRequest)
+				return
+			}
+			req, err = checkFeed(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			feed.Title, feed.Description, feed.Directory, feed.Tag, feed.Order = req.Title, req.Description, req.Directory, req.Tag, req.Order
+			response = feed
+			err = Feeds.UpdateFeed(CTX, feed)
+			if err == nil {
+				queueFeedEpisodes(catalog, feed)
+			}
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			err = Feeds.DeleteFeed(CTX, feed.ID)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case len(parts) == 2 && parts[1] == "rotate" && r.Method == http.MethodPost:
+			var secret string
+			secret, feed.SecretHash, err = newFeedSecret()
+			if err == nil {
+				err = Feeds.UpdateFeed(CTX, feed)
+			}
+			response = feedSubscription{Feed: feed, URL: feedPrefix(r, feed, secret) + "/feed.xml"}
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// PodcastHandler serves feeds to podcast apps, which authenticate with the
+// secret in the path instead of a bearer token
+//
+//	GET /podcast/<id>/<secret>/feed.xml              the RSS feed
+//	GET /podcast/<id>/<secret>/<entry>/podcast.m4a   an episode
+//	GET /podcast/<id>/<secret>/<entry>/<poster>      an episode's artwork
+func PodcastHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/podcast"), "/"), "/")
+		if len(parts) < 3 {
+			http.NotFound(w, r)
+			return
+		}
+		feed, ok := podcastFeed(parts[0], parts[1])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case len(parts) == 3 && parts[2] == "feed.xml":
+			entries, err := feedEntries(catalog, feed)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// Entries tagged or moved into the feed since it was saved
+			for _, entry := range entries {
+				queueEpisode(entry, feed.Owner)
+			}
+			data, err := renderFeed(feed, entries, feedPrefix(r, feed, parts[1]), publicBaseURL(r))
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+			w.Write(data)
+		case len(parts) == 4:
+			entry, err := catalog.GetEntry(CTX, "audio", parts[2])
+			if err != nil || !feedIncludes(feed, entry) {
+				if err != nil && !errors.Is(err, db.ErrNotFound) {
+					Log.Error(err.Error())
+				}
+				http.NotFound(w, r)
+				return
+			}
+			switch {
+			case parts[3] == episodeFile:
+				if episodeLength(entry) == 0 {
+					queueEpisode(entry, feed.Owner)
+					w.Header().Set("Retry-After", "300")
+					http.Error(w, "Episode is being prepared", http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Type", "audio/mp4")
+				http.ServeFile(w, r, episodePath(entry))
+			case entry.Poster != "" && parts[3] == entry.Poster:
+				http.ServeFile(w, r, filepath.Join(mediaLocation(MediaIndexEntry(entry)), entry.Poster))
+			default:
+				http.NotFound(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// podcastFeed finds the feed for a podcast URL. The feed's owner has to still
+// be able to see the library, or the feed stops working
+func podcastFeed(id, secret string) (db.Feed, bool) {
+	feed, err := Feeds.GetFeed(CTX, id)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			Log.Error(err.Error())
+		}
+		return feed, false
+	}
+	if subtle.ConstantTimeCompare([]byte(sessionID(secret)), []byte(feed.SecretHash)) != 1 {
+		return feed, false
+	}
+	user, err := Users.GetUser(CTX, feed.Owner)
+	if err != nil || roleRank[user.Role] < roleRank[RoleViewer] {
+		return feed, false
+	}
+	return feed, true
+}
+
+type fileFeedStore struct {
+	store *jsonFileStore[db.Feed]
+}
+
+func newFileFeedStore(path string) (*fileFeedStore, error) {
+	store, err := newJSONFileStore[db.Feed](path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileFeedStore{store: store}, nil
+}
+
+func (fs *fileFeedStore) AddFeed(ctx context.Context, feed db.Feed) error {
+	inserted, err := fs.store.insert(feed.ID, feed)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return db.ErrExists
+	}
+	return nil
+}
+
+func (fs *fileFeedStore) GetFeed(ctx context.Context, id string) (db.Feed, error) {
+	feed, ok := fs.store.get(id)
+	if !ok {
+		return feed, db.ErrNotFound
+	}
+	return feed, nil
+}
+
+func (fs *fileFeedStore) ListFeeds(ctx context.Context, owner string) ([]db.Feed, error) {
+	feeds := []db.Feed{}
+	for _, feed := range fs.store.list() {
+		if owner == "" || feed.Owner == owner {
+			feeds = append(feeds, feed)
+		}
+	}
+	sort.Slice(feeds, func(i, j int) bool {
+		if feeds[i].Title != feeds[j].Title {
+			return feeds[i].Title < feeds[j].Title
+		}
+		return feeds[i].ID < feeds[j].ID
+	})
+	return feeds, nil
+}
+
+func (fs *fileFeedStore) UpdateFeed(ctx context.Context, feed db.Feed) error {
+	found, err := fs.store.update(feed.ID, func(stored *db.Feed) {
+		stored.Title = feed.Title
+		stored.Description = feed.Description
+		stored.Directory = feed.Directory
+		stored.Tag = feed.Tag
+		stored.Order = feed.Order
+		stored.SecretHash = feed.SecretHash
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (fs *fileFeedStore) DeleteFeed(ctx context.Context, id string) error {
+	return fs.store.delete(id)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckFeed(t *testing.T) {
+	tests := []struct {
+		name string
+		req  feedRequest
+		err  bool
+		want feedRequest
+	}{
+		{name: "directory", req: feedRequest{Title: " Physics ", Directory: "/Lectures/Physics/"}, want: feedRequest{Title: "Physics", Directory: "Lectures/Physics", Order: "title"}},
+		{name: "tag", req: feedRequest{Title: "Talks", Tag: " talk ", Order: "added"}, want: feedRequest{Title: "Talks", Tag: "talk", Order: "added"}},
+		{name: "no title", req: feedRequest{Directory: "Lectures"}, err: true},
+		{name: "whole library", req: feedRequest{Title: "All", Directory: "/"}, err: true},
+		{name: "climbs out", req: feedRequest{Title: "Up", Directory: "../x"}, err: true},
+		{name: "bad order", req: feedRequest{Title: "x", Tag: "talk", Order: "duration"}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := checkFeed(tt.req)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %+v, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestFeedIncludes(t *testing.T) {
+	feed := db.Feed{Directory: "Lectures", Tag: "physics"}
+	tests := []struct {
+		name  string
+		entry db.MediaIndexEntry
+		want  bool
+	}{
+		{"in the folder with the tag", db.MediaIndexEntry{MediaType: "audio", Directory: "Lectures", Tags: []string{"physics"}}, true},
+		{"in a subfolder", db.MediaIndexEntry{MediaType: "audio", Directory: "Lectures/2024", Tags: []string{"physics"}}, true},
+		{"without the tag", db.MediaIndexEntry{MediaType: "audio", Directory: "Lectures"}, false},
+		{"in another folder", db.MediaIndexEntry{MediaType: "audio", Directory: "LecturesOld", Tags: []string{"physics"}}, false},
+		{"video", db.MediaIndexEntry{MediaType: "video", Directory: "Lectures", Tags: []string{"physics"}}, false},
+		{"missing", db.MediaIndexEntry{MediaType: "audio", Directory: "Lectures", Tags: []string{"physics"}, Missing: true}, false},
+	}
+	for _, tt := range tests {
+		if got := feedIncludes(feed, tt.entry); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// setupFeeds gives a test the test users, a file feed store, a job queue with
+// no workers and a catalog of audio entries. All but d4 have their episode
+func setupFeeds(t *testing.T) *db.MemoryRepository {
+	t.Helper()
+	setupUsers(t)
+	setupJobs(t)
+	queuedEpisodes = map[string]bool{}
+	addTestUser(t, "other", RoleViewer, "secret")
+	store, err := newFileFeedStore(filepath.Join(t.TempDir(), "feeds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Feeds = store
+	catalog := setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "Part 2", MediaType: "audio", Directory: "Lectures", Duration: 60.4, Poster: "poster.jpg"},
+		db.MediaIndexEntry{ID: "b2", Title: "Part 1", MediaType: "audio", Directory: "Lectures/Extra"},
+		db.MediaIndexEntry{ID: "c3", Title: "Song", MediaType: "audio", Directory: "Music"},
+		db.MediaIndexEntry{ID: "d4", Title: "Part 3", MediaType: "audio", Directory: "Lectures"},
+	)
+	for _, id := range []string{"a1", "b2", "c3"} {
+		os.WriteFile(filepath.Join("media", "audio", id, episodeFile), []byte("m4a"), 0644)
+	}
+	os.WriteFile(filepath.Join("media", "audio", "a1", "poster.jpg"), []byte("jpg"), 0644)
+	return catalog
+}
+
+func callFeeds(t *testing.T, catalog db.MediaRepository, user, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	return serveAs(t, user, RequireRole(RoleViewer, FeedsHandler(catalog)), r)
+}
+
+func getPodcast(catalog db.MediaRepository, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	PodcastHandler(catalog)(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestFeedsHandler(t *testing.T) {
+	catalog := setupFeeds(t)
+	if w := callFeeds(t, catalog, RoleViewer, http.MethodPost, "/feeds/", `{"title": "All"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("a feed of everything: got %d", w.Code)
+	}
+	w := callFeeds(t, catalog, RoleViewer, http.MethodPost, "/feeds/", `{"title": "Lectures", "directory": "Lectures"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %v", w.Code, w.Body)
+	}
+	var sub feedSubscription
+	json.NewDecoder(w.Body).Decode(&sub)
+	if sub.ID == "" || sub.Order != "title" || !strings.HasPrefix(sub.URL, "http://example.com/podcast/"+sub.ID+"/") {
+		t.Fatalf("got %+v", sub)
+	}
+	feedPath := strings.TrimPrefix(sub.URL, "http://example.com")
+
+	// Creating the feed queues the one episode it is missing
+	jobs, _ := Jobs.List()
+	if len(jobs) != 1 || jobs[0].Kind != JobPodcast || jobs[0].Metadata.ID != "d4" || jobs[0].Owner != RoleViewer {
+		t.Fatalf("got jobs %+v", jobs)
+	}
+
+	// The secret is only handed out once
+	w = callFeeds(t, catalog, RoleViewer, http.MethodGet, "/feeds/"+sub.ID, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), strings.Split(feedPath, "/")[3]) {
+		t.Errorf("get: got %d %v", w.Code, w.Body)
+	}
+	if w := callFeeds(t, catalog, "other", http.MethodGet, "/feeds/"+sub.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another user: got %d", w.Code)
+	}
+	var feeds []db.Feed
+	json.NewDecoder(callFeeds(t, catalog, "other", http.MethodGet, "/feeds/", "").Body).Decode(&feeds)
+	if len(feeds) != 0 {
+		t.Errorf("another user lists %+v", feeds)
+	}
+
+	w = getPodcast(catalog, feedPath)
+	if w.Code != http.StatusOK {
+		t.Fatalf("feed: got %d %v", w.Code, w.Body)
+	}
+	var rss struct {
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title     string `xml:"title"`
+				Enclosure struct {
+					URL    string `xml:"url,attr"`
+					Length int64  `xml:"length,attr"`
+				} `xml:"enclosure"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatal(err)
+	}
+	if rss.Channel.Title != "Lectures" || len(rss.Channel.Items) != 2 || rss.Channel.Items[0].Title != "Part 1" || rss.Channel.Items[1].Title != "Part 2" {
+		t.Fatalf("got %+v", rss.Channel)
+	}
+	// d4 is left out until its episode has been made
+	episode := rss.Channel.Items[1].Enclosure
+	if episode.Length != 3 || !strings.HasSuffix(episode.URL, "/a1/"+episodeFile) {
+		t.Errorf("got enclosure %+v", episode)
+	}
+
+	prefix := strings.TrimSuffix(feedPath, "/feed.xml")
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{"episode", prefix + "/a1/" + episodeFile, http.StatusOK},
+		{"poster", prefix + "/a1/poster.jpg", http.StatusOK},
+		{"other file", prefix + "/a1/output.m3u8", http.StatusNotFound},
+		{"entry outside the feed", prefix + "/c3/" + episodeFile, http.StatusNotFound},
+		{"wrong secret", "/podcast/" + sub.ID + "/nope/feed.xml", http.StatusNotFound},
+		{"unknown feed", "/podcast/nope/nope/feed.xml", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := getPodcast(catalog, tt.path); w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+	w = getPodcast(catalog, prefix+"/d4/"+episodeFile)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("episode being made: got %d %v", w.Code, w.Header())
+	}
+	if jobs, _ := Jobs.List(); len(jobs) != 1 {
+		t.Errorf("the episode was queued again: %+v", jobs)
+	}
+
+	// Rotating the secret retires the old URL
+	w = callFeeds(t, catalog, RoleViewer, http.MethodPost, "/feeds/"+sub.ID+"/rotate", "")
+	var rotated feedSubscription
+	json.NewDecoder(w.Body).Decode(&rotated)
+	if w.Code != http.StatusOK || rotated.URL == sub.URL {
+		t.Fatalf("rotate: got %d %+v", w.Code, rotated)
+	}
+	if w := getPodcast(catalog, feedPath); w.Code != http.StatusNotFound {
+		t.Errorf("old URL after a rotate: got %d", w.Code)
+	}
+	newPath := strings.TrimPrefix(rotated.URL, "http://example.com")
+	if w := getPodcast(catalog, newPath); w.Code != http.StatusOK {
+		t.Errorf("new URL: got %d", w.Code)
+	}
+
+	// Feeds stop working when their owner loses access
+	Users.DeleteUser(CTX, RoleViewer)
+	if w := getPodcast(catalog, newPath); w.Code != http.StatusNotFound {
+		t.Errorf("feed of a deleted user: got %d", w.Code)
+	}
+}
+
+func TestFeedsHandlerUpdateDelete(t *testing.T) {
+	catalog := setupFeeds(t)
+	w := callFeeds(t, catalog, RoleViewer, http.MethodPost, "/feeds/", `{"title": "Talks", "tag": "talk"}`)
+	var sub feedSubscription
+	json.NewDecoder(w.Body).Decode(&sub)
+	created, _ := Feeds.GetFeed(CTX, sub.ID)
+
+	if w := callFeeds(t, catalog, RoleViewer, http.MethodPut, "/feeds/"+sub.ID, `{"title": "Talks"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("update to everything: got %d", w.Code)
+	}
+	w = callFeeds(t, catalog, RoleViewer, http.MethodPut, "/feeds/"+sub.ID, `{"title": "Music", "directory": "Music", "order": "added"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: got %d %v", w.Code, w.Body)
+	}
+	stored, err := Feeds.GetFeed(CTX, sub.ID)
+	if err != nil || stored.Title != "Music" || stored.Directory != "Music" || stored.Tag != "" || stored.Order != "added" || stored.SecretHash != created.SecretHash {
+		t.Errorf("stored %+v, %v", stored, err)
+	}
+	if w := callFeeds(t, catalog, RoleAdmin, http.MethodGet, "/feeds/"+sub.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("admin: got %d", w.Code)
+	}
+	if w := callFeeds(t, catalog, "other", http.MethodDelete, "/feeds/"+sub.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another user deleted: got %d", w.Code)
+	}
+	if w := callFeeds(t, catalog, RoleViewer, http.MethodDelete, "/feeds/"+sub.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d", w.Code)
+	}
+	if _, err := Feeds.GetFeed(CTX, sub.ID); err == nil {
+		t.Errorf("the feed is still stored")
+	}
+}
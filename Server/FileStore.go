@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// jsonFileStore keeps a keyed collection in memory and mirrors it to a JSON
+// file. It backs the stores that need to work when MongoDB is not configured.
+// Items are written as extended JSON using their bson tags, so the file holds
+// the same fields as the Mongo documents, including ones hidden from the API
+// such as password hashes
+type jsonFileStore[T any] struct {
+	path  string
+	mutex sync.RWMutex
+	items map[string]T
+}
+
+func newJSONFileStore[T any](path string) (*jsonFileStore[T], error) {
+	s := &jsonFileStore[T]{
+		path:  path,
+		items: map[string]T{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", path, err)
+	}
+	if len(data) > 0 {
+		if err := bson.UnmarshalExtJSON(data, false, &s.items); err != nil {
+			// Stores written before they switched to extended JSON are plain
+			// JSON, they are read as such and rewritten on the next save
+			s.items = map[string]T{}
+			if jsonErr := json.Unmarshal(data, &s.items); jsonErr != nil {
+				return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *jsonFileStore[T]) get(id string) (T, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	item, ok := s.items[id]
+	return item, ok
+}
+
+func (s *jsonFileStore[T]) list() []T {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	items := make([]T, 0, len(s.items))
+	for _, item := range s.items {
+		items = append(items, item)
+	}
+	return items
+}
+
+func (s *jsonFileStore[T]) put(id string, item T) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.items[id] = item
+	return s.save()
+}
+
+// insert stores the item only if the id is free. It returns false if the id is taken
+func (s *jsonFileStore[T]) insert(id string, item T) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.items[id]; ok {
+		return false, nil
+	}
+	s.items[id] = item
+	return true, s.save()
+}
+
+// update applies fn to the stored item. It returns false if there is no item with that id
+func (s *jsonFileStore[T]) update(id string, fn func(item *T)) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[id]
+	if !ok {
+		return false, nil
+	}
+	fn(&item)
+	s.items[id] = item
+	return true, s.save()
+}
+
+func (s *jsonFileStore[T]) delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.items, id)
+	return s.save()
+}
+
+// deleteWhere removes every item matching fn and returns how many were removed
+func (s *jsonFileStore[T]) deleteWhere(fn func(item T) bool) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := 0
+	for id, item := range s.items {
+		if fn(item) {
+			delete(s.items, id)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.save()
+}
+
+// save writes the collection to disk. The caller must hold the write lock
+func (s *jsonFileStore[T]) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create store directory: %v", err)
+	}
+	data, err := bson.MarshalExtJSONIndent(s.items, false, false, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal store: %v", err)
+	}
+	// Write to a temp file first so a crash never leaves a half written store
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write store: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace store: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Folders are not stored anywhere, they are the directory paths of the entries.
+// A folder exists for as long as some entry is in it or below it
+
+type folderInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Entries counts the entries directly in the folder, Total those in its subfolders too
+	Entries int `json:"entries"`
+	Total   int `json:"total"`
+}
+
+type folderListing struct {
+	Path    string               `json:"path"`
+	Folders []folderInfo         `json:"folders"`
+	Entries []db.MediaIndexEntry `json:"entries"`
+}
+
+type folderMoveRequest struct {
+	Entries []string `json:"entries"`
+	Folders []string `json:"folders"`
+	To      string   `json:"to"`
+}
+
+type folderRenameRequest struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+// cleanFolder normalises a folder path to "a/b" form, "" being the root. It
+// fails for paths that climb out of the root
+func cleanFolder(folder string) (string, bool) {
+	folder = strings.Trim(strings.TrimSpace(folder), "/")
+	if folder == "" {
+		return "", true
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	folder = path.Clean(folder)
+	if folder == "." {
+		return "", true
+	}
+	return folder, true
+}
+
+// inFolder reports whether dir is folder or one of its subfolders
+func inFolder(dir, folder string) bool {
+	return folder == "" || dir == folder || strings.HasPrefix(dir, folder+"/")
+}
+
+// listFolder builds the listing of one folder from the entries of a media type
+func listFolder(entries []db.MediaIndexEntry, folder string) (folderListing, bool) {
+	listing := folderListing{Path: folder, Folders: []folderInfo{}, Entries: []db.MediaIndexEntry{}}
+	children := map[string]*folderInfo{}
+	found := folder == ""
+	for _, entry := range entries {
+		dir, _ := cleanFolder(entry.Directory)
+		if !inFolder(dir, folder) {
+			continue
+		}
+		found = true
+		if dir == folder {
+			listing.Entries = append(listing.Entries, entry)
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(dir, folder), "/")
+		name, _, _ := strings.Cut(rest, "/")
+		child, ok := children[name]
+		if !ok {
+			child = &folderInfo{Name: name, Path: path.Join(folder, name)}
+			children[name] = child
+		}
+		child.Total++
+		if dir == child.Path {
+			child.Entries++
+		}
+	}
+	for _, child := range children {
+		listing.Folders = append(listing.Folders, *child)
+	}
+	sort.Slice(listing.Folders, func(i, j int) bool {
+		return strings.ToLower(listing.Folders[i].Name) < strings.ToLower(listing.Folders[j].Name)
+	})
+	return listing, found
+}
+
+// moveEntries puts the entries in ids into the folder to, and moves every
+// entry below a key of folders to the same place below its value. It returns
+// how many entries were moved
+func moveEntries(catalog db.MediaRepository, mediaType string, ids []string, to string, folders map[string]string) (int, error) {
+	moved := 0
+	setDirectory := func(id, dir string) error {
+		_, err := catalog.UpdateEntry(CTX, mediaType, id, func(entry *db.MediaIndexEntry) error {
+			entry.Directory = dir
+			return nil
+		})
+		if err == nil {
+			moved++
+		}
+		return err
+	}
+	for _, id := range ids {
+		if err := setDirectory(id, to); err != nil {
+			return moved, fmt.Errorf("failed to move %v: %w", id, err)
+		}
+	}
+	if len(folders) == 0 {
+		return moved, nil
+	}
+	entries, err := catalog.ListEntries(CTX, mediaType)
+	if err != nil {
+		return moved, err
+	}
+	for _, entry := range entries {
+		dir, _ := cleanFolder(entry.Directory)
+		// When a folder and one of its subfolders are both moved, the subfolder wins
+		match := ""
+		for from := range folders {
+			if inFolder(dir, from) && len(from) > len(match) {
+				match = from
+			}
+		}
+		if match == "" {
+			continue
+		}
+		if err := setDirectory(entry.ID, folders[match]+strings.TrimPrefix(dir, match)); err != nil {
+			return moved, fmt.Errorf("failed to move %v: %w", entry.ID, err)
+		}
+	}
+	return moved, nil
+}
+
+// FoldersHandler serves the folder tree of the entries. Viewers can list it,
+// changing it needs the uploader role
+//
+//	GET  /folders/?mType=&path=a/b   subfolders with counts and the entries directly in a/b
+//	POST /folders/move?mType=        {"entries": [ids], "folders": [paths], "to": "x"}
+//	POST /folders/rename?mType=      {"path": "a/b", "name": "c"} turns a/b into a/c
+func FoldersHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType := r.URL.Query().Get("mType")
+		if mediaType != "video" && mediaType != "audio" {
+			http.Error(w, "Invalid media type", http.StatusBadRequest)
+			return
+		}
+		action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/folders"), "/")
+		user, _ := currentUser(r)
+		if r.Method != http.MethodGet && roleRank[user.Role] < roleRank[RoleUploader] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			folder, ok := cleanFolder(r.URL.Query().Get("path"))
+			if !ok {
+				http.Error(w, "Invalid path", http.StatusBadRequest)
+				return
+			}
+			entries, err := catalog.ListEntries(CTX, mediaType)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			listing, found := listFolder(entries, folder)
+			if !found {
+				http.Error(w, "Folder not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(listing)
+		case r.Method == http.MethodPost && action == "move":
+			var req folderMoveRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid move JSON", http.StatusBadRequest)
+				return
+			}
+			to, ok := cleanFolder(req.To)
+			if !ok {
+				http.Error(w, "Invalid destination", http.StatusBadRequest)
+				return
+			}
+			// A folder keeps its name inside the destination
+			moves := map[string]string{}
+			for _, folder := range req.Folders {
+				from, ok := cleanFolder(folder)
+				if !ok || from == "" {
+					http.Error(w, "Invalid folder "+folder, http.StatusBadRequest)
+					return
+				}
+				if inFolder(to, from) {
+					http.Error(w, "Cannot move "+from+" into itself", http.StatusBadRequest)
+					return
+				}
+				moves[from] = path.Join(to, path.Base(from))
+			}
+			moved, err := moveEntries(catalog, mediaType, req.Entries, to, moves)
+			writeMoved(w, moved, err)
+		case r.Method == http.MethodPost && action == "rename":
+			var req folderRenameRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid rename JSON", http.StatusBadRequest)
+				return
+			}
+			from, ok := cleanFolder(req.Path)
+			name := strings.TrimSpace(req.Name)
+			if !ok || from == "" {
+				http.Error(w, "Invalid path", http.StatusBadRequest)
+				return
+			}
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+				http.Error(w, "Invalid name", http.StatusBadRequest)
+				return
+			}
+			moves := map[string]string{from: path.Join(path.Dir(from), name)}
+			moved, err := moveEntries(catalog, mediaType, nil, "", moves)
+			writeMoved(w, moved, err)
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// writeMoved answers a move or rename with the number of entries it moved
+func writeMoved(w http.ResponseWriter, moved int, err error) {
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"moved": moved})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCleanFolder(t *testing.T) {
+	tests := []struct {
+		folder string
+		want   string
+		ok     bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{" shows/drama/ ", "shows/drama", true},
+		{"shows//drama", "shows/drama", true},
+		{"shows/./drama", "shows/drama", true},
+		{".", "", true},
+		{"..", "", false},
+		{"shows/../..", "", false},
+		{"shows/../drama", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cleanFolder(tt.folder)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %q, %v, want %q, %v", tt.folder, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// folderCatalog holds a small tree of video entries:
+//
+//	a1          (root)
+//	b2, c3      shows
+//	d4          shows/drama
+//	e5          showsies, which only shares a prefix with shows
+func folderCatalog(t *testing.T) *db.MemoryRepository {
+	t.Helper()
+	return setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "Root", MediaType: "video"},
+		db.MediaIndexEntry{ID: "b2", Title: "One", MediaType: "video", Directory: "shows"},
+		db.MediaIndexEntry{ID: "c3", Title: "Two", MediaType: "video", Directory: "/shows/"},
+		db.MediaIndexEntry{ID: "d4", Title: "Three", MediaType: "video", Directory: "shows/drama"},
+		db.MediaIndexEntry{ID: "e5", Title: "Four", MediaType: "video", Directory: "showsies"},
+	)
+}
+
+// directories returns the folder of each video entry by id
+func directories(t *testing.T, catalog db.MediaRepository) map[string]string {
+	t.Helper()
+	entries, err := catalog.ListEntries(CTX, "video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := map[string]string{}
+	for _, entry := range entries {
+		dirs[entry.ID], _ = cleanFolder(entry.Directory)
+	}
+	return dirs
+}
+
+func TestFoldersHandlerList(t *testing.T) {
+	setupUsers(t)
+	catalog := folderCatalog(t)
+	tests := []struct {
+		name    string
+		query   string
+		code    int
+		folders string
+		entries string
+	}{
+		{name: "root", query: "?mType=video", code: http.StatusOK, folders: "shows 2/3,showsies 1/1", entries: "a1"},
+		{name: "folder", query: "?mType=video&path=/shows/", code: http.StatusOK, folders: "shows/drama 1/1", entries: "b2,c3"},
+		{name: "leaf", query: "?mType=video&path=shows/drama", code: http.StatusOK, entries: "d4"},
+		{name: "missing", query: "?mType=video&path=movies", code: http.StatusNotFound},
+		{name: "prefix is not a folder", query: "?mType=video&path=show", code: http.StatusNotFound},
+		{name: "climbs out", query: "?mType=video&path=../shows", code: http.StatusBadRequest},
+		{name: "bad media type", query: "?mType=image", code: http.StatusBadRequest},
+		{name: "empty media type", query: "?mType=audio", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serveAs(t, RoleViewer, RequireRole(RoleViewer, FoldersHandler(catalog)), httptest.NewRequest(http.MethodGet, "/folders/"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var listing folderListing
+		json.NewDecoder(w.Body).Decode(&listing)
+		var folders, entries []string
+		for _, folder := range listing.Folders {
+			folders = append(folders, fmt.Sprintf("%v %d/%d", folder.Path, folder.Entries, folder.Total))
+		}
+		for _, entry := range listing.Entries {
+			entries = append(entries, entry.ID)
+		}
+		if strings.Join(folders, ",") != tt.folders || strings.Join(entries, ",") != tt.entries {
+			t.Errorf("%v: got folders %v and entries %v", tt.name, folders, entries)
+		}
+	}
+}
+
+func TestFoldersHandlerMove(t *testing.T) {
+	setupUsers(t)
+	tests := []struct {
+		name  string
+		user  string
+		path  string
+		body  string
+		code  int
+		moved int
+		dirs  map[string]string
+	}{
+		{
+			name: "viewers cannot move", user: RoleViewer, path: "/folders/move",
+			body: `{"entries": ["a1"], "to": "movies"}`, code: http.StatusForbidden,
+		},
+		{
+			name: "entries", user: RoleUploader, path: "/folders/move",
+			body: `{"entries": ["a1", "d4"], "to": "/movies/"}`, code: http.StatusOK, moved: 2,
+			dirs: map[string]string{"a1": "movies", "d4": "movies"},
+		},
+		{
+			name: "folder keeps its name", user: RoleUploader, path: "/folders/move",
+			body: `{"folders": ["shows"], "to": "archive"}`, code: http.StatusOK, moved: 3,
+			dirs: map[string]string{"b2": "archive/shows", "c3": "archive/shows", "d4": "archive/shows/drama", "e5": "showsies"},
+		},
+		{
+			name: "subfolder to the root", user: RoleUploader, path: "/folders/move",
+			body: `{"folders": ["shows/drama"], "to": ""}`, code: http.StatusOK, moved: 1,
+			dirs: map[string]string{"b2": "shows", "d4": "drama"},
+		},
+		{
+			name: "into itself", user: RoleUploader, path: "/folders/move",
+			body: `{"folders": ["shows"], "to": "shows/drama"}`, code: http.StatusBadRequest,
+		},
+		{
+			name: "climbs out", user: RoleUploader, path: "/folders/move",
+			body: `{"entries": ["a1"], "to": "../movies"}`, code: http.StatusBadRequest,
+		},
+		{
+			name: "root folder", user: RoleUploader, path: "/folders/move",
+			body: `{"folders": ["/"], "to": "movies"}`, code: http.StatusBadRequest,
+		},
+		{
+			name: "unknown entry", user: RoleUploader, path: "/folders/move",
+			body: `{"entries": ["z9"], "to": "movies"}`, code: http.StatusNotFound,
+		},
+		{
+			name: "rename", user: RoleUploader, path: "/folders/rename",
+			body: `{"path": "shows", "name": "series"}`, code: http.StatusOK, moved: 3,
+			dirs: map[string]string{"a1": "", "b2": "series", "c3": "series", "d4": "series/drama", "e5": "showsies"},
+		},
+		{
+			name: "rename a subfolder", user: RoleUploader, path: "/folders/rename",
+			body: `{"path": "shows/drama", "name": "comedy"}`, code: http.StatusOK, moved: 1,
+			dirs: map[string]string{"b2": "shows", "d4": "shows/comedy"},
+		},
+		{
+			name: "rename with a slash", user: RoleUploader, path: "/folders/rename",
+			body: `{"path": "shows", "name": "a/b"}`, code: http.StatusBadRequest,
+		},
+		{
+			name: "rename the root", user: RoleUploader, path: "/folders/rename",
+			body: `{"path": "", "name": "top"}`, code: http.StatusBadRequest,
+		},
+		{
+			name: "not json", user: RoleUploader, path: "/folders/rename",
+			body: `shows`, code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		catalog := folderCatalog(t)
+		r := httptest.NewRequest(http.MethodPost, tt.path+"?mType=video", strings.NewReader(tt.body))
+		w := serveAs(t, tt.user, RequireRole(RoleViewer, FoldersHandler(catalog)), r)
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var result map[string]int
+		json.NewDecoder(w.Body).Decode(&result)
+		if result["moved"] != tt.moved {
+			t.Errorf("%v: moved %d entries, want %d", tt.name, result["moved"], tt.moved)
+		}
+		dirs := directories(t, catalog)
+		for id, want := range tt.dirs {
+			if dirs[id] != want {
+				t.Errorf("%v: %v is in %q, want %q", tt.name, id, dirs[id], want)
+			}
+		}
+	}
+}
@@ -1,43 +1,47 @@
 package main
 
 import (
-	"archive/zip"
+	"Farnsworth/Server/db"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var tokens []string
-
 type MediaIndexEntry struct {
-	Title       string   `json:"title"`
-	Description string   `json:"description"`
-	Genre       []string `json:"genre"`
-	Tags        []string `json:"tags"`
-	Directory   string   `json:"directory"`
-	Location    string   `json:"location"`
-	MediaType   string   `json:"mediaType"`
+	ID          string             `json:"id"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Genre       []string           `json:"genre"`
+	Tags        []string           `json:"tags"`
+	Directory   string             `json:"directory"`
+	Location    string             `json:"location"`
+	MediaType   string             `json:"mediaType"`
+	Playlist    string             `json:"playlist"`
+	Duration    float64            `json:"duration"`
+	Poster      string             `json:"poster,omitempty"`
+	Sprite      *db.SpriteSheet    `json:"sprite,omitempty"`
+	Thumbnails  string             `json:"thumbnails,omitempty"`
+	Subtitles   []db.SubtitleTrack `json:"subtitles,omitempty"`
+	AudioTracks []db.AudioTrack    `json:"audioTracks,omitempty"`
+	Added       time.Time          `json:"added"`
+	Missing     bool               `json:"missing,omitempty" bson:"missing,omitempty"`
+	Revision    int64              `json:"-" bson:"revision"`
 }
 
 func UploadZipHandler(w http.ResponseWriter, r *http.Request) {
-	err := ensureMediaDirectoriesExist()
-	if err != nil {
-		Log.Error(err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
 	// Parse the multipart form
-	err = r.ParseMultipartForm(10 << 20) // 10 MB max memory
+	err := r.ParseMultipartForm(10 << 20) // 10 MB max memory
 	if err != nil {
 		Log.Error(err.Error())
 		http.Error(w, "Unable to parse form", http.StatusBadRequest)
@@ -65,6 +69,11 @@ func UploadZipHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid media type", http.StatusBadRequest)
 		return
 	}
+	if !validTitle(mie.Title) {
+		http.Error(w, "Invalid title", http.StatusBadRequest)
+		return
+	}
+	mie.ID = ""
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -80,17 +89,26 @@ func UploadZipHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Retrieve chunk information
-	chunkIndex := r.FormValue("chunkIndex")
+	// Retrieve chunk information. The index names the chunk file, so it must be
+	// a number within the upload
 	totalChunks, err := strconv.Atoi(r.FormValue("totalChunks"))
-	if chunkIndex == "" || err != nil {
-		Log.Error(err.Error())
+	if err != nil || totalChunks <= 0 || totalChunks > maxUploadChunks {
+		Log.Error("Invalid chunk count")
 		http.Error(w, "Chunk information missing", http.StatusBadRequest)
 		return
 	}
+	chunkIndex, err := strconv.Atoi(r.FormValue("chunkIndex"))
+	if err != nil || chunkIndex < 0 || chunkIndex >= totalChunks {
+		Log.Error("Invalid chunk index")
+		http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+		return
+	}
 
-	// Create a temporary directory for storing chunks
-	chunkDir := "./chunks/" + mie.Title
+	// Create a temporary directory for storing chunks. This protocol has no upload id,
+	// chunks of the same title from the same user are taken to be the same upload
+	user, _ := currentUser(r)
+	uploadKey := sha256.Sum256([]byte(user.Username + "\x00" + mie.Title))
+	chunkDir := filepath.Join(chunksRoot, "legacy-"+hex.EncodeToString(uploadKey[:8]))
 	if _, err := os.Stat(chunkDir); os.IsNotExist(err) {
 		err = os.MkdirAll(chunkDir, os.ModePerm)
 		if err != nil {
@@ -101,9 +119,8 @@ func UploadZipHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save the chunk to a temporary file
-	chunkFilePath := filepath.Join(chunkDir, fmt.Sprintf("chunk-%s", chunkIndex))
+	chunkFilePath := filepath.Join(chunkDir, fmt.Sprintf("chunk-%d", chunkIndex))
 	chunkFile, err := os.Create(chunkFilePath)
-	fmt.Printf("Created %v\n", chunkFilePath)
 	if err != nil {
 		Log.Error(err.Error())
 		http.Error(w, "Unable to create chunk file", http.StatusInternalServerError)
@@ -127,43 +144,50 @@ func UploadZipHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if chunkCount == totalChunks {
-		// Assemble chunks into a complete file
-		finalFilePath := filepath.Join("./media/", mie.MediaType, mie.Title+".zip")
-		err = assembleChunks(chunkDir, finalFilePath)
+		// Assemble chunks into a complete file outside the chunk directory, which goes away now
+		sourceID, err := randomHex(16)
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sourceDir := filepath.Join(chunksRoot, "source-"+sourceID)
+		finalFilePath := filepath.Join(sourceDir, "upload.zip")
+		err = os.MkdirAll(sourceDir, os.ModePerm)
+		if err == nil {
+			err = assembleChunks(chunkDir, totalChunks, finalFilePath)
+		}
 		// Clean up chunk directory
 		os.RemoveAll(chunkDir)
 		if err != nil {
+			os.RemoveAll(sourceDir)
 			Log.Error(err.Error())
 			http.Error(w, "Error assembling chunks", http.StatusInternalServerError)
 			return
 		}
-
-		expandedDir := strings.TrimSuffix(finalFilePath, filepath.Ext(finalFilePath))
-		mie.Location = expandedDir
-		// Unzip the file
-		err = unzip(finalFilePath, mie.Location)
-		os.Remove(finalFilePath)
-		if err != nil {
+		// A bad archive is turned away now rather than failing later in its job
+		if err := checkArchive(finalFilePath); err != nil {
+			os.RemoveAll(sourceDir)
 			Log.Error(err.Error())
-			http.Error(w, "Error unzipping file", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// If DB is there, add to DB
-		if DBConnected {
-			if mie.MediaType == "video" {
-				_, err = DBClient.AddVideo(CTX, mie)
-			} else {
-				_, err = DBClient.AddAudio(CTX, mie)
-			}
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		job, err := Jobs.Submit(db.Job{
+			Kind:     JobUnpack,
+			Owner:    user.Username,
+			Metadata: db.MediaIndexEntry(mie),
+			Source:   finalFilePath,
+		})
+		if err != nil {
+			os.RemoveAll(sourceDir)
+			Log.Error(err.Error())
+			http.Error(w, "Unable to queue upload for processing", http.StatusInternalServerError)
+			return
 		}
 
-		// Respond with success
+		// Respond with success, the archive is unpacked in the background
+		w.Header().Set("X-Job-ID", job.ID)
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "Upload complete")
 	} else {
@@ -205,19 +229,14 @@ func countChunks(chunkDir string) (int, error) {
 	return len(files), nil
 }
 
-func assembleChunks(chunkDir, finalFilePath string) error {
+func assembleChunks(chunkDir string, totalChunks int, finalFilePath string) error {
 	finalFile, err := os.Create(finalFilePath)
 	if err != nil {
 		return err
 	}
 	defer finalFile.Close()
 
-	files, err := os.ReadDir(chunkDir)
-	if err != nil {
-		return err
-	}
-
-	for i := 0; i < len(files); i++ {
+	for i := 0; i < totalChunks; i++ {
 		chunkFilePath := filepath.Join(chunkDir, fmt.Sprintf("chunk-%d", i))
 		chunkFile, err := os.Open(chunkFilePath)
 		if err != nil {
@@ -233,39 +252,37 @@ func assembleChunks(chunkDir, finalFilePath string) error {
 	return nil
 }
 
-func DeleteHandler(w http.ResponseWriter, r *http.Request) {
-	mediaType := r.URL.Query().Get("mType")
-	toDeleteEncoded := r.URL.Query().Get("title")
-	toDelete, err := url.QueryUnescape(toDeleteEncoded) // Decode the title
-	if err != nil {
-		Log.Error(err.Error())
-		http.Error(w, "Invalid title encoding", http.StatusBadRequest)
-		return
-	}
+func DeleteHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType := r.URL.Query().Get("mType")
+		toDelete := r.URL.Query().Get("id")
 
-	if mediaType != "video" && mediaType != "audio" {
-		http.Error(w, "Invalid media type", http.StatusBadRequest)
-		return
-	}
-	if DBConnected {
-		if mediaType == "video" {
-			_, err := DBClient.DeleteVideo(CTX, toDelete)
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		} else {
-			_, err := DBClient.DeleteAudio(CTX, toDelete)
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if mediaType != "video" && mediaType != "audio" {
+			http.Error(w, "Invalid media type", http.StatusBadRequest)
+			return
+		}
+		if !validID(toDelete) {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		_, err := catalog.DeleteEntry(CTX, mediaType, toDelete)
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		dirPath := "./media/" + mediaType + "/" + toDelete // Add "/" separator
-		fmt.Printf("Deleting directory: %v\n", dirPath)    // Log the directory to be deleted
-		err = RemoveContents(dirPath)                      // Call RemoveContents to delete directory contents
+		Log.Info(fmt.Sprintf("Deleting directory: %v", dirPath))
+		err = RemoveContents(dirPath) // Call RemoveContents to delete directory contents
+		if os.IsNotExist(err) {
+			// The files were already gone, removing the entry was all there was to do
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		if err != nil {
 			Log.Error(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -280,6 +297,79 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+func UpdateMetaDataHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		mediaType := r.URL.Query().Get("mType")
+		id := r.URL.Query().Get("id")
+		if mediaType != "video" && mediaType != "audio" {
+			http.Error(w, "Invalid media type", http.StatusBadRequest)
+			return
+		}
+		if !validID(id) {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, "Unable to read the request", http.StatusBadRequest)
+			return
+		}
+
+		// The files live under the id, so a new title is only a catalog change
+		updated, err := catalog.UpdateEntry(CTX, mediaType, id, func(entry *db.MediaIndexEntry) error {
+			// PUT replaces the metadata, PATCH only overwrites the fields present in the body
+			var mie MediaIndexEntry
+			if r.Method == http.MethodPatch {
+				mie = MediaIndexEntry(*entry)
+			}
+			if err := json.Unmarshal(body, &mie); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidMetadata, err)
+			}
+			if mie.MediaType != "" && mie.MediaType != mediaType {
+				return fmt.Errorf("%w: changing the media type is not supported", errInvalidMetadata)
+			}
+			if !validTitle(mie.Title) {
+				return fmt.Errorf("%w: invalid title", errInvalidMetadata)
+			}
+			entry.Title = mie.Title
+			entry.Description = mie.Description
+			entry.Genre = mie.Genre
+			entry.Tags = mie.Tags
+			entry.Directory = mie.Directory
+			return nil
+		})
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errInvalidMetadata) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+	}
+}
+
+var errInvalidMetadata = errors.New("invalid metadata")
+
+// validTitle reports whether a title is usable. Titles are only labels, any
+// number of entries may share one
+func validTitle(title string) bool {
+	return strings.TrimSpace(title) != ""
+}
+
 func RemoveContents(dir string) error {
 	d, err := os.Open(dir)
 	if err != nil {
@@ -306,12 +396,22 @@ func HandleRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleLogin(w http.ResponseWriter, r *http.Request) {
-	token, _ := randomHex(20)
-	tokens = append(tokens, token)
+	user, ok := r.Context().Value(userContextKey).(db.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	token, session, err := NewSession(CTX, user.Username)
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to create session", http.StatusInternalServerError)
+		return
+	}
 	http.SetCookie(w, &http.Cookie{
-		Name:  "auth-token",
-		Value: token,
-		Path:  "/",
+		Name:    "auth-token",
+		Value:   token,
+		Path:    "/",
+		Expires: session.Expires,
 	})
 	w.Header().Set("token", token)
 	redirectURL := "/"
@@ -323,6 +423,26 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusFound)
 }
 
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	err := RevokeSession(CTX, bearerToken(r))
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to revoke session", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   "auth-token",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
 func randomHex(n int) (string, error) {
 	bytes := make([]byte, n)
 	if _, err := rand.Read(bytes); err != nil {
@@ -336,17 +456,8 @@ func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
 		username, password, ok := r.BasicAuth()
 
 		if ok {
-			usernameHash := sha256.Sum256([]byte(username))
-			passwordHash := sha256.Sum256([]byte(password))
-			expectedUsernameHash := sha256.Sum256([]byte(ExpectedUser))
-			expectedPasswordHash := sha256.Sum256([]byte(ExpectedKey))
-
-			usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1
-			passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1
-
-			if usernameMatch && passwordMatch {
-
-				next.ServeHTTP(w, r)
+			if user, ok := authenticate(CTX, username, password); ok {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
 				return
 			}
 		}
@@ -356,19 +467,22 @@ func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// bearerToken returns the token from the Authorization header, or "" if there is none
+func bearerToken(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1]
+	}
+	return ""
+}
+
 func CheckToken(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		bToken := r.Header.Get("Authorization")
-		if bToken != "" {
-			parts := strings.Split(bToken, " ")
-			if len(parts) == 2 && parts[0] == "Bearer" {
-				reqToken := parts[1]
-				for _, token := range tokens {
-					if token == reqToken {
-						next.ServeHTTP(w, r)
-						return
-					}
-				}
+		reqToken := bearerToken(r)
+		if reqToken != "" {
+			if session, ok := ValidateSession(CTX, reqToken); ok && len(session.Scope) == 0 {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, session)))
+				return
 			}
 		}
 		// If token is not found or does not match, return unauthorized
@@ -377,117 +491,87 @@ func CheckToken(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		fPath := filepath.Join(dest, f.Name)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fPath, os.ModePerm)
-			continue
-		}
+// MaxPageSize caps the limit a client can ask /dir/ for
+const MaxPageSize = 500
 
-		if err := os.MkdirAll(filepath.Dir(fPath), os.ModePerm); err != nil {
-			return err
-		}
+// entryPage is the /dir/ response when the client pages through the entries
+type entryPage struct {
+	Entries    []db.MediaIndexEntry `json:"entries"`
+	NextCursor string               `json:"nextCursor,omitempty"`
+}
 
-		outFile, err := os.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
+// ListDirectoriesHandler lists the entries of ?mType=. It takes
+//
+//	q          words that must all appear in the title or description
+//	genre      only entries with this genre
+//	tag        only entries with this tag
+//	directory  only entries in this directory
+//	sort       id, title, added or duration, with a leading "-" for descending
+//	limit      page size, at most MaxPageSize
+//	cursor     nextCursor of the previous page
+//
+// Without limit or cursor the response is a plain array of every match, as it
+// has always been. With either one it is a page: {"entries": [], "nextCursor": ""}
+func ListDirectoriesHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		mediaType := params.Get("mType")
+		if mediaType != "video" && mediaType != "audio" {
+			http.Error(w, "Invalid media type", http.StatusBadRequest)
+			return
 		}
-
-		rc, err := f.Open()
-		if err != nil {
-			return err
+		query := db.EntryQuery{
+			Text:      params.Get("q"),
+			Genre:     params.Get("genre"),
+			Tag:       params.Get("tag"),
+			Directory: params.Get("directory"),
+			Sort:      params.Get("sort"),
+			Cursor:    params.Get("cursor"),
 		}
-
-		_, err = io.Copy(outFile, rc)
-
-		outFile.Close()
-		rc.Close()
-
-		if err != nil {
-			return err
+		paged := params.Has("limit") || params.Has("cursor")
+		if paged {
+			query.Limit = MaxPageSize
 		}
-	}
-	return nil
-}
-
-func ListDirectoriesHandler(w http.ResponseWriter, r *http.Request) {
-	mediaType := r.URL.Query().Get("mType")
-	if mediaType != "video" && mediaType != "audio" {
-		http.Error(w, "Invalid media type", http.StatusBadRequest)
-		return
-	}
-
-	if DBConnected {
-		if mediaType == "video" {
-			videos, err := DBClient.GetVideos(CTX)
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			jsonData, err := json.Marshal(videos)
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(jsonData)
-		} else {
-			audio, err := DBClient.GetAudio(CTX)
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			jsonData, err := json.Marshal(audio)
-			if err != nil {
-				Log.Error(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		if v := params.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit <= 0 || limit > MaxPageSize {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", MaxPageSize), http.StatusBadRequest)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(jsonData)
+			query.Limit = limit
+		}
+
+		entries, next, err := catalog.QueryEntries(CTX, mediaType, query)
+		if errors.Is(err, db.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	} else {
-		dirPath := "./media/" + mediaType
-		dirs, err := listDirectories(dirPath)
 		if err != nil {
 			Log.Error(err.Error())
-			http.Error(w, "Error reading directories", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(dirs)
+		if paged {
+			json.NewEncoder(w).Encode(entryPage{Entries: entries, NextCursor: next})
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
 	}
 }
 
-func listDirectories(path string) ([]string, error) {
-	var directories []string
-
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, entry := range entries {
-		if entry.IsDir() {
-			directories = append(directories, entry.Name())
-		}
+// ServeMediaHandler serves the files below ./media. Share links,
+// /media/share/<token>/<file>, are checked here, every other path needs a
+// session with the viewer role
+func ServeMediaHandler(w http.ResponseWriter, r *http.Request) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/media/share/"); ok {
+		serveSharedMedia(w, r, rest)
+		return
 	}
-
-	return directories, nil
+	CheckToken(RequireRole(RoleViewer, serveMediaPath))(w, r)
 }
 
-func ServeMediaHandler(w http.ResponseWriter, r *http.Request) {
+func serveMediaPath(w http.ResponseWriter, r *http.Request) {
 	// Extract the path from the URL
 	urlPath := r.URL.Path
 
@@ -503,6 +587,14 @@ func ServeMediaHandler(w http.ResponseWriter, r *http.Request) {
 	filePath := filepath.Join("./media", trimmedPath)
 
 	// Serve the file
+	serveMedia(w, r, filePath)
+}
+
+func serveMedia(w http.ResponseWriter, r *http.Request, filePath string) {
+	// Thumbnail tracks are not in every mime table
+	if filepath.Ext(filePath) == ".vtt" {
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	}
 	http.ServeFile(w, r, filePath)
 }
 
@@ -523,8 +615,8 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 			next.ServeHTTP(w, r)
 		} else {
 			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Chunk-SHA256")
 
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusOK)
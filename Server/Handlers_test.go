@@ -0,0 +1,305 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupCatalog gives a test an in-memory catalog holding entries, with an
+// empty directory under ./media for each of them
+func setupCatalog(t *testing.T, entries ...db.MediaIndexEntry) *db.MemoryRepository {
+	t.Helper()
+	useTempDir(t)
+	catalog := db.NewMemoryRepository()
+	for _, entry := range entries {
+		entry.Location = filepath.Join("media", entry.MediaType, entry.ID)
+		if err := os.MkdirAll(entry.Location, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := catalog.AddEntry(CTX, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return catalog
+}
+
+// postLegacyChunk sends one chunk of an archive to the legacy upload route
+func postLegacyChunk(t *testing.T, chunkIndex, totalChunks string, chunk []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("metadata", `{"title": "Show", "mediaType": "video"}`)
+	mw.WriteField("chunkIndex", chunkIndex)
+	mw.WriteField("totalChunks", totalChunks)
+	fw, _ := mw.CreateFormFile("file", "show.zip")
+	fw.Write(chunk)
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return serveAs(t, RoleUploader, RequireRole(RoleUploader, UploadZipHandler), r)
+}
+
+func TestUploadZipHandler(t *testing.T) {
+	setupUsers(t)
+	setupJobs(t)
+	archive := buildArchive(t, []archiveFile{{name: "output.m3u8", mode: 0644, body: "#EXTM3U\n"}})
+
+	tests := []struct {
+		name        string
+		chunkIndex  string
+		totalChunks string
+	}{
+		{"no index", "", "1"},
+		{"index is a path", "../x", "1"},
+		{"negative index", "-1", "1"},
+		{"index past the end", "1", "1"},
+		{"no count", "0", ""},
+		{"no chunks", "0", "0"},
+	}
+	for _, tt := range tests {
+		if w := postLegacyChunk(t, tt.chunkIndex, tt.totalChunks, archive); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %d %v", tt.name, w.Code, w.Body)
+		}
+	}
+	if chunks, _ := filepath.Glob(filepath.Join(chunksRoot, "legacy-*", "*")); len(chunks) != 0 {
+		t.Errorf("rejected chunks were stored: %v", chunks)
+	}
+
+	w := postLegacyChunk(t, "0", "1", archive)
+	if w.Code != http.StatusOK || w.Header().Get("X-Job-ID") == "" {
+		t.Fatalf("upload: got %d %v", w.Code, w.Body)
+	}
+	job, err := Jobs.Get(w.Header().Get("X-Job-ID"))
+	if err != nil || job.Kind != JobUnpack || job.Owner != RoleUploader || job.Metadata.Title != "Show" {
+		t.Errorf("got job %+v, %v", job, err)
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+	catalog := setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "Show", MediaType: "video"},
+		db.MediaIndexEntry{ID: "b2", Title: "Show", MediaType: "video"},
+	)
+	os.WriteFile(filepath.Join("media", "video", "a1", "segment0.ts"), []byte("ts"), 0644)
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{"bad media type", "?mType=image&id=a1", http.StatusBadRequest},
+		{"missing id", "?mType=video", http.StatusBadRequest},
+		{"path in id", "?mType=video&id=../a1", http.StatusBadRequest},
+		{"unknown id", "?mType=video&id=c3", http.StatusNotFound},
+		{"wrong media type", "?mType=audio&id=a1", http.StatusNotFound},
+		{"deleted", "?mType=video&id=a1", http.StatusOK},
+		{"already deleted", "?mType=video&id=a1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		DeleteHandler(catalog)(w, httptest.NewRequest(http.MethodDelete, "/delete"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join("media", "video", "a1")); !os.IsNotExist(err) {
+		t.Errorf("the directory of the deleted entry is still there: %v", err)
+	}
+	// Entries that share a title are separate entries
+	if _, err := catalog.GetEntry(CTX, "video", "b2"); err != nil {
+		t.Errorf("deleting one entry removed another: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("media", "video", "b2")); err != nil {
+		t.Errorf("deleting one entry removed the directory of another: %v", err)
+	}
+}
+
+func TestUpdateMetaDataHandler(t *testing.T) {
+	catalog := setupCatalog(t, db.MediaIndexEntry{
+		ID: "a1", Title: "Show", Description: "A show", Genre: []string{"drama"}, MediaType: "video", Playlist: "output.m3u8",
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   string
+		code   int
+		want   db.MediaIndexEntry
+	}{
+		{name: "bad method", method: http.MethodPost, query: "?mType=video&id=a1", body: `{"title": "New"}`, code: http.StatusMethodNotAllowed},
+		{name: "bad media type", method: http.MethodPut, query: "?mType=image&id=a1", body: `{"title": "New"}`, code: http.StatusBadRequest},
+		{name: "path in id", method: http.MethodPut, query: "?mType=video&id=..", body: `{"title": "New"}`, code: http.StatusBadRequest},
+		{name: "unknown id", method: http.MethodPut, query: "?mType=video&id=c3", body: `{"title": "New"}`, code: http.StatusNotFound},
+		{name: "not json", method: http.MethodPut, query: "?mType=video&id=a1", body: `title`, code: http.StatusBadRequest},
+		{name: "blank title", method: http.MethodPatch, query: "?mType=video&id=a1", body: `{"title": " "}`, code: http.StatusBadRequest},
+		{name: "new media type", method: http.MethodPatch, query: "?mType=video&id=a1", body: `{"mediaType": "audio"}`, code: http.StatusBadRequest},
+		{
+			name: "patch keeps the other fields", method: http.MethodPatch, query: "?mType=video&id=a1", body: `{"description": "Still a show"}`,
+			code: http.StatusOK,
+			want: db.MediaIndexEntry{Title: "Show", Description: "Still a show", Genre: []string{"drama"}},
+		},
+		{
+			name: "put replaces the metadata", method: http.MethodPut, query: "?mType=video&id=a1", body: `{"title": "Renamed", "tags": ["new"]}`,
+			code: http.StatusOK,
+			want: db.MediaIndexEntry{Title: "Renamed", Tags: []string{"new"}},
+		},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/update"+tt.query, strings.NewReader(tt.body))
+		UpdateMetaDataHandler(catalog)(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var got db.MediaIndexEntry
+		json.NewDecoder(w.Body).Decode(&got)
+		stored, err := catalog.GetEntry(CTX, "video", "a1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range []db.MediaIndexEntry{got, stored} {
+			if entry.ID != "a1" || entry.Playlist != "output.m3u8" || entry.Title != tt.want.Title || entry.Description != tt.want.Description ||
+				strings.Join(entry.Genre, ",") != strings.Join(tt.want.Genre, ",") || strings.Join(entry.Tags, ",") != strings.Join(tt.want.Tags, ",") {
+				t.Errorf("%v: got entry %+v", tt.name, entry)
+			}
+		}
+	}
+
+	// The files stay where they are when the title changes
+	if _, err := os.Stat(filepath.Join("media", "video", "a1")); err != nil {
+		t.Errorf("renaming an entry moved its directory: %v", err)
+	}
+}
+
+func TestListDirectoriesHandler(t *testing.T) {
+	catalog := setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "Night Run", MediaType: "video"},
+		db.MediaIndexEntry{ID: "b2", Title: "Morning", Description: "A short RUN", MediaType: "video"},
+		db.MediaIndexEntry{ID: "c3", Title: "Evening", Tags: []string{"calm"}, MediaType: "video"},
+		db.MediaIndexEntry{ID: "d4", Title: "Run", MediaType: "audio"},
+	)
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		ids   []string
+	}{
+		{name: "bad media type", query: "?mType=image", code: http.StatusBadRequest},
+		{name: "all", query: "?mType=video", code: http.StatusOK, ids: []string{"a1", "b2", "c3"}},
+		{name: "search ignores case", query: "?mType=video&q=run", code: http.StatusOK, ids: []string{"a1", "b2"}},
+		{name: "tag", query: "?mType=video&tag=calm", code: http.StatusOK, ids: []string{"c3"}},
+		{name: "sorted by title", query: "?mType=video&sort=-title", code: http.StatusOK, ids: []string{"a1", "b2", "c3"}},
+		{name: "unknown sort", query: "?mType=video&sort=rating", code: http.StatusBadRequest},
+		{name: "bad limit", query: "?mType=video&limit=0", code: http.StatusBadRequest},
+		{name: "no match", query: "?mType=video&q=nothing", code: http.StatusOK, ids: []string{}},
+		{name: "other media type", query: "?mType=audio", code: http.StatusOK, ids: []string{"d4"}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ListDirectoriesHandler(catalog)(w, httptest.NewRequest(http.MethodGet, "/list"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var entries []db.MediaIndexEntry
+		if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("%v: got %v, want %v", tt.name, ids, tt.ids)
+		}
+	}
+}
+
+func TestListDirectoriesHandlerPaging(t *testing.T) {
+	catalog := setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "One", MediaType: "video"},
+		db.MediaIndexEntry{ID: "b2", Title: "Two", MediaType: "video"},
+		db.MediaIndexEntry{ID: "c3", Title: "Three", MediaType: "video"},
+	)
+	var ids []string
+	query := "?mType=video&sort=title&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatalf("paging does not end, got %v", ids)
+		}
+		w := httptest.NewRecorder()
+		ListDirectoriesHandler(catalog)(w, httptest.NewRequest(http.MethodGet, "/list"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %v", w.Code, w.Body)
+		}
+		var page entryPage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "?mType=video&sort=title&limit=2&cursor=" + page.NextCursor
+	}
+	if strings.Join(ids, ",") != "a1,c3,b2" {
+		t.Errorf("got %v, want [a1 c3 b2]", ids)
+	}
+}
+
+func TestMemoryRepositoryUpdateEntry(t *testing.T) {
+	catalog := db.NewMemoryRepository()
+	catalog.AddEntry(CTX, db.MediaIndexEntry{ID: "a1", Title: "Show", MediaType: "video", Tags: []string{"one"}})
+	if err := catalog.AddEntry(CTX, db.MediaIndexEntry{ID: "a1", Title: "Copy", MediaType: "video"}); !errors.Is(err, db.ErrExists) {
+		t.Errorf("adding a duplicate id: got %v, want ErrExists", err)
+	}
+
+	failed := errors.New("failed")
+	_, err := catalog.UpdateEntry(CTX, "video", "a1", func(entry *db.MediaIndexEntry) error {
+		entry.Title = "Changed"
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("got %v, want the error of the update", err)
+	}
+	if entry, _ := catalog.GetEntry(CTX, "video", "a1"); entry.Title != "Show" {
+		t.Errorf("a failed update was saved: %+v", entry)
+	}
+
+	updated, err := catalog.UpdateEntry(CTX, "video", "a1", func(entry *db.MediaIndexEntry) error {
+		entry.ID, entry.MediaType = "b2", "audio"
+		entry.Tags[0] = "two"
+		return nil
+	})
+	if err != nil || updated.ID != "a1" || updated.MediaType != "video" {
+		t.Errorf("an update changed the key of an entry: %+v, %v", updated, err)
+	}
+
+	// Callers never share slices with the stored entry
+	updated.Tags[0] = "three"
+	if entry, _ := catalog.GetEntry(CTX, "video", "a1"); entry.Tags[0] != "two" {
+		t.Errorf("got tags %v, want [two]", entry.Tags)
+	}
+}
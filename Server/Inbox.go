@@ -0,0 +1,356 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Jobs the inbox submits are owned by this name, which is how failed ones are
+// found again to be quarantined
+const inboxOwner = "inbox"
+
+const quarantineDir = "quarantine"
+
+// inboxReport is written beside a quarantined item to say why it was rejected
+type inboxReport struct {
+	Item   string    `json:"item"`
+	Job    string    `json:"job,omitempty"`
+	Error  string    `json:"error"`
+	Failed time.Time `json:"failed"`
+}
+
+// inboxWatcher picks up zipped or unzipped HLS packages dropped into a
+// directory. An item is only taken once it has not changed between two polls,
+// so files still being copied in are left alone
+type inboxWatcher struct {
+	dir  string
+	seen map[string]string
+}
+
+func newInboxWatcher(dir string) (*inboxWatcher, error) {
+	if err := os.MkdirAll(filepath.Join(dir, quarantineDir), 0755); err != nil {
+		return nil, err
+	}
+	return &inboxWatcher{dir: dir, seen: map[string]string{}}, nil
+}
+
+func (iw *inboxWatcher) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			iw.poll()
+		}
+	}
+}
+
+// poll quarantines the inbox jobs that failed since the last poll and submits
+// the items that have settled
+func (iw *inboxWatcher) poll() {
+	iw.quarantineFailedJobs()
+
+	items, err := os.ReadDir(iw.dir)
+	if err != nil {
+		Log.Error(err.Error())
+		return
+	}
+	seen := map[string]string{}
+	for _, item := range items {
+		name := item.Name()
+		if strings.HasPrefix(name, ".") || name == quarantineDir || strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if !item.IsDir() && strings.ToLower(filepath.Ext(name)) != ".zip" {
+			continue
+		}
+		signature, err := iw.signature(name)
+		if err != nil {
+			continue
+		}
+		if iw.seen[name] != signature {
+			// Changed or new since the last poll, look again next time
+			seen[name] = signature
+			continue
+		}
+		if err := iw.submit(name); err != nil {
+			Log.Error(fmt.Sprintf("Inbox item %v rejected: %v", name, err))
+			// An item that cannot be moved is left for the next poll to try again
+			if err := iw.quarantine(filepath.Join(iw.dir, name), inboxReport{Item: name, Error: err.Error(), Failed: time.Now()}); err != nil {
+				Log.Error(err.Error())
+				continue
+			}
+			if _, err := os.Stat(iw.sidecar(name)); err == nil {
+				if err := iw.quarantine(iw.sidecar(name), inboxReport{}); err != nil {
+					Log.Error(err.Error())
+				}
+			}
+		}
+	}
+	iw.seen = seen
+}
+
+// signature summarises an item and its sidecar so changes between polls show up
+func (iw *inboxWatcher) signature(name string) (string, error) {
+	var files, size int64
+	var modified time.Time
+	err := filepath.WalkDir(filepath.Join(iw.dir, name), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		size += info.Size()
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(iw.sidecar(name)); err == nil {
+		size += info.Size()
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return fmt.Sprintf("%d/%d/%d", files, size, modified.UnixNano()), nil
+}
+
+// sidecar is the optional metadata file for an item: movie.zip or movie/ take
+// their metadata from movie.json
+func (iw *inboxWatcher) sidecar(name string) string {
+	return filepath.Join(iw.dir, strings.TrimSuffix(name, filepath.Ext(name))+".json")
+}
+
+// metadata builds the entry for an item from its sidecar, falling back to a
+// video titled after the item
+func (iw *inboxWatcher) metadata(name string) (MediaIndexEntry, error) {
+	mie := MediaIndexEntry{MediaType: "video"}
+	data, err := os.ReadFile(iw.sidecar(name))
+	if err != nil && !os.IsNotExist(err) {
+		return mie, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &mie); err != nil {
+			return mie, fmt.Errorf("invalid sidecar metadata: %v", err)
+		}
+	}
+	if mie.Title == "" {
+		mie.Title = inferTitle(strings.TrimSuffix(name, filepath.Ext(name)))
+	}
+	if mie.MediaType != "video" && mie.MediaType != "audio" {
+		return mie, fmt.Errorf("invalid media type %q", mie.MediaType)
+	}
+	if !validTitle(mie.Title) {
+		return mie, fmt.Errorf("invalid title")
+	}
+	// Ids and locations are the server's to choose
+	mie.ID = ""
+	mie.Location = ""
+	return mie, nil
+}
+
+// submit moves an item and its sidecar out of the inbox into a source
+// directory and queues the unpack job that ingests it
+func (iw *inboxWatcher) submit(name string) error {
+	mie, err := iw.metadata(name)
+	if err != nil {
+		return err
+	}
+	sourceID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	sourceDir := filepath.Join(chunksRoot, "source-"+sourceID)
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return err
+	}
+	source := filepath.Join(sourceDir, name)
+	if err := moveFile(filepath.Join(iw.dir, name), source); err != nil {
+		// A copy that failed part way is cleaned up by moveFile, anything left
+		// behind may be all there is of the item and is kept
+		os.Remove(sourceDir)
+		return err
+	}
+	// The sidecar travels with the item so a failure can put both back together
+	if _, err := os.Stat(iw.sidecar(name)); err == nil {
+		if err := moveFile(iw.sidecar(name), filepath.Join(sourceDir, filepath.Base(iw.sidecar(name)))); err != nil {
+			Log.Error(err.Error())
+			iw.restore(name, sourceDir)
+			return nil
+		}
+	}
+	job, err := Jobs.Submit(db.Job{
+		Kind:     JobUnpack,
+		Owner:    inboxOwner,
+		Metadata: db.MediaIndexEntry(mie),
+		Source:   source,
+	})
+	if err != nil {
+		// Put it back, the next poll tries again
+		Log.Error(err.Error())
+		iw.restore(name, sourceDir)
+		return nil
+	}
+	Log.Info(fmt.Sprintf("Inbox item %v queued as job %v", name, job.ID))
+	return nil
+}
+
+// restore moves an item and its sidecar from sourceDir back into the inbox.
+// sourceDir is only removed once both are back, otherwise it is kept with
+// whatever did not move
+func (iw *inboxWatcher) restore(name, sourceDir string) {
+	err := moveFile(filepath.Join(sourceDir, name), filepath.Join(iw.dir, name))
+	sidecar := filepath.Join(sourceDir, filepath.Base(iw.sidecar(name)))
+	if _, statErr := os.Stat(sidecar); err == nil && statErr == nil {
+		err = moveFile(sidecar, iw.sidecar(name))
+	}
+	if err != nil {
+		Log.Error(fmt.Sprintf("Unable to return inbox item %v, it is kept in %v: %v", name, sourceDir, err))
+		return
+	}
+	os.RemoveAll(sourceDir)
+}
+
+// quarantineFailedJobs moves the sources of failed and cancelled inbox jobs
+// into the quarantine directory with a report of what went wrong. A job keeps
+// its source until the item and its sidecar have both moved, so one that
+// cannot be moved is tried again on the next poll
+func (iw *inboxWatcher) quarantineFailedJobs() {
+	jobs, err := Jobs.List()
+	if err != nil {
+		Log.Error(err.Error())
+		return
+	}
+	for _, job := range jobs {
+		if job.Owner != inboxOwner || job.Source == "" || (job.Status != JobFailed && job.Status != JobCancelled) {
+			continue
+		}
+		_, err := Jobs.update(job.ID, func(stored *db.Job) error {
+			if stored.Source == "" || (stored.Status != JobFailed && stored.Status != JobCancelled) {
+				return ErrJobState
+			}
+			name := filepath.Base(stored.Source)
+			reason := stored.Error
+			if stored.Status == JobCancelled {
+				reason = "cancelled"
+			}
+			sidecar := filepath.Join(filepath.Dir(stored.Source), strings.TrimSuffix(name, filepath.Ext(name))+".json")
+			// The item may have moved on an earlier poll that failed at the sidecar
+			if _, err := os.Stat(stored.Source); err == nil {
+				if err := iw.quarantine(stored.Source, inboxReport{Item: name, Job: stored.ID, Error: reason, Failed: stored.Finished}); err != nil {
+					return err
+				}
+			}
+			if _, err := os.Stat(sidecar); err == nil {
+				if err := iw.quarantine(sidecar, inboxReport{}); err != nil {
+					return err
+				}
+			}
+			removeJobSource(*stored)
+			stored.Source = ""
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrJobState) {
+			Log.Error(err.Error())
+		}
+	}
+}
+
+// quarantine moves path into the quarantine directory, renaming it if the name
+// is taken, and writes report beside it unless it is empty. An error means
+// path did not move; a report that cannot be written is only logged
+func (iw *inboxWatcher) quarantine(path string, report inboxReport) error {
+	name := filepath.Base(path)
+	dest := filepath.Join(iw.dir, quarantineDir, name)
+	if _, err := os.Stat(dest); err == nil {
+		ext := filepath.Ext(name)
+		name = fmt.Sprintf("%v-%v%v", strings.TrimSuffix(name, ext), time.Now().Unix(), ext)
+		dest = filepath.Join(iw.dir, quarantineDir, name)
+	}
+	if err := moveFile(path, dest); err != nil {
+		return fmt.Errorf("unable to quarantine %v: %w", path, err)
+	}
+	if report.Error == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(dest+".error.json", data, 0644)
+	}
+	if err != nil {
+		Log.Error(err.Error())
+	}
+	return nil
+}
+
+// moveFile renames a file or directory, copying it when the rename fails
+// because src and dest are on different filesystems
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	if err := copyTree(context.Background(), src, dest); err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies a file, or a directory with the regular files in it. Links
+// and other special files are left out
+func copyTree(ctx context.Context, src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type().IsRegular():
+			return copyFile(path, target)
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
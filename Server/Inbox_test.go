@@ -0,0 +1,229 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupInbox gives a test an inbox in its working directory and a job queue
+// with no workers
+func setupInbox(t *testing.T) *inboxWatcher {
+	t.Helper()
+	useTempDir(t)
+	setupJobs(t)
+	iw, err := newInboxWatcher("inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return iw
+}
+
+func TestInboxMetadata(t *testing.T) {
+	iw := setupInbox(t)
+	tests := []struct {
+		name    string
+		item    string
+		sidecar string
+		err     bool
+		want    MediaIndexEntry
+	}{
+		{name: "no sidecar", item: "The_Movie.zip", want: MediaIndexEntry{Title: "The Movie", MediaType: "video"}},
+		{
+			name: "sidecar", item: "album", sidecar: `{"title": "Album", "mediaType": "audio", "genre": ["jazz"]}`,
+			want: MediaIndexEntry{Title: "Album", MediaType: "audio", Genre: []string{"jazz"}},
+		},
+		{
+			name: "the server picks the id", item: "show.zip", sidecar: `{"id": "../x", "location": "/etc", "title": "Show"}`,
+			want: MediaIndexEntry{Title: "Show", MediaType: "video"},
+		},
+		{name: "bad media type", item: "show.zip", sidecar: `{"mediaType": "image"}`, err: true},
+		{name: "bad sidecar", item: "show.zip", sidecar: `{`, err: true},
+	}
+	for _, tt := range tests {
+		os.Remove(iw.sidecar(tt.item))
+		if tt.sidecar != "" {
+			os.WriteFile(iw.sidecar(tt.item), []byte(tt.sidecar), 0644)
+		}
+		mie, err := iw.metadata(tt.item)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if mie.ID != "" || mie.Location != "" || mie.Title != tt.want.Title || mie.MediaType != tt.want.MediaType || len(mie.Genre) != len(tt.want.Genre) {
+			t.Errorf("%v: got %+v", tt.name, mie)
+		}
+	}
+}
+
+func TestInboxPoll(t *testing.T) {
+	iw := setupInbox(t)
+	archive := buildArchive(t, []archiveFile{{name: "output.m3u8", mode: 0644, body: "#EXTM3U\n"}})
+	os.WriteFile(filepath.Join("inbox", "show.zip"), archive, 0644)
+	os.WriteFile(filepath.Join("inbox", "show.json"), []byte(`{"title": "Show", "mediaType": "video"}`), 0644)
+	os.WriteFile(filepath.Join("inbox", "notes.txt"), []byte("not media"), 0644)
+	os.WriteFile(filepath.Join("inbox", "bad.zip"), archive, 0644)
+	os.WriteFile(filepath.Join("inbox", "bad.json"), []byte(`{"mediaType": "image"}`), 0644)
+
+	// An item is only taken once it has looked the same on two polls
+	iw.poll()
+	if jobs, _ := Jobs.List(); len(jobs) != 0 {
+		t.Fatalf("submitted %d jobs on the first poll", len(jobs))
+	}
+	iw.poll()
+	jobs, err := Jobs.List()
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("got %d jobs, %v", len(jobs), err)
+	}
+	job := jobs[0]
+	if job.Kind != JobUnpack || job.Owner != inboxOwner || job.Metadata.Title != "Show" || filepath.Base(job.Source) != "show.zip" {
+		t.Errorf("got job %+v", job)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(job.Source), "show.json")); err != nil {
+		t.Errorf("the sidecar did not move with the item: %v", err)
+	}
+	for _, name := range []string{"show.zip", "show.json", "bad.zip", "bad.json"} {
+		if _, err := os.Stat(filepath.Join("inbox", name)); !os.IsNotExist(err) {
+			t.Errorf("%v is still in the inbox", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("inbox", "notes.txt")); err != nil {
+		t.Errorf("a file that is not an item was touched: %v", err)
+	}
+
+	// Items that cannot be submitted go straight to quarantine with a report
+	data, err := os.ReadFile(filepath.Join("inbox", quarantineDir, "bad.zip.error.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report inboxReport
+	json.Unmarshal(data, &report)
+	if report.Item != "bad.zip" || report.Error == "" {
+		t.Errorf("got report %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join("inbox", quarantineDir, "bad.json")); err != nil {
+		t.Errorf("the sidecar was not quarantined: %v", err)
+	}
+}
+
+func TestInboxQuarantineFailedJobs(t *testing.T) {
+	iw := setupInbox(t)
+	os.WriteFile(filepath.Join("inbox", "broken.zip"), []byte("not a zip"), 0644)
+	os.WriteFile(filepath.Join("inbox", "broken.json"), []byte(`{"title": "Broken"}`), 0644)
+	iw.poll()
+	iw.poll()
+	jobs, _ := Jobs.List()
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs", len(jobs))
+	}
+	if err := Jobs.Start(1); err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, jobs[0].ID)
+	if job.Status != JobFailed {
+		t.Fatalf("got %+v", job)
+	}
+	source := job.Source
+
+	iw.poll()
+	job, _ = Jobs.Get(job.ID)
+	if job.Source != "" {
+		t.Errorf("the job still has its source %v", job.Source)
+	}
+	if _, err := os.Stat(filepath.Dir(source)); !os.IsNotExist(err) {
+		t.Errorf("the source directory was kept: %v", err)
+	}
+	for _, name := range []string{"broken.zip", "broken.zip.error.json", "broken.json"} {
+		if _, err := os.Stat(filepath.Join("inbox", quarantineDir, name)); err != nil {
+			t.Errorf("%v was not quarantined: %v", name, err)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join("inbox", quarantineDir, "broken.zip.error.json"))
+	var report inboxReport
+	json.Unmarshal(data, &report)
+	if report.Job != job.ID || report.Error == "" {
+		t.Errorf("got report %+v", report)
+	}
+}
+
+func TestInboxSubmitFailure(t *testing.T) {
+	iw := setupInbox(t)
+	// A job store that cannot be written makes every submit fail
+	dir := filepath.Join(t.TempDir(), "jobs")
+	store, err := newFileJobStore(filepath.Join(dir, "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	os.WriteFile(dir, nil, 0644)
+	Jobs = NewJobQueue(store, db.NewMemoryRepository())
+
+	archive := buildArchive(t, []archiveFile{{name: "output.m3u8", mode: 0644, body: "#EXTM3U\n"}})
+	os.WriteFile(filepath.Join("inbox", "show.zip"), archive, 0644)
+	os.WriteFile(filepath.Join("inbox", "show.json"), []byte(`{"title": "Show"}`), 0644)
+	iw.poll()
+	iw.poll()
+
+	// Both are put back for the next poll rather than quarantined
+	for _, name := range []string{"show.zip", "show.json"} {
+		if _, err := os.Stat(filepath.Join("inbox", name)); err != nil {
+			t.Errorf("%v was not put back: %v", name, err)
+		}
+	}
+	if sources, _ := filepath.Glob(filepath.Join(chunksRoot, "source-*")); len(sources) != 0 {
+		t.Errorf("source directories were left behind: %v", sources)
+	}
+	if quarantined, _ := os.ReadDir(filepath.Join("inbox", quarantineDir)); len(quarantined) != 0 {
+		t.Errorf("quarantined %v", quarantined)
+	}
+}
+
+func TestInboxQuarantineRetries(t *testing.T) {
+	iw := setupInbox(t)
+	source := writeJobSource(t, []byte("not a zip"))
+	os.WriteFile(filepath.Join(filepath.Dir(source), "upload.json"), []byte(`{"title": "Broken"}`), 0644)
+	job, err := Jobs.Submit(db.Job{Kind: JobUnpack, Owner: inboxOwner, Source: source, Metadata: db.MediaIndexEntry{Title: "Broken", MediaType: "video"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Jobs.Start(1); err != nil {
+		t.Fatal(err)
+	}
+	if job = waitForJob(t, job.ID); job.Status != JobFailed {
+		t.Fatalf("got %+v", job)
+	}
+
+	// Nothing can be moved while the quarantine directory is a file
+	quarantine := filepath.Join("inbox", quarantineDir)
+	os.RemoveAll(quarantine)
+	os.WriteFile(quarantine, nil, 0644)
+	iw.poll()
+	if job, _ = Jobs.Get(job.ID); job.Source != source {
+		t.Errorf("the job lost its source %q", job.Source)
+	}
+	for _, name := range []string{"upload.zip", "upload.json"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(source), name)); err != nil {
+			t.Errorf("%v was removed before it was quarantined: %v", name, err)
+		}
+	}
+
+	os.Remove(quarantine)
+	os.Mkdir(quarantine, 0755)
+	iw.poll()
+	if job, _ = Jobs.Get(job.ID); job.Source != "" {
+		t.Errorf("the job still has its source %q", job.Source)
+	}
+	for _, name := range []string{"upload.zip", "upload.zip.error.json", "upload.json"} {
+		if _, err := os.Stat(filepath.Join(quarantine, name)); err != nil {
+			t.Errorf("%v was not quarantined: %v", name, err)
+		}
+	}
+}
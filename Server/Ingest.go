@@ -0,0 +1,129 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrEntryExists = errors.New("an entry with that id already exists")
+
+// mediaLocation is the directory an entry's HLS package lives in
+func mediaLocation(mie MediaIndexEntry) string {
+	return filepath.Join("./media", mie.MediaType, mie.ID)
+}
+
+// validID reports whether an entry id is safe to use as a directory name. IDs
+// are ObjectIDs, but without a database the directory names are the ids
+func validID(id string) bool {
+	return strings.TrimSpace(id) != "" && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, `/\`)
+}
+
+// migrateEntryIDs gives entries stored before entries had IDs their ID, and
+// moves their directories from ./media/<type>/<title> to ./media/<type>/<id>.
+// It is safe to run on every start, only entries without an ID are touched
+func migrateEntryIDs() error {
+	for _, mediaType := range []string{"video", "audio"} {
+		entries, err := DBClient.EntriesWithoutID(CTX, mediaType)
+		if err != nil {
+			return err
+		}
+		for id, entry := range entries {
+			mie := MediaIndexEntry(entry)
+			mie.ID = id
+			oldDir := mie.Location
+			if oldDir == "" {
+				oldDir = filepath.Join("./media", mediaType, mie.Title)
+			}
+			newDir := mediaLocation(mie)
+			// A previous run may have moved the directory before it was interrupted
+			if _, err := os.Stat(newDir); os.IsNotExist(err) {
+				if err := os.Rename(oldDir, newDir); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to move %v: %v", oldDir, err)
+				}
+			}
+			if err := DBClient.AssignEntryID(CTX, mediaType, id, newDir); err != nil {
+				return err
+			}
+			Log.Info(fmt.Sprintf("Migrated %v %q to id %v", mediaType, mie.Title, id))
+		}
+	}
+	return nil
+}
+
+// ingestArchive extracts a zipped HLS package, or copies an unzipped one, into
+// ./media/<type>/<id>, checks that it is playable and records it in the
+// catalog. Nothing is left on disk if any step fails
+func ingestArchive(ctx context.Context, catalog db.MediaRepository, mie MediaIndexEntry, source string, progress func(float64)) (MediaIndexEntry, error) {
+	if err := ensureMediaDirectoriesExist(); err != nil {
+		return mie, err
+	}
+	if mie.ID == "" {
+		mie.ID = db.NewEntryID()
+	}
+	mie.Location = mediaLocation(mie)
+	// Never extract over an existing entry, a failed upload would take it down with it
+	if _, err := os.Stat(mie.Location); err == nil {
+		return mie, ErrEntryExists
+	}
+
+	// Extract into a hidden directory first so a half extracted package never shows up as an entry
+	workID, err := randomHex(8)
+	if err != nil {
+		return mie, err
+	}
+	workDir := filepath.Join("./media", mie.MediaType, ".unpack-"+workID)
+	defer os.RemoveAll(workDir)
+	if info, statErr := os.Stat(source); statErr == nil && info.IsDir() {
+		// The source is left alone so the job can be retried
+		err = copyTree(ctx, source, workDir)
+	} else {
+		err = unzip(ctx, source, workDir, progress)
+	}
+	if err != nil {
+		return mie, err
+	}
+	return registerPackage(catalog, workDir, mie)
+}
+
+// unpack is the JobUnpack runner
+func unpack(ctx context.Context, catalog db.MediaRepository, job db.Job, progress func(float64)) (MediaIndexEntry, error) {
+	return ingestArchive(ctx, catalog, MediaIndexEntry(job.Metadata), job.Source, progress)
+}
+
+// registerPackage moves the HLS package in workDir to mie.Location, validates it
+// and adds it to the catalog. The package is removed if any step fails
+func registerPackage(catalog db.MediaRepository, workDir string, mie MediaIndexEntry) (MediaIndexEntry, error) {
+	scanMutex.RLock()
+	defer scanMutex.RUnlock()
+	if _, err := os.Stat(mie.Location); err == nil {
+		return mie, ErrEntryExists
+	}
+	if err := os.Rename(workDir, mie.Location); err != nil {
+		return mie, err
+	}
+	var err error
+	mie.Playlist, mie.Duration, err = validateHLSPackage(mie.Location)
+	if err == nil {
+		mie = attachPackagedSubtitles(mie)
+		// Packages may arrive with renditions of their own, record those too
+		if master, masterRel, err := masterPlaylist(mie); err == nil && masterRel == mie.Playlist {
+			mie = withRenditions(mie, master, masterRel)
+		}
+	}
+	if err == nil {
+		mie.Added = time.Now().UTC().Truncate(time.Millisecond)
+		err = catalog.AddEntry(CTX, db.MediaIndexEntry(mie))
+	}
+	if err != nil {
+		// Roll back so nothing half usable is left in ./media
+		os.RemoveAll(mie.Location)
+		return mie, err
+	}
+	return mie, nil
+}
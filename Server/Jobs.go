@@ -0,0 +1,524 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobFailed    = "failed"
+	JobDone      = "done"
+	JobCancelled = "cancelled"
+)
+
+const (
+	JobUnpack    = "unpack"
+	JobTranscode = "transcode"
+)
+
+// JobSourceRetention is how long the source of a failed or cancelled job is
+// kept around for a retry
+var JobSourceRetention = 72 * time.Hour
+
+// Progress is only written back to the store when it moves this much
+const jobProgressStep = 1.0
+
+var ErrJobState = errors.New("job is not in a state that allows this")
+
+// JobStore persists jobs. *db.MongoClient implements it when the database is
+// connected, fileJobStore otherwise
+type JobStore interface {
+	AddJob(ctx context.Context, job db.Job) error
+	GetJob(ctx context.Context, id string) (db.Job, error)
+	ListJobs(ctx context.Context) ([]db.Job, error)
+	UpdateJob(ctx context.Context, job db.Job) error
+	DeleteJob(ctx context.Context, id string) error
+}
+
+// JobQueue runs persisted jobs on a fixed number of workers
+type JobQueue struct {
+	store   JobStore
+	catalog db.MediaRepository
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending []string
+	cancels map[string]context.CancelFunc
+}
+
+var Jobs *JobQueue
+
+func NewJobQueue(store JobStore, catalog db.MediaRepository) *JobQueue {
+	q := &JobQueue{
+		store:   store,
+		catalog: catalog,
+		cancels: map[string]context.CancelFunc{},
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Start requeues the jobs a previous run left behind and starts the workers
+func (q *JobQueue) Start(workers int) error {
+	jobs, err := q.store.ListJobs(CTX)
+	if err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	for _, job := range jobs {
+		if job.Status == JobRunning {
+			// The server stopped while this was running, start it over
+			Log.Info(fmt.Sprintf("Requeueing %v job %v interrupted by a restart", job.Kind, job.ID))
+			job.Status = JobQueued
+			job.Progress = 0
+			if err := q.store.UpdateJob(CTX, job); err != nil {
+				Log.Error(err.Error())
+				continue
+			}
+		}
+		if job.Status == JobQueued {
+			q.pending = append(q.pending, job.ID)
+		}
+	}
+	q.mutex.Unlock()
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return nil
+}
+
+func (q *JobQueue) Submit(job db.Job) (db.Job, error) {
+	id, err := randomHex(12)
+	if err != nil {
+		return job, err
+	}
+	job.ID = id
+	job.Status = JobQueued
+	job.Created = time.Now()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.store.AddJob(CTX, job); err != nil {
+		return job, err
+	}
+	q.pending = append(q.pending, job.ID)
+	q.cond.Signal()
+	return job, nil
+}
+
+func (q *JobQueue) Get(id string) (db.Job, error) {
+	return q.store.GetJob(CTX, id)
+}
+
+// List returns every job, newest first
+func (q *JobQueue) List() ([]db.Job, error) {
+	jobs, err := q.store.ListJobs(CTX)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].Created.After(jobs[j].Created) })
+	return jobs, nil
+}
+
+// update applies fn to the stored job under the queue lock so concurrent updates are not lost
+func (q *JobQueue) update(id string, fn func(job *db.Job) error) (db.Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.updateLocked(id, fn)
+}
+
+func (q *JobQueue) updateLocked(id string, fn func(job *db.Job) error) (db.Job, error) {
+	job, err := q.store.GetJob(CTX, id)
+	if err != nil {
+		return job, err
+	}
+	if err := fn(&job); err != nil {
+		return job, err
+	}
+	return job, q.store.UpdateJob(CTX, job)
+}
+
+// Cancel stops a running job or drops a queued one
+func (q *JobQueue) Cancel(id string) (db.Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if cancel, ok := q.cancels[id]; ok {
+		// The worker records the cancelled state once the job has stopped
+		cancel()
+		return q.store.GetJob(CTX, id)
+	}
+	return q.updateLocked(id, func(job *db.Job) error {
+		if job.Status != JobQueued {
+			return ErrJobState
+		}
+		job.Status = JobCancelled
+		job.Finished = time.Now()
+		return nil
+	})
+}
+
+// Retry queues a failed or cancelled job again
+func (q *JobQueue) Retry(id string) (db.Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, err := q.updateLocked(id, func(job *db.Job) error {
+		if job.Status != JobFailed && job.Status != JobCancelled {
+			return ErrJobState
+		}
+		// Artwork and episodes are made from the published package rather than an upload
+		if job.Source == "" && job.Kind != JobArtwork && job.Kind != JobPodcast {
+			return fmt.Errorf("%w: the source is no longer available", ErrJobState)
+		}
+		job.Status = JobQueued
+		job.Error = ""
+		job.Progress = 0
+		job.Started = time.Time{}
+		job.Finished = time.Time{}
+		return nil
+	})
+	if err != nil {
+		return job, err
+	}
+	q.pending = append(q.pending, job.ID)
+	q.cond.Signal()
+	return job, nil
+}
+
+// Remove deletes a finished job along with whatever is left of its source
+func (q *JobQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, err := q.store.GetJob(CTX, id)
+	if err != nil {
+		return err
+	}
+	if job.Status == JobQueued || job.Status == JobRunning {
+		return ErrJobState
+	}
+	removeJobSource(job)
+	return q.store.DeleteJob(CTX, id)
+}
+
+func (q *JobQueue) next() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.pending) == 0 {
+		q.cond.Wait()
+	}
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id
+}
+
+// start marks a queued job as running. It returns false if the job was cancelled while it waited
+func (q *JobQueue) start(id string, cancel context.CancelFunc) (db.Job, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, err := q.updateLocked(id, func(job *db.Job) error {
+		if job.Status != JobQueued {
+			return ErrJobState
+		}
+		job.Status = JobRunning
+		job.Progress = 0
+		job.Attempts++
+		job.Started = time.Now()
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrJobState) {
+			Log.Error(err.Error())
+		}
+		return job, false
+	}
+	q.cancels[id] = cancel
+	return job, true
+}
+
+func (q *JobQueue) worker() {
+	for {
+		id := q.next()
+		ctx, cancel := context.WithCancel(CTX)
+		job, ok := q.start(id, cancel)
+		if !ok {
+			cancel()
+			continue
+		}
+		Log.Info(fmt.Sprintf("Starting %v job %v for %v", job.Kind, job.ID, job.Metadata.Title))
+
+		lastProgress := 0.0
+		progress := func(percent float64) {
+			if percent-lastProgress < jobProgressStep {
+				return
+			}
+			lastProgress = percent
+			_, err := q.update(id, func(job *db.Job) error {
+				job.Progress = percent
+				return nil
+			})
+			if err != nil {
+				Log.Error(err.Error())
+			}
+		}
+
+		var mie MediaIndexEntry
+		var err error
+		switch job.Kind {
+		case JobUnpack:
+			mie, err = unpack(ctx, q.catalog, job, progress)
+		case JobTranscode:
+			mie, err = transcode(ctx, q.catalog, job, progress)
+		case JobArtwork:
+			mie, err = generateArtwork(ctx, q.catalog, job, progress)
+		case JobAudioTrack:
+			mie, err = addAudioTrack(ctx, q.catalog, job, progress)
+		case JobPodcast:
+			mie, err = preparePodcastEpisode(ctx, q.catalog, job, progress)
+		default:
+			err = fmt.Errorf("unknown job kind %q", job.Kind)
+		}
+		cancelled := ctx.Err() != nil
+
+		q.mutex.Lock()
+		delete(q.cancels, id)
+		cancel()
+		job, updateErr := q.updateLocked(id, func(job *db.Job) error {
+			job.Finished = time.Now()
+			job.Metadata = db.MediaIndexEntry(mie)
+			switch {
+			case cancelled:
+				job.Status = JobCancelled
+			case err != nil:
+				job.Status = JobFailed
+				job.Error = err.Error()
+			default:
+				// The source goes in the same update, so a finished job is
+				// never seen still holding it
+				job.Status = JobDone
+				job.Progress = 100
+				removeJobSource(*job)
+				job.Source = ""
+			}
+			return nil
+		})
+		q.mutex.Unlock()
+		if updateErr != nil {
+			Log.Error(updateErr.Error())
+		}
+
+		switch job.Status {
+		case JobCancelled:
+			Log.Info(fmt.Sprintf("Cancelled %v job %v", job.Kind, job.ID))
+		case JobFailed:
+			Log.Error(fmt.Sprintf("%v job %v failed: %v", job.Kind, job.ID, err))
+		default:
+			Log.Info(fmt.Sprintf("Finished %v job %v", job.Kind, job.ID))
+			if job.Kind == JobUnpack || job.Kind == JobTranscode {
+				queueArtwork(mie, job.Owner)
+				queueNewEpisode(mie, job.Owner)
+			}
+		}
+	}
+}
+
+// removeJobSource deletes the directory holding a job's source file
+func removeJobSource(job db.Job) {
+	if job.Source == "" {
+		return
+	}
+	if err := os.RemoveAll(filepath.Dir(job.Source)); err != nil {
+		Log.Error(err.Error())
+	}
+}
+
+// pruneJobSources frees the disk used by failed and cancelled jobs nobody retried
+func (q *JobQueue) pruneJobSources() {
+	jobs, err := q.store.ListJobs(CTX)
+	if err != nil {
+		Log.Error(err.Error())
+		return
+	}
+	cutoff := time.Now().Add(-JobSourceRetention)
+	for _, job := range jobs {
+		if job.Source == "" || (job.Status != JobFailed && job.Status != JobCancelled) || job.Finished.After(cutoff) {
+			continue
+		}
+		_, err := q.update(job.ID, func(stored *db.Job) error {
+			if stored.Status != JobFailed && stored.Status != JobCancelled {
+				return ErrJobState
+			}
+			removeJobSource(*stored)
+			stored.Source = ""
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrJobState) {
+			Log.Error(err.Error())
+		}
+	}
+}
+
+func (q *JobQueue) pruneJobSourcesPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.pruneJobSources()
+		}
+	}
+}
+
+// removeWorkDirectories clears the hidden directories jobs extract and transcode
+// into. Anything there at startup was left behind by a crash
+func removeWorkDirectories() {
+	for _, mediaType := range []string{"video", "audio"} {
+		dir := filepath.Join("./media", mediaType)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					Log.Error(err.Error())
+				}
+			}
+		}
+	}
+}
+
+// JobsHandler serves the job API. Uploaders only see their own jobs
+//
+//	GET    /jobs/              list jobs, optionally filtered with ?status=
+//	GET    /jobs/<id>          one job
+//	POST   /jobs/<id>/cancel   cancel a queued or running job
+//	POST   /jobs/<id>/retry    queue a failed or cancelled job again
+//	DELETE /jobs/<id>          forget a finished job
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		all, err := Jobs.List()
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		jobs := []db.Job{}
+		for _, job := range all {
+			if (job.Owner == user.Username || user.Role == RoleAdmin) && (status == "" || job.Status == status) {
+				jobs = append(jobs, job)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+		return
+	}
+
+	job, err := Jobs.Get(parts[0])
+	if err == nil && job.Owner != user.Username && user.Role != RoleAdmin {
+		err = db.ErrNotFound
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		err = Jobs.Remove(job.ID)
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+		job, err = Jobs.Cancel(job.ID)
+	case len(parts) == 2 && parts[1] == "retry" && r.Method == http.MethodPost:
+		job, err = Jobs.Retry(job.ID)
+	default:
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, ErrJobState) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+type fileJobStore struct {
+	store *jsonFileStore[db.Job]
+}
+
+func newFileJobStore(path string) (*fileJobStore, error) {
+	store, err := newJSONFileStore[db.Job](path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileJobStore{store: store}, nil
+}
+
+func (fs *fileJobStore) AddJob(ctx context.Context, job db.Job) error {
+	return fs.store.put(job.ID, job)
+}
+
+func (fs *fileJobStore) GetJob(ctx context.Context, id string) (db.Job, error) {
+	job, ok := fs.store.get(id)
+	if !ok {
+		return job, db.ErrNotFound
+	}
+	return job, nil
+}
+
+func (fs *fileJobStore) ListJobs(ctx context.Context) ([]db.Job, error) {
+	jobs := fs.store.list()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs, nil
+}
+
+func (fs *fileJobStore) UpdateJob(ctx context.Context, job db.Job) error {
+	found, err := fs.store.update(job.ID, func(stored *db.Job) {
+		*stored = job
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (fs *fileJobStore) DeleteJob(ctx context.Context, id string) error {
+	return fs.store.delete(id)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupJobs gives the tests a job queue backed by a file store and an empty
+// in-memory catalog. No workers are started unless a test calls Start itself
+func setupJobs(t *testing.T) *fileJobStore {
+	t.Helper()
+	store, err := newFileJobStore(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Jobs = NewJobQueue(store, db.NewMemoryRepository())
+	return store
+}
+
+// writeJobSource creates a source file in its own directory, the way a finalized upload leaves it
+func writeJobSource(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "source-upload", "upload.zip")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// waitForJob polls until the job has finished one way or the other
+func waitForJob(t *testing.T, id string) db.Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := Jobs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != JobQueued && job.Status != JobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %v did not finish", id)
+	return db.Job{}
+}
+
+func TestJobQueueStates(t *testing.T) {
+	setupJobs(t)
+	source := writeJobSource(t, []byte("zip"))
+	job, err := Jobs.Submit(db.Job{Kind: JobUnpack, Owner: "uploader", Source: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" || job.Status != JobQueued {
+		t.Fatalf("got %+v", job)
+	}
+
+	if _, err := Jobs.Retry(job.ID); !errors.Is(err, ErrJobState) {
+		t.Errorf("retry a queued job: got %v", err)
+	}
+	if err := Jobs.Remove(job.ID); !errors.Is(err, ErrJobState) {
+		t.Errorf("remove a queued job: got %v", err)
+	}
+	job, err = Jobs.Cancel(job.ID)
+	if err != nil || job.Status != JobCancelled || job.Finished.IsZero() {
+		t.Fatalf("cancel: got %+v, %v", job, err)
+	}
+	if _, err := Jobs.Cancel(job.ID); !errors.Is(err, ErrJobState) {
+		t.Errorf("cancel a cancelled job: got %v", err)
+	}
+	job, err = Jobs.Retry(job.ID)
+	if err != nil || job.Status != JobQueued || !job.Finished.IsZero() {
+		t.Fatalf("retry: got %+v, %v", job, err)
+	}
+	Jobs.Cancel(job.ID)
+	if err := Jobs.Remove(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Jobs.Get(job.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("removed job is still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(source)); !os.IsNotExist(err) {
+		t.Errorf("the source of a removed job was kept: %v", err)
+	}
+}
+
+func TestJobQueueRuns(t *testing.T) {
+	useTempDir(t)
+	setupJobs(t)
+	if err := Jobs.Start(1); err != nil {
+		t.Fatal(err)
+	}
+	archive := buildArchive(t, []archiveFile{
+		{name: "output.m3u8", mode: 0644, body: "#EXTM3U\n#EXTINF:4,\nsegment0.ts\n#EXT-X-ENDLIST\n"},
+		{name: "segment0.ts", mode: 0644, body: "ts"},
+	})
+	source := writeJobSource(t, archive)
+	job, err := Jobs.Submit(db.Job{Kind: JobUnpack, Source: source, Metadata: db.MediaIndexEntry{Title: "Show", MediaType: "video"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, job.ID)
+	if job.Status != JobDone || job.Progress != 100 || job.Attempts != 1 || job.Metadata.Playlist != "output.m3u8" {
+		t.Fatalf("got %+v", job)
+	}
+	if _, err := os.Stat(filepath.Dir(source)); !os.IsNotExist(err) || job.Source != "" {
+		t.Errorf("the source of a finished job was kept: %v", err)
+	}
+
+	// A failed job keeps its source for a retry
+	source = writeJobSource(t, []byte("not a zip"))
+	job, err = Jobs.Submit(db.Job{Kind: JobUnpack, Source: source, Metadata: db.MediaIndexEntry{Title: "Bad", MediaType: "video"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, job.ID)
+	if job.Status != JobFailed || job.Error == "" || job.Source == "" {
+		t.Fatalf("got %+v", job)
+	}
+	if _, err := Jobs.Retry(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, job.ID)
+	if job.Status != JobFailed || job.Attempts != 2 {
+		t.Fatalf("retried job: got %+v", job)
+	}
+}
+
+func TestJobQueueRecovery(t *testing.T) {
+	store := setupJobs(t)
+	now := time.Now()
+	jobs := []db.Job{
+		{ID: "running", Kind: "unknown", Status: JobRunning, Progress: 50, Created: now},
+		{ID: "queued", Kind: "unknown", Status: JobQueued, Created: now.Add(time.Second)},
+		{ID: "done", Kind: "unknown", Status: JobDone, Created: now.Add(2 * time.Second)},
+	}
+	for _, job := range jobs {
+		store.AddJob(CTX, job)
+	}
+	if err := Jobs.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := Jobs.Get("running"); job.Status != JobQueued || job.Progress != 0 {
+		t.Errorf("interrupted job was not requeued: %+v", job)
+	}
+	if len(Jobs.pending) != 2 || Jobs.pending[0] != "running" || Jobs.pending[1] != "queued" {
+		t.Errorf("got pending %v", Jobs.pending)
+	}
+	listed, err := Jobs.List()
+	if err != nil || len(listed) != 3 || listed[0].ID != "done" {
+		t.Errorf("List is not newest first: %v, %v", listed, err)
+	}
+}
+
+func TestPruneJobSources(t *testing.T) {
+	store := setupJobs(t)
+	old := writeJobSource(t, []byte("old"))
+	recent := writeJobSource(t, []byte("recent"))
+	finished := time.Now().Add(-JobSourceRetention - time.Hour)
+	store.AddJob(CTX, db.Job{ID: "old", Status: JobFailed, Source: old, Finished: finished})
+	store.AddJob(CTX, db.Job{ID: "recent", Status: JobCancelled, Source: recent, Finished: time.Now()})
+
+	Jobs.pruneJobSources()
+	if job, _ := Jobs.Get("old"); job.Source != "" {
+		t.Errorf("old job kept its source %v", job.Source)
+	}
+	if _, err := os.Stat(filepath.Dir(old)); !os.IsNotExist(err) {
+		t.Errorf("old source is still on disk: %v", err)
+	}
+	if job, _ := Jobs.Get("recent"); job.Source != recent {
+		t.Errorf("recent job lost its source")
+	}
+	if _, err := Jobs.Retry("old"); !errors.Is(err, ErrJobState) {
+		t.Errorf("retry without a source: got %v", err)
+	}
+}
+
+func TestJobsHandler(t *testing.T) {
+	setupUsers(t)
+	store := setupJobs(t)
+	addTestUser(t, "other", RoleUploader, "secret")
+	store.AddJob(CTX, db.Job{ID: "mine", Owner: RoleUploader, Status: JobQueued})
+	store.AddJob(CTX, db.Job{ID: "theirs", Owner: "other", Status: JobFailed})
+	handler := RequireRole(RoleUploader, JobsHandler)
+
+	list := func(user, query string) []string {
+		w := serveAs(t, user, handler, httptest.NewRequest(http.MethodGet, "/jobs/"+query, nil))
+		var jobs []db.Job
+		json.NewDecoder(w.Body).Decode(&jobs)
+		var ids []string
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		return ids
+	}
+	if ids := list(RoleUploader, ""); len(ids) != 1 || ids[0] != "mine" {
+		t.Errorf("uploader sees %v", ids)
+	}
+	if ids := list(RoleAdmin, ""); len(ids) != 2 {
+		t.Errorf("admin sees %v", ids)
+	}
+	if ids := list(RoleAdmin, "?status=failed"); len(ids) != 1 || ids[0] != "theirs" {
+		t.Errorf("admin sees failed jobs %v", ids)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		status int
+	}{
+		{"someone else's job", RoleUploader, http.MethodGet, "/jobs/theirs", http.StatusNotFound},
+		{"unknown job", RoleUploader, http.MethodGet, "/jobs/none", http.StatusNotFound},
+		{"retry a queued job", RoleUploader, http.MethodPost, "/jobs/mine/retry", http.StatusConflict},
+		{"cancel", RoleUploader, http.MethodPost, "/jobs/mine/cancel", http.StatusOK},
+		{"delete", RoleUploader, http.MethodDelete, "/jobs/mine", http.StatusOK},
+		{"admin opens any job", RoleAdmin, http.MethodGet, "/jobs/theirs", http.StatusOK},
+		{"viewer", RoleViewer, http.MethodGet, "/jobs/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := serveAs(t, tt.user, handler, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+	}
+}
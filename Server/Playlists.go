@@ -0,0 +1,416 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PlaylistStore persists users' playlists. *db.MongoClient implements it when
+// the database is connected, filePlaylistStore otherwise
+type PlaylistStore interface {
+	AddPlaylist(ctx context.Context, playlist db.Playlist) error
+	GetPlaylist(ctx context.Context, id string) (db.Playlist, error)
+	ListPlaylists(ctx context.Context, owner string) ([]db.Playlist, error)
+	UpdatePlaylist(ctx context.Context, playlist db.Playlist) error
+	DeletePlaylist(ctx context.Context, id string) error
+}
+
+var Playlists PlaylistStore
+
+var MaxPlaylistItems = 5000
+
+// PublicURL is where clients reach the server, used to build the absolute
+// media URLs handed to other programs. Without it the request's host is used
+var PublicURL = ""
+
+// TrustProxy makes publicBaseURL believe X-Forwarded-Proto and X-Forwarded-Host.
+// Only turn it on behind a proxy that sets them, anyone can send them otherwise
+var TrustProxy bool
+
+type playlistRequest struct {
+	Name  string            `json:"name"`
+	Items []db.PlaylistItem `json:"items"`
+}
+
+// playlistImport is the answer to an import, Unresolved are the URLs that did
+// not lead to an entry and were left out
+type playlistImport struct {
+	Playlist   db.Playlist `json:"playlist"`
+	Unresolved []string    `json:"unresolved"`
+}
+
+// publicBaseURL is the scheme and host media URLs are built on
+func publicBaseURL(r *http.Request) string {
+	if PublicURL != "" {
+		return strings.TrimSuffix(PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if TrustProxy {
+		// A chain of proxies appends to the headers, the first is the client's
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.TrimSpace(proto); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		forwarded, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		if forwarded = strings.TrimSpace(forwarded); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return scheme + "://" + host
+}
+
+// entryFileURL is the URL of a file of an entry below prefix, which is
+// "<base>/media" for the API
+func entryFileURL(prefix string, entry db.MediaIndexEntry, file string) string {
+	return fmt.Sprintf("%v/%v/%v/%v", prefix, entry.MediaType, url.PathEscape(entry.ID), file)
+}
+
+// entryPlaylist is the playlist file of an entry, entries from before the
+// playlist was recorded use output.m3u8
+func entryPlaylist(entry db.MediaIndexEntry) string {
+	if entry.Playlist == "" {
+		return "output.m3u8"
+	}
+	return entry.Playlist
+}
+
+var mediaURLPattern = regexp.MustCompile(`/media/(video|audio)/([^/]+)/`)
+
+// resolveMediaURL finds the entry a playlist.json URL points at. URLs saved
+// before entries had ids name the entry by title
+func resolveMediaURL(catalog db.MediaRepository, titles map[string]map[string]string, mediaURL string) (db.PlaylistItem, bool) {
+	match := mediaURLPattern.FindStringSubmatch(mediaURL)
+	if match == nil {
+		return db.PlaylistItem{}, false
+	}
+	mediaType := match[1]
+	name, err := url.PathUnescape(match[2])
+	if err != nil {
+		return db.PlaylistItem{}, false
+	}
+	if _, err := catalog.GetEntry(CTX, mediaType, name); err == nil {
+		return db.PlaylistItem{MediaType: mediaType, EntryID: name}, true
+	}
+	if id, ok := titles[mediaType][name]; ok {
+		return db.PlaylistItem{MediaType: mediaType, EntryID: id}, true
+	}
+	return db.PlaylistItem{}, false
+}
+
+// checkPlaylist validates a playlist's name and items, every item has to point
+// at an entry in the catalog
+func checkPlaylist(catalog db.MediaRepository, req playlistRequest) (playlistRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return req, fmt.Errorf("name cannot be empty")
+	}
+	if len(req.Items) > MaxPlaylistItems {
+		return req, fmt.Errorf("a playlist can hold at most %d items", MaxPlaylistItems)
+	}
+	items := make([]db.PlaylistItem, 0, len(req.Items))
+	for _, item := range req.Items {
+		if item.MediaType != "video" && item.MediaType != "audio" {
+			return req, fmt.Errorf("invalid media type %q", item.MediaType)
+		}
+		if !validID(item.EntryID) {
+			return req, fmt.Errorf("invalid entry id %q", item.EntryID)
+		}
+		if _, err := catalog.GetEntry(CTX, item.MediaType, item.EntryID); err != nil {
+			return req, fmt.Errorf("entry %v/%v: %w", item.MediaType, item.EntryID, err)
+		}
+		items = append(items, db.PlaylistItem{MediaType: item.MediaType, EntryID: item.EntryID})
+	}
+	req.Items = items
+	return req, nil
+}
+
+// expandPlaylist fills in the entries of a playlist's items. Items whose entry
+// has been deleted since are kept without one
+func expandPlaylist(catalog db.MediaRepository, playlist db.Playlist) (db.Playlist, error) {
+	// The items may be shared with a stored copy, which must stay without entries
+	playlist.Items = append([]db.PlaylistItem{}, playlist.Items...)
+	for i, item := range playlist.Items {
+		entry, err := catalog.GetEntry(CTX, item.MediaType, item.EntryID)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return playlist, err
+		}
+		playlist.Items[i].Entry = &entry
+	}
+	return playlist, nil
+}
+
+func newPlaylist(owner string, req playlistRequest) (db.Playlist, error) {
+	id, err := randomHex(12)
+	if err != nil {
+		return db.Playlist{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	return db.Playlist{ID: id, Owner: owner, Name: req.Name, Items: req.Items, Created: now, Updated: now}, nil
+}
+
+// PlaylistsHandler serves the signed in user's playlists. Admins can open,
+// change and delete anyone's
+//
+//	GET    /playlists/                the user's playlists, without their entries
+//	POST   /playlists/                {"name": "x", "items": [{"mediaType": "video", "entryId": "id"}]}
+//	POST   /playlists/import?name=x   a playlist.json array of media URLs
+//	GET    /playlists/<id>            the playlist with each item's entry
+//	PUT    /playlists/<id>            replace the name and items
+//	DELETE /playlists/<id>            delete the playlist
+//	GET    /playlists/<id>/export     the playlist as a playlist.json array of media URLs
+func PlaylistsHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := currentUser(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/playlists"), "/"), "/")
+
+		switch {
+		case parts[0] == "" && r.Method == http.MethodGet:
+			playlists, err := Playlists.ListPlaylists(CTX, user.Username)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(playlists)
+			return
+		case parts[0] == "" && r.Method == http.MethodPost:
+			var req playlistRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, "Invalid playlist JSON", http.StatusBadRequest)
+				return
+			}
+			createPlaylist(w, catalog, user.Username, req, nil)
+			return
+		case len(parts) == 1 && parts[0] == "import" && r.Method == http.MethodPost:
+			var urls []string
+			if err := json.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&urls); err != nil {
+				http.Error(w, "Invalid playlist.json, expected an array of URLs", http.StatusBadRequest)
+				return
+			}
+			req, unresolved, err := importPlaylist(catalog, r.URL.Query().Get("name"), urls)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			createPlaylist(w, catalog, user.Username, req, unresolved)
+			return
+		}
+
+		playlist, err := Playlists.GetPlaylist(CTX, parts[0])
+		if err == nil && playlist.Owner != user.Username && user.Role != RoleAdmin {
+			err = db.ErrNotFound
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Playlist not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			playlist, err = expandPlaylist(catalog, playlist)
+		case len(parts) == 1 && r.Method == http.MethodPut:
+			var req playlistRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, "Invalid playlist JSON", http.StatusBadRequest)
+				return
+			}
+			req, err = checkPlaylist(catalog, req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			playlist.Name = req.Name
+			playlist.Items = req.Items
+			playlist.Updated = time.Now().UTC().Truncate(time.Millisecond)
+			err = Playlists.UpdatePlaylist(CTX, playlist)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			err = Playlists.DeletePlaylist(CTX, playlist.ID)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case len(parts) == 2 && parts[1] == "export" && r.Method == http.MethodGet:
+			exportPlaylist(w, r, catalog, playlist)
+			return
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Playlist not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(playlist)
+	}
+}
+
+func createPlaylist(w http.ResponseWriter, catalog db.MediaRepository, owner string, req playlistRequest, unresolved []string) {
+	req, err := checkPlaylist(catalog, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	playlist, err := newPlaylist(owner, req)
+	if err == nil {
+		err = Playlists.AddPlaylist(CTX, playlist)
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if unresolved != nil {
+		json.NewEncoder(w).Encode(playlistImport{Playlist: playlist, Unresolved: unresolved})
+		return
+	}
+	json.NewEncoder(w).Encode(playlist)
+}
+
+// importPlaylist turns the URLs of a playlist.json into playlist items, in
+// order, and returns the URLs it could not resolve
+func importPlaylist(catalog db.MediaRepository, name string, urls []string) (playlistRequest, []string, error) {
+	req := playlistRequest{Name: name, Items: []db.PlaylistItem{}}
+	if strings.TrimSpace(req.Name) == "" {
+		req.Name = "Imported playlist"
+	}
+	titles := map[string]map[string]string{}
+	for _, mediaType := range []string{"video", "audio"} {
+		entries, err := catalog.ListEntries(CTX, mediaType)
+		if err != nil {
+			return req, nil, err
+		}
+		titles[mediaType] = map[string]string{}
+		for _, entry := range entries {
+			titles[mediaType][entry.Title] = entry.ID
+		}
+	}
+	unresolved := []string{}
+	for _, mediaURL := range urls {
+		item, ok := resolveMediaURL(catalog, titles, mediaURL)
+		if !ok {
+			unresolved = append(unresolved, mediaURL)
+			continue
+		}
+		req.Items = append(req.Items, item)
+	}
+	return req, unresolved, nil
+}
+
+// exportPlaylist writes a playlist in the playlist.json format the client
+// downloads, leaving out items whose entry has been deleted
+func exportPlaylist(w http.ResponseWriter, r *http.Request, catalog db.MediaRepository, playlist db.Playlist) {
+	playlist, err := expandPlaylist(catalog, playlist)
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	base := publicBaseURL(r)
+	urls := []string{}
+	for _, item := range playlist.Items {
+		if item.Entry != nil {
+			urls = append(urls, entryFileURL(base+"/media", *item.Entry, entryPlaylist(*item.Entry)))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="playlist.json"`)
+	json.NewEncoder(w).Encode(urls)
+}
+
+type filePlaylistStore struct {
+	store *jsonFileStore[db.Playlist]
+}
+
+func newFilePlaylistStore(path string) (*filePlaylistStore, error) {
+	store, err := newJSONFileStore[db.Playlist](path)
+	if err != nil {
+		return nil, err
+	}
+	return &filePlaylistStore{store: store}, nil
+}
+
+func (fs *filePlaylistStore) AddPlaylist(ctx context.Context, playlist db.Playlist) error {
+	inserted, err := fs.store.insert(playlist.ID, playlist)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return db.ErrExists
+	}
+	return nil
+}
+
+func (fs *filePlaylistStore) GetPlaylist(ctx context.Context, id string) (db.Playlist, error) {
+	playlist, ok := fs.store.get(id)
+	if !ok {
+		return playlist, db.ErrNotFound
+	}
+	return playlist, nil
+}
+
+func (fs *filePlaylistStore) ListPlaylists(ctx context.Context, owner string) ([]db.Playlist, error) {
+	playlists := []db.Playlist{}
+	for _, playlist := range fs.store.list() {
+		if owner == "" || playlist.Owner == owner {
+			playlists = append(playlists, playlist)
+		}
+	}
+	sort.Slice(playlists, func(i, j int) bool {
+		if playlists[i].Name != playlists[j].Name {
+			return playlists[i].Name < playlists[j].Name
+		}
+		return playlists[i].ID < playlists[j].ID
+	})
+	return playlists, nil
+}
+
+func (fs *filePlaylistStore) UpdatePlaylist(ctx context.Context, playlist db.Playlist) error {
+	found, err := fs.store.update(playlist.ID, func(stored *db.Playlist) {
+		stored.Name = playlist.Name
+		stored.Items = playlist.Items
+		stored.Updated = playlist.Updated
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (fs *filePlaylistStore) DeletePlaylist(ctx context.Context, id string) error {
+	return fs.store.delete(id)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPublicBaseURL(t *testing.T) {
+	defer func(publicURL string, trustProxy bool) { PublicURL, TrustProxy = publicURL, trustProxy }(PublicURL, TrustProxy)
+	forwarded := map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "media.example.org, proxy.internal"}
+	tests := []struct {
+		name       string
+		publicURL  string
+		tls        bool
+		trustProxy bool
+		headers    map[string]string
+		want       string
+	}{
+		{name: "request host", want: "http://example.com"},
+		{name: "tls", tls: true, want: "https://example.com"},
+		{name: "public url", publicURL: "https://media.example.org/", want: "https://media.example.org"},
+		{name: "forwarded headers ignored", headers: forwarded, want: "http://example.com"},
+		{name: "forwarded headers trusted", trustProxy: true, headers: forwarded, want: "https://media.example.org"},
+		{name: "bad forwarded scheme", trustProxy: true, headers: map[string]string{"X-Forwarded-Proto": "javascript"}, want: "http://example.com"},
+		{name: "public url wins", publicURL: "https://media.example.org", trustProxy: true, headers: map[string]string{"X-Forwarded-Host": "evil.example"}, want: "https://media.example.org"},
+	}
+	for _, tt := range tests {
+		PublicURL, TrustProxy = tt.publicURL, tt.trustProxy
+		r := httptest.NewRequest(http.MethodGet, "/playlists/", nil)
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := publicBaseURL(r); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// setupPlaylists gives a test the test users, a file playlist store and a
+// catalog with a video and an audio entry
+func setupPlaylists(t *testing.T) *db.MemoryRepository {
+	t.Helper()
+	setupUsers(t)
+	addTestUser(t, "other", RoleViewer, "secret")
+	store, err := newFilePlaylistStore(filepath.Join(t.TempDir(), "playlists.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Playlists = store
+	return setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "Show", MediaType: "video", Playlist: "output.m3u8"},
+		db.MediaIndexEntry{ID: "b2", Title: "Song", MediaType: "audio", Playlist: "master.m3u8"},
+	)
+}
+
+func callPlaylists(t *testing.T, catalog db.MediaRepository, user, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	return serveAs(t, user, RequireRole(RoleViewer, PlaylistsHandler(catalog)), r)
+}
+
+func TestPlaylistsHandler(t *testing.T) {
+	catalog := setupPlaylists(t)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"blank name", `{"name": " ", "items": []}`, http.StatusBadRequest},
+		{"bad media type", `{"name": "x", "items": [{"mediaType": "image", "entryId": "a1"}]}`, http.StatusBadRequest},
+		{"unknown entry", `{"name": "x", "items": [{"mediaType": "video", "entryId": "z9"}]}`, http.StatusBadRequest},
+		{"not json", `[`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := callPlaylists(t, catalog, RoleViewer, http.MethodPost, "/playlists/", tt.body); w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+
+	w := callPlaylists(t, catalog, RoleViewer, http.MethodPost, "/playlists/",
+		`{"name": " Mix ", "items": [{"mediaType": "video", "entryId": "a1"}, {"mediaType": "audio", "entryId": "b2"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %v", w.Code, w.Body)
+	}
+	var playlist db.Playlist
+	json.NewDecoder(w.Body).Decode(&playlist)
+	if playlist.ID == "" || playlist.Name != "Mix" || playlist.Owner != RoleViewer || len(playlist.Items) != 2 {
+		t.Fatalf("got %+v", playlist)
+	}
+	path := "/playlists/" + playlist.ID
+
+	// Only the owner and admins can see a playlist
+	if w := callPlaylists(t, catalog, "other", http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another user: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := callPlaylists(t, catalog, RoleAdmin, http.MethodGet, path, ""); w.Code != http.StatusOK {
+		t.Errorf("admin: got %d, want %d", w.Code, http.StatusOK)
+	}
+	var list []db.Playlist
+	json.NewDecoder(callPlaylists(t, catalog, "other", http.MethodGet, "/playlists/", "").Body).Decode(&list)
+	if len(list) != 0 {
+		t.Errorf("another user lists %+v", list)
+	}
+
+	// A deleted entry stays in the playlist without its metadata
+	catalog.DeleteEntry(CTX, "audio", "b2")
+	json.NewDecoder(callPlaylists(t, catalog, RoleViewer, http.MethodGet, path, "").Body).Decode(&playlist)
+	if len(playlist.Items) != 2 || playlist.Items[0].Entry == nil || playlist.Items[0].Entry.Title != "Show" || playlist.Items[1].Entry != nil {
+		t.Errorf("got items %+v", playlist.Items)
+	}
+
+	w = callPlaylists(t, catalog, RoleViewer, http.MethodPut, path, `{"name": "Renamed", "items": [{"mediaType": "video", "entryId": "a1"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: got %d %v", w.Code, w.Body)
+	}
+	if stored, _ := Playlists.GetPlaylist(CTX, playlist.ID); stored.Name != "Renamed" || len(stored.Items) != 1 || stored.Items[0].Entry != nil {
+		t.Errorf("stored %+v", stored)
+	}
+	if w := callPlaylists(t, catalog, "other", http.MethodDelete, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another user deleted: got %d", w.Code)
+	}
+	if w := callPlaylists(t, catalog, RoleViewer, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d %v", w.Code, w.Body)
+	}
+	if w := callPlaylists(t, catalog, RoleViewer, http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("after a delete: got %d", w.Code)
+	}
+}
+
+func TestPlaylistImportExport(t *testing.T) {
+	catalog := setupPlaylists(t)
+	urls := `[
+		"http://old-host:4000/media/video/a1/output.m3u8",
+		"http://old-host:4000/media/audio/Song/output.m3u8",
+		"http://old-host:4000/media/video/Missing/output.m3u8",
+		"not a media url"
+	]`
+	w := callPlaylists(t, catalog, RoleViewer, http.MethodPost, "/playlists/import", urls)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %v", w.Code, w.Body)
+	}
+	var imported playlistImport
+	json.NewDecoder(w.Body).Decode(&imported)
+	playlist := imported.Playlist
+	if playlist.Name != "Imported playlist" || len(playlist.Items) != 2 || playlist.Items[0].EntryID != "a1" || playlist.Items[1].EntryID != "b2" {
+		t.Errorf("got %+v", playlist)
+	}
+	if len(imported.Unresolved) != 2 {
+		t.Errorf("got unresolved %v", imported.Unresolved)
+	}
+	if w := callPlaylists(t, catalog, RoleViewer, http.MethodPost, "/playlists/import", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("not an array: got %d", w.Code)
+	}
+
+	defer func(publicURL string) { PublicURL = publicURL }(PublicURL)
+	PublicURL = "https://media.example.org"
+	w = callPlaylists(t, catalog, RoleViewer, http.MethodGet, "/playlists/"+playlist.ID+"/export", "")
+	var exported []string
+	json.NewDecoder(w.Body).Decode(&exported)
+	want := "https://media.example.org/media/video/a1/output.m3u8,https://media.example.org/media/audio/b2/master.m3u8"
+	if strings.Join(exported, ",") != want {
+		t.Errorf("got %v, want %v", exported, want)
+	}
+}
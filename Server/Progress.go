@@ -0,0 +1,260 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProgressStore persists how far each user got into each entry.
+// *db.MongoClient implements it when the database is connected,
+// fileProgressStore otherwise
+type ProgressStore interface {
+	SaveProgress(ctx context.Context, progress db.Progress) error
+	GetProgress(ctx context.Context, username, mediaType, id string) (db.Progress, error)
+	ListProgress(ctx context.Context, username string) ([]db.Progress, error)
+	DeleteProgress(ctx context.Context, username, mediaType, id string) error
+}
+
+var WatchProgress ProgressStore
+
+// WatchedThreshold is the fraction of an entry that has to be played for it to
+// count as watched
+var WatchedThreshold = 0.9
+
+// progressUpdate is the body of PUT /progress/<type>/<id>. Duration defaults to
+// the entry's, Watched overrides the threshold when it is set
+type progressUpdate struct {
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Watched  *bool   `json:"watched"`
+}
+
+// continueItem is one row of the continue watching list
+type continueItem struct {
+	db.Progress
+	Entry db.MediaIndexEntry `json:"entry"`
+}
+
+// applyProgress records a new position. An entry becomes watched once the
+// position passes the threshold and stays watched when it is started again,
+// until the client says otherwise
+func applyProgress(progress db.Progress, update progressUpdate, duration float64) db.Progress {
+	progress.Position = update.Position
+	progress.Duration = duration
+	if update.Duration > 0 {
+		progress.Duration = update.Duration
+	}
+	if progress.Duration > 0 && progress.Position >= progress.Duration*WatchedThreshold {
+		progress.Watched = true
+	}
+	if update.Watched != nil {
+		progress.Watched = *update.Watched
+	}
+	progress.Updated = time.Now().UTC().Truncate(time.Millisecond)
+	return progress
+}
+
+// ProgressHandler serves the signed in user's playback positions
+//
+//	GET    /progress/                    every position, most recent first, ?watched= filters
+//	GET    /progress/continue?limit=     unfinished entries with their metadata, most recent first
+//	GET    /progress/<type>/<id>         one position, zero if the entry was never played
+//	PUT    /progress/<type>/<id>         {"position": 12.5, "duration": 3600, "watched": true}
+//	DELETE /progress/<type>/<id>         forget the position
+func ProgressHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := currentUser(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/progress"), "/"), "/")
+
+		switch {
+		case r.Method == http.MethodGet && parts[0] == "":
+			progress, err := WatchProgress.ListProgress(CTX, user.Username)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if v := r.URL.Query().Get("watched"); v != "" {
+				watched, err := strconv.ParseBool(v)
+				if err != nil {
+					http.Error(w, "Invalid watched filter", http.StatusBadRequest)
+					return
+				}
+				filtered := []db.Progress{}
+				for _, p := range progress {
+					if p.Watched == watched {
+						filtered = append(filtered, p)
+					}
+				}
+				progress = filtered
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(progress)
+		case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "continue":
+			limit := 20
+			if v := r.URL.Query().Get("limit"); v != "" {
+				var err error
+				limit, err = strconv.Atoi(v)
+				if err != nil || limit <= 0 || limit > MaxPageSize {
+					http.Error(w, "Invalid limit", http.StatusBadRequest)
+					return
+				}
+			}
+			items, err := continueWatching(catalog, user.Username, limit)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(items)
+		case len(parts) == 2:
+			mediaType, id := parts[0], parts[1]
+			if mediaType != "video" && mediaType != "audio" {
+				http.Error(w, "Invalid media type", http.StatusBadRequest)
+				return
+			}
+			if !validID(id) {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+			entryProgress(w, r, catalog, user.Username, mediaType, id)
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func entryProgress(w http.ResponseWriter, r *http.Request, catalog db.MediaRepository, username, mediaType, id string) {
+	progress, err := WatchProgress.GetProgress(CTX, username, mediaType, id)
+	if errors.Is(err, db.ErrNotFound) {
+		progress = db.Progress{Username: username, MediaType: mediaType, EntryID: id}
+	} else if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(progress)
+	case http.MethodPut:
+		var update progressUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid progress JSON", http.StatusBadRequest)
+			return
+		}
+		if update.Position < 0 || update.Duration < 0 {
+			http.Error(w, "Position and duration cannot be negative", http.StatusBadRequest)
+			return
+		}
+		entry, err := catalog.GetEntry(CTX, mediaType, id)
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		progress = applyProgress(progress, update, entry.Duration)
+		if err := WatchProgress.SaveProgress(CTX, progress); err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(progress)
+	case http.MethodDelete:
+		if err := WatchProgress.DeleteProgress(CTX, username, mediaType, id); err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// continueWatching lists the entries a user started and has not finished,
+// most recently played first. Entries that have since been deleted are left out
+func continueWatching(catalog db.MediaRepository, username string, limit int) ([]continueItem, error) {
+	progress, err := WatchProgress.ListProgress(CTX, username)
+	if err != nil {
+		return nil, err
+	}
+	items := []continueItem{}
+	for _, p := range progress {
+		if len(items) == limit {
+			break
+		}
+		if p.Watched || p.Position <= 0 {
+			continue
+		}
+		entry, err := catalog.GetEntry(CTX, p.MediaType, p.EntryID)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, continueItem{Progress: p, Entry: entry})
+	}
+	return items, nil
+}
+
+type fileProgressStore struct {
+	store *jsonFileStore[db.Progress]
+}
+
+func newFileProgressStore(path string) (*fileProgressStore, error) {
+	store, err := newJSONFileStore[db.Progress](path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileProgressStore{store: store}, nil
+}
+
+// progressKey is unambiguous because media types and ids never contain a "/"
+func progressKey(username, mediaType, id string) string {
+	return mediaType + "/" + id + "/" + username
+}
+
+func (fs *fileProgressStore) SaveProgress(ctx context.Context, progress db.Progress) error {
+	return fs.store.put(progressKey(progress.Username, progress.MediaType, progress.EntryID), progress)
+}
+
+func (fs *fileProgressStore) GetProgress(ctx context.Context, username, mediaType, id string) (db.Progress, error) {
+	progress, ok := fs.store.get(progressKey(username, mediaType, id))
+	if !ok {
+		return progress, db.ErrNotFound
+	}
+	return progress, nil
+}
+
+func (fs *fileProgressStore) ListProgress(ctx context.Context, username string) ([]db.Progress, error) {
+	progress := []db.Progress{}
+	for _, p := range fs.store.list() {
+		if p.Username == username {
+			progress = append(progress, p)
+		}
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Updated.After(progress[j].Updated)
+	})
+	return progress, nil
+}
+
+func (fs *fileProgressStore) DeleteProgress(ctx context.Context, username, mediaType, id string) error {
+	return fs.store.delete(progressKey(username, mediaType, id))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyProgress(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		watched  bool
+		update   progressUpdate
+		duration float64
+		want     db.Progress
+	}{
+		{"started", false, progressUpdate{Position: 10}, 100, db.Progress{Position: 10, Duration: 100}},
+		{"past the threshold", false, progressUpdate{Position: 90}, 100, db.Progress{Position: 90, Duration: 100, Watched: true}},
+		{"client duration wins", false, progressUpdate{Position: 90, Duration: 200}, 100, db.Progress{Position: 90, Duration: 200}},
+		{"unknown duration", false, progressUpdate{Position: 90}, 0, db.Progress{Position: 90}},
+		{"rewatching stays watched", true, progressUpdate{Position: 5}, 100, db.Progress{Position: 5, Duration: 100, Watched: true}},
+		{"marked unwatched", true, progressUpdate{Position: 95, Watched: &no}, 100, db.Progress{Position: 95, Duration: 100}},
+		{"marked watched", false, progressUpdate{Position: 0, Watched: &yes}, 100, db.Progress{Duration: 100, Watched: true}},
+	}
+	for _, tt := range tests {
+		got := applyProgress(db.Progress{Watched: tt.watched}, tt.update, tt.duration)
+		if got.Position != tt.want.Position || got.Duration != tt.want.Duration || got.Watched != tt.want.Watched || got.Updated.IsZero() {
+			t.Errorf("%v: got %+v", tt.name, got)
+		}
+	}
+}
+
+// setupProgress gives a test the viewer users, a file progress store and a
+// catalog with two videos of 100 seconds
+func setupProgress(t *testing.T) *db.MemoryRepository {
+	t.Helper()
+	setupUsers(t)
+	store, err := newFileProgressStore(filepath.Join(t.TempDir(), "progress.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	WatchProgress = store
+	addTestUser(t, "other", RoleViewer, "secret")
+	return setupCatalog(t,
+		db.MediaIndexEntry{ID: "a1", Title: "One", MediaType: "video", Duration: 100},
+		db.MediaIndexEntry{ID: "b2", Title: "Two", MediaType: "video", Duration: 100},
+	)
+}
+
+func callProgress(t *testing.T, catalog db.MediaRepository, user, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	return serveAs(t, user, RequireRole(RoleViewer, ProgressHandler(catalog)), r)
+}
+
+func TestProgressHandler(t *testing.T) {
+	catalog := setupProgress(t)
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"never played", RoleViewer, http.MethodGet, "/progress/video/a1", "", http.StatusOK},
+		{"bad media type", RoleViewer, http.MethodGet, "/progress/image/a1", "", http.StatusBadRequest},
+		{"bad id", RoleViewer, http.MethodGet, "/progress/video/..", "", http.StatusBadRequest},
+		{"unknown entry", RoleViewer, http.MethodPut, "/progress/video/z9", `{"position": 1}`, http.StatusNotFound},
+		{"negative position", RoleViewer, http.MethodPut, "/progress/video/a1", `{"position": -1}`, http.StatusBadRequest},
+		{"not json", RoleViewer, http.MethodPut, "/progress/video/a1", `1`, http.StatusBadRequest},
+		{"bad method", RoleViewer, http.MethodPost, "/progress/video/a1", `{"position": 1}`, http.StatusMethodNotAllowed},
+		{"bad watched filter", RoleViewer, http.MethodGet, "/progress/?watched=maybe", "", http.StatusBadRequest},
+		{"bad limit", RoleViewer, http.MethodGet, "/progress/continue?limit=0", "", http.StatusBadRequest},
+		{"started", RoleViewer, http.MethodPut, "/progress/video/a1", `{"position": 30}`, http.StatusOK},
+		{"finished", RoleViewer, http.MethodPut, "/progress/video/b2", `{"position": 95}`, http.StatusOK},
+		{"another user", "other", http.MethodPut, "/progress/video/b2", `{"position": 10}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := callProgress(t, catalog, tt.user, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+		// Keep the updates apart so the most recent one is clear
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	var progress db.Progress
+	json.NewDecoder(callProgress(t, catalog, RoleViewer, http.MethodGet, "/progress/video/a1", "").Body).Decode(&progress)
+	if progress.Position != 30 || progress.Duration != 100 || progress.Watched {
+		t.Errorf("got %+v", progress)
+	}
+
+	var list []db.Progress
+	json.NewDecoder(callProgress(t, catalog, RoleViewer, http.MethodGet, "/progress/", "").Body).Decode(&list)
+	if len(list) != 2 || list[0].EntryID != "b2" || list[1].EntryID != "a1" {
+		t.Errorf("got %+v, want b2 then a1", list)
+	}
+	json.NewDecoder(callProgress(t, catalog, RoleViewer, http.MethodGet, "/progress/?watched=true", "").Body).Decode(&list)
+	if len(list) != 1 || list[0].EntryID != "b2" {
+		t.Errorf("watched: got %+v", list)
+	}
+
+	// Watched entries and other users' positions are not in the list
+	var items []continueItem
+	json.NewDecoder(callProgress(t, catalog, RoleViewer, http.MethodGet, "/progress/continue", "").Body).Decode(&items)
+	if len(items) != 1 || items[0].EntryID != "a1" || items[0].Entry.Title != "One" {
+		t.Errorf("continue: got %+v", items)
+	}
+	// Nor are entries that have been deleted since
+	catalog.DeleteEntry(CTX, "video", "b2")
+	json.NewDecoder(callProgress(t, catalog, "other", http.MethodGet, "/progress/continue", "").Body).Decode(&items)
+	if len(items) != 0 {
+		t.Errorf("continue after a delete: got %+v", items)
+	}
+
+	if w := callProgress(t, catalog, RoleViewer, http.MethodDelete, "/progress/video/a1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d %v", w.Code, w.Body)
+	}
+	json.NewDecoder(callProgress(t, catalog, RoleViewer, http.MethodGet, "/progress/video/a1", "").Body).Decode(&progress)
+	if progress.Position != 0 {
+		t.Errorf("after a delete: got %+v", progress)
+	}
+}
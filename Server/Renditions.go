@@ -0,0 +1,174 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"Farnsworth/Server/hls"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// renditionMutex serialises rewrites of master playlists
+var renditionMutex sync.Mutex
+
+// masterPlaylist returns the entry's master playlist and its path relative to
+// the entry's directory. A package that only has a media playlist is given a
+// master playlist wrapping it, which is not written until the caller saves it
+func masterPlaylist(mie MediaIndexEntry) (*hls.Playlist, string, error) {
+	entry := filepath.Join(mie.Location, filepath.FromSlash(mie.Playlist))
+	p, err := hls.ParseFile(entry)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.Master {
+		return p, mie.Playlist, nil
+	}
+
+	name := "master.m3u8"
+	if path.Base(mie.Playlist) == name {
+		name = "main.m3u8"
+	}
+	masterRel := path.Join(path.Dir(mie.Playlist), name)
+	if _, err := os.Stat(filepath.Join(mie.Location, filepath.FromSlash(masterRel))); err == nil {
+		return nil, "", fmt.Errorf("%v already exists", masterRel)
+	}
+	master := &hls.Playlist{Master: true, Version: 3}
+	master.Variants = append(master.Variants, hls.Variant{
+		URI:        path.Base(mie.Playlist),
+		Attributes: map[string]string{"BANDWIDTH": fmt.Sprint(peakBandwidth(mie.Location, mie.Playlist, p))},
+	})
+	return master, masterRel, nil
+}
+
+// peakBandwidth estimates the BANDWIDTH of a media playlist from its largest segment
+func peakBandwidth(root, rel string, p *hls.Playlist) int {
+	peak := 0.0
+	for _, s := range p.Segments {
+		target, ok := hls.Resolve(rel, s.URI)
+		if !ok || s.Duration <= 0 {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(target)))
+		if err != nil {
+			continue
+		}
+		peak = math.Max(peak, float64(info.Size())*8/s.Duration)
+	}
+	return int(math.Ceil(peak))
+}
+
+// removeRenditions drops the renditions of a type for a language
+func removeRenditions(renditions []hls.Rendition, kind, language string) []hls.Rendition {
+	kept := renditions[:0:0]
+	for _, r := range renditions {
+		if r.Type() != kind || r.Attributes["LANGUAGE"] != language {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// detachRendition removes the rendition of a type for language from the master
+// playlist, and its files when they sit in dir/<language>/ beside the master
+// as attachSubtitle and addAudioTrack lay them out. Once the last alternate of
+// a type is gone the variants stop referring to its group
+func detachRendition(mie MediaIndexEntry, kind, dir, language string) (MediaIndexEntry, error) {
+	renditionMutex.Lock()
+	defer renditionMutex.Unlock()
+	master, masterRel, err := masterPlaylist(mie)
+	if err != nil {
+		return mie, err
+	}
+	var removed []hls.Rendition
+	var kept []hls.Rendition
+	alternates := 0
+	for _, r := range master.Renditions {
+		switch {
+		case r.Type() != kind:
+			kept = append(kept, r)
+		// The rendition without a URI is the one muxed into the variants, it cannot go
+		case r.Attributes["LANGUAGE"] == language && r.URI() != "":
+			removed = append(removed, r)
+		default:
+			if r.URI() != "" {
+				alternates++
+			}
+			kept = append(kept, r)
+		}
+	}
+	if len(removed) == 0 {
+		return mie, db.ErrNotFound
+	}
+	master.Renditions = kept
+	if alternates == 0 {
+		master.Renditions = master.Renditions[:0]
+		for _, r := range kept {
+			if r.Type() != kind {
+				master.Renditions = append(master.Renditions, r)
+			}
+		}
+		for _, v := range master.Variants {
+			delete(v.Attributes, kind)
+		}
+	} else if kind == "AUDIO" {
+		ensureDefaultRendition(master, kind)
+	}
+	if err := master.WriteFile(filepath.Join(mie.Location, filepath.FromSlash(masterRel))); err != nil {
+		return mie, err
+	}
+
+	ours := path.Join(path.Dir(masterRel), dir, language)
+	for _, r := range removed {
+		if uri, ok := hls.Resolve(masterRel, r.URI()); ok && path.Dir(uri) == ours {
+			if err := os.RemoveAll(filepath.Join(mie.Location, filepath.FromSlash(ours))); err != nil {
+				Log.Error(err.Error())
+			}
+		}
+	}
+	return withRenditions(mie, master, masterRel), nil
+}
+
+// ensureDefaultRendition marks the first rendition of a type as the default
+// when none of them is
+func ensureDefaultRendition(master *hls.Playlist, kind string) {
+	first := -1
+	for i, r := range master.Renditions {
+		if r.Type() != kind {
+			continue
+		}
+		if r.Attributes["DEFAULT"] == "YES" {
+			return
+		}
+		if first < 0 {
+			first = i
+		}
+	}
+	if first >= 0 {
+		master.Renditions[first].Attributes["DEFAULT"] = "YES"
+	}
+}
+
+// saveRenditions stores the entry point and renditions withRenditions recorded on the entry
+func saveRenditions(catalog db.MediaRepository, mie MediaIndexEntry) (MediaIndexEntry, error) {
+	entry, err := catalog.UpdateEntry(CTX, mie.MediaType, mie.ID, func(entry *db.MediaIndexEntry) error {
+		entry.Playlist = mie.Playlist
+		entry.Subtitles = mie.Subtitles
+		entry.AudioTracks = mie.AudioTracks
+		return nil
+	})
+	if err != nil {
+		return mie, err
+	}
+	return MediaIndexEntry(entry), nil
+}
+
+// withRenditions records the master playlist and the renditions it lists on the entry
+func withRenditions(mie MediaIndexEntry, master *hls.Playlist, masterRel string) MediaIndexEntry {
+	mie.Playlist = masterRel
+	mie.Subtitles = subtitleTracks(master, masterRel)
+	mie.AudioTracks = audioTracks(master, masterRel)
+	return mie
+}
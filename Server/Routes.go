@@ -1,17 +1,35 @@
 package main
 
 import (
+	"Farnsworth/Server/db"
 	"log"
 	"net/http"
 )
 
-func Route() {
+func Route(catalog db.MediaRepository) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/upload/", enableCORS(CheckToken(UploadZipHandler)))
-	mux.HandleFunc("/dir/", enableCORS(CheckToken(ListDirectoriesHandler)))
-	mux.HandleFunc("/media/", enableCORS(CheckToken(ServeMediaHandler)))
-	mux.HandleFunc("/delete/", enableCORS(CheckToken(DeleteHandler)))
+	mux.HandleFunc("/upload/", enableCORS(CheckToken(RequireRole(RoleUploader, UploadZipHandler))))
+	mux.HandleFunc("/uploads/", enableCORS(CheckToken(RequireRole(RoleUploader, UploadSessionsHandler))))
+	mux.HandleFunc("/jobs/", enableCORS(CheckToken(RequireRole(RoleUploader, JobsHandler))))
+	mux.HandleFunc("/dir/", enableCORS(CheckToken(RequireRole(RoleViewer, ListDirectoriesHandler(catalog)))))
+	mux.HandleFunc("/folders/", enableCORS(CheckToken(RequireRole(RoleViewer, FoldersHandler(catalog)))))
+	mux.HandleFunc("/artwork/", enableCORS(CheckToken(RequireRole(RoleViewer, ArtworkHandler(catalog)))))
+	mux.HandleFunc("/subtitles/", enableCORS(CheckToken(RequireRole(RoleViewer, SubtitlesHandler(catalog)))))
+	mux.HandleFunc("/audiotracks/", enableCORS(CheckToken(RequireRole(RoleViewer, AudioTracksHandler(catalog)))))
+	mux.HandleFunc("/progress/", enableCORS(CheckToken(RequireRole(RoleViewer, ProgressHandler(catalog)))))
+	mux.HandleFunc("/playlists/", enableCORS(CheckToken(RequireRole(RoleViewer, PlaylistsHandler(catalog)))))
+	mux.HandleFunc("/export/", enableCORS(CheckToken(RequireRole(RoleViewer, ExportHandler(catalog)))))
+	mux.HandleFunc("/feeds/", enableCORS(CheckToken(RequireRole(RoleViewer, FeedsHandler(catalog)))))
+	mux.HandleFunc("/shares/", enableCORS(CheckToken(RequireRole(RoleViewer, SharesHandler(catalog)))))
+	mux.HandleFunc("/media/", enableCORS(ServeMediaHandler))
+	mux.HandleFunc("/delete/", enableCORS(CheckToken(RequireRole(RoleAdmin, DeleteHandler(catalog)))))
+	mux.HandleFunc("/update/", enableCORS(CheckToken(RequireRole(RoleUploader, UpdateMetaDataHandler(catalog)))))
+	mux.HandleFunc("/scan/", enableCORS(CheckToken(RequireRole(RoleAdmin, ScanHandler(catalog)))))
+	mux.HandleFunc("/users/", enableCORS(CheckToken(RequireRole(RoleAdmin, UsersHandler))))
 	mux.HandleFunc("/login/", enableCORS(BasicAuth(HandleLogin)))
+	mux.HandleFunc("/logout/", enableCORS(CheckToken(HandleLogout)))
+	mux.HandleFunc("/stream/", enableCORS(ServeStreamHandler))
+	mux.HandleFunc("/podcast/", PodcastHandler(catalog))
 	mux.HandleFunc("/ffmpeg/", ServeFFMPEGHandler)
 	mux.HandleFunc("/", enableCORS(HandleRoot))
 
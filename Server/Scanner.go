@@ -0,0 +1,164 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanMutex keeps a scan from registering a package that has been moved into
+// ./media but not yet added to the catalog. Packages are published under the
+// read lock, scans take the write lock
+var scanMutex sync.RWMutex
+
+type scanProblem struct {
+	Location string `json:"location"`
+	Error    string `json:"error"`
+}
+
+// scanReport is what a scan changed in the catalog
+type scanReport struct {
+	// Added are directories that had no entry and were registered
+	Added []db.MediaIndexEntry `json:"added"`
+	// Missing are entries whose directory is gone, they are flagged rather than deleted
+	Missing []db.MediaIndexEntry `json:"missing"`
+	// Restored are flagged entries whose directory is back
+	Restored []db.MediaIndexEntry `json:"restored"`
+	// Skipped are directories that are not playable HLS packages
+	Skipped []scanProblem `json:"skipped"`
+}
+
+// inferTitle turns a directory name like "The_Movie.2019" into a title
+func inferTitle(name string) string {
+	title := strings.Join(strings.Fields(strings.NewReplacer("_", " ", ".", " ").Replace(name)), " ")
+	if title == "" {
+		return name
+	}
+	return title
+}
+
+// scanMedia reconciles ./media with the catalog. Directories without an entry
+// are registered under their directory name with metadata inferred from the
+// package, and entries are flagged as missing, or no longer missing, by
+// whether their directory exists
+func scanMedia(catalog db.MediaRepository) (scanReport, error) {
+	report := scanReport{Added: []db.MediaIndexEntry{}, Missing: []db.MediaIndexEntry{}, Restored: []db.MediaIndexEntry{}, Skipped: []scanProblem{}}
+	if err := ensureMediaDirectoriesExist(); err != nil {
+		return report, err
+	}
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+
+	for _, mediaType := range []string{"video", "audio"} {
+		entries, err := catalog.ListEntries(CTX, mediaType)
+		if err != nil {
+			return report, err
+		}
+		known := map[string]bool{}
+		for _, entry := range entries {
+			known[entry.ID] = true
+			_, err := os.Stat(mediaLocation(MediaIndexEntry(entry)))
+			missing := os.IsNotExist(err)
+			if missing == entry.Missing {
+				continue
+			}
+			entry, err = catalog.UpdateEntry(CTX, mediaType, entry.ID, func(entry *db.MediaIndexEntry) error {
+				entry.Missing = missing
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+			if missing {
+				report.Missing = append(report.Missing, entry)
+			} else {
+				report.Restored = append(report.Restored, entry)
+			}
+		}
+
+		dirs, err := os.ReadDir(filepath.Join("./media", mediaType))
+		if err != nil {
+			return report, err
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() || !validID(dir.Name()) || known[dir.Name()] {
+				continue
+			}
+			info, err := dir.Info()
+			if err != nil {
+				continue
+			}
+			mie := MediaIndexEntry{ID: dir.Name(), Title: inferTitle(dir.Name()), MediaType: mediaType}
+			mie.Location = mediaLocation(mie)
+			mie.Added = info.ModTime().UTC().Truncate(time.Millisecond)
+			mie.Playlist, mie.Duration, err = validateHLSPackage(mie.Location)
+			if err != nil {
+				report.Skipped = append(report.Skipped, scanProblem{Location: mie.Location, Error: err.Error()})
+				continue
+			}
+			if master, masterRel, err := masterPlaylist(mie); err == nil && masterRel == mie.Playlist {
+				mie = withRenditions(mie, master, masterRel)
+			}
+			if _, err := os.Stat(filepath.Join(mie.Location, "poster.jpg")); err == nil {
+				mie.Poster = "poster.jpg"
+			}
+			if err := catalog.AddEntry(CTX, db.MediaIndexEntry(mie)); err != nil {
+				return report, err
+			}
+			report.Added = append(report.Added, db.MediaIndexEntry(mie))
+		}
+	}
+	return report, nil
+}
+
+// logScan writes a one line summary of a scan that changed something
+func logScan(report scanReport) {
+	if len(report.Added)+len(report.Missing)+len(report.Restored)+len(report.Skipped) == 0 {
+		return
+	}
+	Log.Info(fmt.Sprintf("Media scan: %d added, %d missing, %d restored, %d skipped",
+		len(report.Added), len(report.Missing), len(report.Restored), len(report.Skipped)))
+}
+
+func scanMediaPeriodically(ctx context.Context, catalog db.MediaRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := scanMedia(catalog)
+			if err != nil {
+				Log.Error(err.Error())
+			}
+			logScan(report)
+		}
+	}
+}
+
+// ScanHandler runs a scan on POST /scan/ and answers with its report
+func ScanHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := scanMedia(catalog)
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logScan(report)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
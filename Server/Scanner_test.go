@@ -0,0 +1,100 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInferTitle(t *testing.T) {
+	tests := map[string]string{
+		"The_Movie.2019":  "The Movie 2019",
+		"plain":           "plain",
+		"a__b..c":         "a b c",
+		"___":             "___",
+		"Already Spaced ": "Already Spaced",
+	}
+	for name, want := range tests {
+		if got := inferTitle(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// writeHLSPackage puts a one segment package into dir
+func writeHLSPackage(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "output.m3u8"), []byte("#EXTM3U\n#EXTINF:4,\nsegment0.ts\n#EXT-X-ENDLIST\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "segment0.ts"), []byte("ts"), 0644)
+}
+
+func TestScanMedia(t *testing.T) {
+	catalog := setupCatalog(t,
+		db.MediaIndexEntry{ID: "known", Title: "Known", MediaType: "video"},
+		db.MediaIndexEntry{ID: "gone", Title: "Gone", MediaType: "audio"},
+	)
+	os.Remove(filepath.Join("media", "audio", "gone"))
+	writeHLSPackage(t, filepath.Join("media", "video", "The_Movie.2019"))
+	os.WriteFile(filepath.Join("media", "video", "The_Movie.2019", "poster.jpg"), []byte("jpg"), 0644)
+	os.MkdirAll(filepath.Join("media", "video", "empty"), 0755)
+	os.MkdirAll(filepath.Join("media", "video", ".hidden"), 0755)
+
+	report, err := scanMedia(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 1 || len(report.Missing) != 1 || len(report.Restored) != 0 || len(report.Skipped) != 1 {
+		t.Fatalf("got %+v", report)
+	}
+	added, err := catalog.GetEntry(CTX, "video", "The_Movie.2019")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Title != "The Movie 2019" || added.Playlist != "output.m3u8" || added.Duration != 4 || added.Poster != "poster.jpg" || added.Added.IsZero() {
+		t.Errorf("got entry %+v", added)
+	}
+	if report.Skipped[0].Location != mediaLocation(MediaIndexEntry{ID: "empty", MediaType: "video"}) {
+		t.Errorf("skipped %+v, want the empty directory", report.Skipped[0])
+	}
+	// Missing entries are flagged, not deleted
+	if gone, err := catalog.GetEntry(CTX, "audio", "gone"); err != nil || !gone.Missing {
+		t.Errorf("got %+v, %v", gone, err)
+	}
+
+	// A second scan only reports what changed since the first
+	os.MkdirAll(filepath.Join("media", "audio", "gone"), 0755)
+	report, err = scanMedia(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 0 || len(report.Missing) != 0 || len(report.Restored) != 1 || report.Restored[0].ID != "gone" {
+		t.Fatalf("got %+v", report)
+	}
+	if gone, _ := catalog.GetEntry(CTX, "audio", "gone"); gone.Missing {
+		t.Errorf("a restored entry is still flagged as missing")
+	}
+}
+
+func TestScanHandler(t *testing.T) {
+	catalog := setupCatalog(t)
+	w := httptest.NewRecorder()
+	ScanHandler(catalog)(w, httptest.NewRequest(http.MethodGet, "/scan/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	writeHLSPackage(t, filepath.Join("media", "audio", "album"))
+	w = httptest.NewRecorder()
+	ScanHandler(catalog)(w, httptest.NewRequest(http.MethodPost, "/scan/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %v", w.Code, w.Body)
+	}
+	if _, err := catalog.GetEntry(CTX, "audio", "album"); err != nil {
+		t.Errorf("the scan did not add the package: %v", err)
+	}
+}
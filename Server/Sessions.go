@@ -0,0 +1,171 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// SessionStore persists login sessions. *db.MongoClient implements it when the
+// database is connected, fileSessionStore otherwise
+type SessionStore interface {
+	AddSession(ctx context.Context, session db.Session) error
+	GetSession(ctx context.Context, id string) (db.Session, error)
+	TouchSession(ctx context.Context, id string, lastUsed time.Time) error
+	DeleteSession(ctx context.Context, id string) error
+	PruneSessions(ctx context.Context, now time.Time) error
+}
+
+var Sessions SessionStore
+var SessionTTL = 7 * 24 * time.Hour
+
+// MediaTokenTTL is how long the media URLs in generated playlist files work
+var MediaTokenTTL = 30 * 24 * time.Hour
+
+// Last-used is only written back this often so streaming segments does not hammer the store
+const sessionTouchInterval = time.Minute
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession creates a session for a user and returns the bearer token for it
+func NewSession(ctx context.Context, username string) (string, db.Session, error) {
+	token, err := randomHex(20)
+	if err != nil {
+		return "", db.Session{}, err
+	}
+	now := time.Now()
+	session := db.Session{
+		ID:       sessionID(token),
+		Username: username,
+		Created:  now,
+		LastUsed: now,
+		TTL:      SessionTTL,
+		Expires:  now.Add(SessionTTL),
+	}
+	if err := Sessions.AddSession(ctx, session); err != nil {
+		return "", db.Session{}, err
+	}
+	return token, session, nil
+}
+
+// NewMediaToken creates a session that can only fetch the files of the
+// entries in scope, for players that cannot send a bearer token. It returns
+// the token, which goes into the media URLs
+func NewMediaToken(ctx context.Context, username string, scope []string) (string, db.Session, error) {
+	// Without a scope it would be an ordinary session
+	if len(scope) == 0 {
+		return "", db.Session{}, errors.New("media token needs a scope")
+	}
+	token, err := randomHex(20)
+	if err != nil {
+		return "", db.Session{}, err
+	}
+	now := time.Now()
+	session := db.Session{
+		ID:       sessionID(token),
+		Username: username,
+		Created:  now,
+		LastUsed: now,
+		TTL:      MediaTokenTTL,
+		Expires:  now.Add(MediaTokenTTL),
+		Scope:    scope,
+	}
+	if err := Sessions.AddSession(ctx, session); err != nil {
+		return "", db.Session{}, err
+	}
+	return token, session, nil
+}
+
+// ValidateSession looks up the session for a token, dropping it if it has expired
+func ValidateSession(ctx context.Context, token string) (db.Session, bool) {
+	id := sessionID(token)
+	session, err := Sessions.GetSession(ctx, id)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			Log.Error(err.Error())
+		}
+		return session, false
+	}
+	now := time.Now()
+	if !now.Before(session.Expires) {
+		if err := Sessions.DeleteSession(ctx, id); err != nil {
+			Log.Error(err.Error())
+		}
+		return session, false
+	}
+	if now.Sub(session.LastUsed) > sessionTouchInterval {
+		session.LastUsed = now
+		if err := Sessions.TouchSession(ctx, id, now); err != nil {
+			Log.Error(err.Error())
+		}
+	}
+	return session, true
+}
+
+func RevokeSession(ctx context.Context, token string) error {
+	return Sessions.DeleteSession(ctx, sessionID(token))
+}
+
+// pruneSessionsPeriodically removes expired sessions until ctx is cancelled
+func pruneSessionsPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := Sessions.PruneSessions(ctx, now); err != nil {
+				Log.Error(err.Error())
+			}
+		}
+	}
+}
+
+type fileSessionStore struct {
+	store *jsonFileStore[db.Session]
+}
+
+func newFileSessionStore(path string) (*fileSessionStore, error) {
+	store, err := newJSONFileStore[db.Session](path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{store: store}, nil
+}
+
+func (fs *fileSessionStore) AddSession(ctx context.Context, session db.Session) error {
+	return fs.store.put(session.ID, session)
+}
+
+func (fs *fileSessionStore) GetSession(ctx context.Context, id string) (db.Session, error) {
+	session, ok := fs.store.get(id)
+	if !ok {
+		return session, db.ErrNotFound
+	}
+	return session, nil
+}
+
+func (fs *fileSessionStore) TouchSession(ctx context.Context, id string, lastUsed time.Time) error {
+	_, err := fs.store.update(id, func(session *db.Session) {
+		session.LastUsed = lastUsed
+	})
+	return err
+}
+
+func (fs *fileSessionStore) DeleteSession(ctx context.Context, id string) error {
+	return fs.store.delete(id)
+}
+
+func (fs *fileSessionStore) PruneSessions(ctx context.Context, now time.Time) error {
+	_, err := fs.store.deleteWhere(func(session db.Session) bool {
+		return !now.Before(session.Expires)
+	})
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupSessions(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(useTempDir(t), "sessions.json")
+	sessions, err := newFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sessions = sessions
+	return path
+}
+
+func TestValidateSession(t *testing.T) {
+	setupSessions(t)
+	token, session, err := NewSession(CTX, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID == token || session.ID != sessionID(token) {
+		t.Fatalf("session id %v is not the hash of the token", session.ID)
+	}
+	if _, ok := ValidateSession(CTX, token); !ok {
+		t.Fatal("new session is not valid")
+	}
+	if _, ok := ValidateSession(CTX, token+"0"); ok {
+		t.Fatal("unknown token is valid")
+	}
+
+	stale := time.Now().Add(-time.Hour)
+	if err := Sessions.TouchSession(CTX, session.ID, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateSession(CTX, token); !ok {
+		t.Fatal("session is not valid after an hour")
+	}
+	touched, err := Sessions.GetSession(CTX, session.ID)
+	if err != nil || !touched.LastUsed.After(stale) {
+		t.Fatalf("last used was not written back: %v, %v", touched.LastUsed, err)
+	}
+
+	expired := session
+	expired.Expires = time.Now().Add(-time.Second)
+	if err := Sessions.AddSession(CTX, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateSession(CTX, token); ok {
+		t.Fatal("expired session is valid")
+	}
+	if _, err := Sessions.GetSession(CTX, session.ID); err == nil {
+		t.Fatal("expired session was not removed")
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := setupSessions(t)
+	token, _, err := NewSession(CTX, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken, expired, err := NewSession(CTX, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.Expires = time.Now().Add(-time.Second)
+	if err := Sessions.AddSession(CTX, expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := Sessions.PruneSessions(CTX, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart reads the sessions back from the file
+	Sessions, err = newFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateSession(CTX, token); !ok {
+		t.Error("session was lost on a restart")
+	}
+	if _, err := Sessions.GetSession(CTX, sessionID(expiredToken)); err == nil {
+		t.Error("pruned session survived a restart")
+	}
+}
+
+func TestCheckTokenAndLogout(t *testing.T) {
+	setupSessions(t)
+	token, _, err := NewSession(CTX, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected := CheckToken(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := func(method string, handler http.HandlerFunc, header string) int {
+		r := httptest.NewRequest(method, "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"bearer token", "Bearer " + token, http.StatusNoContent},
+		{"no header", "", http.StatusUnauthorized},
+		{"unknown token", "Bearer 1234", http.StatusUnauthorized},
+		{"other scheme", "Basic " + token, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if status := request(http.MethodGet, protected, tt.header); status != tt.status {
+			t.Errorf("%v: got %d, want %d", tt.name, status, tt.status)
+		}
+	}
+
+	if status := request(http.MethodGet, HandleLogout, "Bearer "+token); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET logout: got %d", status)
+	}
+	if status := request(http.MethodPost, HandleLogout, "Bearer "+token); status != http.StatusOK {
+		t.Fatalf("logout: got %d", status)
+	}
+	if status := request(http.MethodGet, protected, "Bearer "+token); status != http.StatusUnauthorized {
+		t.Errorf("token works after logout: got %d", status)
+	}
+}
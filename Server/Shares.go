@@ -0,0 +1,530 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShareStore persists share links. *db.MongoClient implements it when the
+// database is connected, fileShareStore otherwise
+type ShareStore interface {
+	AddShare(ctx context.Context, share db.Share) error
+	GetShare(ctx context.Context, id string) (db.Share, error)
+	ListShares(ctx context.Context, owner string) ([]db.Share, error)
+	RevokeShare(ctx context.Context, id string, revoked time.Time) error
+	CountView(ctx context.Context, id string) (db.Share, error)
+	PruneShares(ctx context.Context, now time.Time) error
+}
+
+var Shares ShareStore
+
+// ShareKey signs share links. It comes from SHARE_SECRET, or is made once and
+// kept in ./data/share.key so links survive a restart
+var ShareKey []byte
+
+var DefaultShareTTL = 24 * time.Hour
+var MaxShareTTL = 30 * 24 * time.Hour
+
+// ShareViewGrace is added to the length of an entry to get how long one view
+// of a share can keep fetching the stream, to allow for pausing and seeking
+var ShareViewGrace = 30 * time.Minute
+
+type shareRequest struct {
+	MediaType string `json:"mediaType"`
+	EntryID   string `json:"entryId"`
+	// TTL is a duration such as "48h", DefaultShareTTL when empty
+	TTL      string `json:"ttl"`
+	MaxViews int    `json:"maxViews"`
+}
+
+// shareLink is a share with the URL to send. The URL can always be rebuilt
+// from the share, so unlike a feed's it is shown every time
+type shareLink struct {
+	db.Share
+	URL string `json:"url"`
+}
+
+// loadShareKey reads the signing key at path, making one if there is none
+func loadShareKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return []byte(strings.TrimSpace(string(data))), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read share key: %v", err)
+	}
+	key, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create share key directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(key), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write share key: %v", err)
+	}
+	return []byte(key), nil
+}
+
+// signShare is the HMAC of everything a link grants, so no part of it can be
+// changed without the key
+func signShare(share db.Share) string {
+	mac := hmac.New(sha256.New, ShareKey)
+	fmt.Fprintf(mac, "%v|%v|%v|%d|%d", share.ID, share.MediaType, share.EntryID, share.Expires.Unix(), share.MaxViews)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareToken is the path segment of a share link, <id>.<expires>.<signature>
+func shareToken(share db.Share) string {
+	return fmt.Sprintf("%v.%d.%v", share.ID, share.Expires.Unix(), signShare(share))
+}
+
+// signView is the HMAC of one counted view of a share
+func signView(share db.Share, view int, expires int64) string {
+	mac := hmac.New(sha256.New, ShareKey)
+	fmt.Fprintf(mac, "view|%v|%d|%d", share.ID, view, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// viewToken lets the player that made the latest counted view of share fetch
+// the rest of the stream, v<view>.<expires>.<signature>. It lasts as long as
+// the entry plus ShareViewGrace, never past the share itself
+func viewToken(share db.Share, now time.Time) string {
+	expires := now.Add(time.Duration(share.Duration*float64(time.Second)) + ShareViewGrace)
+	if expires.After(share.Expires) {
+		expires = share.Expires
+	}
+	return fmt.Sprintf("v%d.%d.%v", share.Views, expires.Unix(), signView(share, share.Views, expires.Unix()))
+}
+
+// checkViewToken makes sure token was handed out by a counted view of share
+// and has not run out. It returns the status to answer with when it does not
+func checkViewToken(share db.Share, token string) (int, error) {
+	rest, ok := strings.CutPrefix(token, "v")
+	parts := strings.Split(rest, ".")
+	if !ok || len(parts) != 3 {
+		return http.StatusNotFound, errors.New("Share link not found")
+	}
+	view, err := strconv.Atoi(parts[0])
+	if err != nil || view < 1 || view > share.Views {
+		return http.StatusNotFound, errors.New("Share link not found")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[2]), []byte(signView(share, view, expires))) {
+		return http.StatusNotFound, errors.New("Share link not found")
+	}
+	if time.Now().Unix() >= expires {
+		return http.StatusGone, errors.New("Share link view has ended, open the link again")
+	}
+	return http.StatusOK, nil
+}
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewriteSharedPlaylist points the relative URIs of the playlist at file
+// through view, so renditions, segments and subtitles can only be fetched by
+// the player that made the view
+func rewriteSharedPlaylist(data []byte, file, view string) []byte {
+	prefix := strings.Repeat("../", strings.Count(file, "/")) + view + "/"
+	if dir := path.Dir(file); dir != "." {
+		prefix += dir + "/"
+	}
+	rewrite := func(uri string) string {
+		u, err := url.Parse(uri)
+		if uri == "" || err != nil || u.IsAbs() || strings.HasPrefix(uri, "/") {
+			return uri
+		}
+		return prefix + uri
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = uriAttribute.ReplaceAllStringFunc(line, func(attribute string) string {
+				return `URI="` + rewrite(uriAttribute.FindStringSubmatch(attribute)[1]) + `"`
+			})
+		default:
+			lines[i] = rewrite(trimmed)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func newShareLink(r *http.Request, share db.Share) shareLink {
+	return shareLink{Share: share, URL: fmt.Sprintf("%v/media/share/%v/%v", publicBaseURL(r), shareToken(share), share.Playlist)}
+}
+
+// checkShareToken finds the share for a link and makes sure it still works. It
+// returns the status to answer with when it does not
+func checkShareToken(token string) (db.Share, int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return db.Share{}, http.StatusNotFound, errors.New("Share link not found")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return db.Share{}, http.StatusNotFound, errors.New("Share link not found")
+	}
+	if time.Now().Unix() >= expires {
+		return db.Share{}, http.StatusGone, errors.New("Share link has expired")
+	}
+	share, err := Shares.GetShare(CTX, parts[0])
+	if errors.Is(err, db.ErrNotFound) {
+		return share, http.StatusNotFound, errors.New("Share link not found")
+	}
+	if err != nil {
+		return share, http.StatusInternalServerError, err
+	}
+	if share.Expires.Unix() != expires || !hmac.Equal([]byte(parts[2]), []byte(signShare(share))) {
+		return share, http.StatusNotFound, errors.New("Share link not found")
+	}
+	if share.Revoked != nil {
+		return share, http.StatusGone, errors.New("Share link has been revoked")
+	}
+	// Removing the user, or taking away their role, cuts off their links too
+	user, err := Users.GetUser(CTX, share.Owner)
+	if err != nil || roleRank[user.Role] < roleRank[RoleViewer] {
+		return share, http.StatusGone, errors.New("Share link has been revoked")
+	}
+	return share, http.StatusOK, nil
+}
+
+// serveSharedMedia serves /media/share/<token>/<file>, the playlist of the
+// entry a share link is for. Fetching it counts as a view and hands out a view
+// token, the playlist comes back pointing at /media/share/<token>/<view>/...
+// and nothing else of the entry can be fetched without one. Segments are not
+// counted, so a player that got the playlist can finish the stream
+func serveSharedMedia(w http.ResponseWriter, r *http.Request, rest string) {
+	token, file, _ := strings.Cut(rest, "/")
+	file = strings.TrimPrefix(path.Clean("/"+file), "/")
+	if file == "" {
+		http.NotFound(w, r)
+		return
+	}
+	share, status, err := checkShareToken(token)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			Log.Error(err.Error())
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	entryDir := filepath.Join("./media", share.MediaType, share.EntryID)
+
+	if file != share.Playlist {
+		view, viewFile, _ := strings.Cut(file, "/")
+		if status, err := checkViewToken(share, view); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if viewFile == "" {
+			http.NotFound(w, r)
+			return
+		}
+		serveMedia(w, r, filepath.Join(entryDir, filepath.FromSlash(viewFile)))
+		return
+	}
+	if r.Method == http.MethodHead {
+		serveMedia(w, r, filepath.Join(entryDir, filepath.FromSlash(file)))
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(entryDir, filepath.FromSlash(file)))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	share, err = Shares.CountView(CTX, share.ID)
+	if errors.Is(err, db.ErrUsedUp) {
+		http.Error(w, "Share link has no views left", http.StatusGone)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(rewriteSharedPlaylist(data, file, viewToken(share, time.Now())))
+}
+
+// SharesHandler manages the signed in user's share links. Admins can open and
+// revoke anyone's
+//
+//	GET  /shares/?revoked=       the user's links, newest first, revoked=true gives the revoke list
+//	POST /shares/                {"mediaType": "video", "entryId": "id", "ttl": "48h", "maxViews": 3}
+//	GET  /shares/<id>            one link
+//	POST /shares/<id>/revoke     stop a link from working
+func SharesHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := currentUser(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/shares"), "/"), "/")
+
+		switch {
+		case parts[0] == "" && r.Method == http.MethodGet:
+			shares, err := Shares.ListShares(CTX, user.Username)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			filter := r.URL.Query().Get("revoked")
+			revoked, err := strconv.ParseBool(filter)
+			if filter != "" && err != nil {
+				http.Error(w, "Invalid revoked filter", http.StatusBadRequest)
+				return
+			}
+			links := []shareLink{}
+			for _, share := range shares {
+				if filter == "" || (share.Revoked != nil) == revoked {
+					links = append(links, newShareLink(r, share))
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(links)
+			return
+		case parts[0] == "" && r.Method == http.MethodPost:
+			createShare(w, r, catalog, user.Username)
+			return
+		}
+
+		share, err := Shares.GetShare(CTX, parts[0])
+		if err == nil && share.Owner != user.Username && user.Role != RoleAdmin {
+			err = db.ErrNotFound
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+		case len(parts) == 2 && parts[1] == "revoke" && r.Method == http.MethodPost:
+			err = Shares.RevokeShare(CTX, share.ID, time.Now().UTC().Truncate(time.Millisecond))
+			if err == nil {
+				share, err = Shares.GetShare(CTX, share.ID)
+			}
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newShareLink(r, share))
+	}
+}
+
+func createShare(w http.ResponseWriter, r *http.Request, catalog db.MediaRepository, owner string) {
+	var req shareRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid share JSON", http.StatusBadRequest)
+		return
+	}
+	if req.MediaType != "video" && req.MediaType != "audio" {
+		http.Error(w, "Invalid media type", http.StatusBadRequest)
+		return
+	}
+	if !validID(req.EntryID) {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	ttl := DefaultShareTTL
+	if req.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "ttl is not a valid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > MaxShareTTL {
+		http.Error(w, fmt.Sprintf("ttl cannot be longer than %v", MaxShareTTL), http.StatusBadRequest)
+		return
+	}
+	if req.MaxViews < 0 {
+		http.Error(w, "maxViews cannot be negative", http.StatusBadRequest)
+		return
+	}
+	entry, err := catalog.GetEntry(CTX, req.MediaType, req.EntryID)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := randomHex(12)
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	share := db.Share{
+		ID:        id,
+		Owner:     owner,
+		MediaType: entry.MediaType,
+		EntryID:   entry.ID,
+		Playlist:  entryPlaylist(entry),
+		MaxViews:  req.MaxViews,
+		Duration:  entry.Duration,
+		Created:   now,
+		Expires:   now.Add(ttl),
+	}
+	if err := Shares.AddShare(CTX, share); err != nil {
+		Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newShareLink(r, share))
+}
+
+// pruneSharesPeriodically removes expired shares until ctx is cancelled
+func pruneSharesPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := Shares.PruneShares(ctx, now); err != nil {
+				Log.Error(err.Error())
+			}
+		}
+	}
+}
+
+type fileShareStore struct {
+	store *jsonFileStore[db.Share]
+}
+
+func newFileShareStore(path string) (*fileShareStore, error) {
+	store, err := newJSONFileStore[db.Share](path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileShareStore{store: store}, nil
+}
+
+func (fs *fileShareStore) AddShare(ctx context.Context, share db.Share) error {
+	inserted, err := fs.store.insert(share.ID, share)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return db.ErrExists
+	}
+	return nil
+}
+
+func (fs *fileShareStore) GetShare(ctx context.Context, id string) (db.Share, error) {
+	share, ok := fs.store.get(id)
+	if !ok {
+		return share, db.ErrNotFound
+	}
+	return share, nil
+}
+
+func (fs *fileShareStore) ListShares(ctx context.Context, owner string) ([]db.Share, error) {
+	shares := []db.Share{}
+	for _, share := range fs.store.list() {
+		if owner == "" || share.Owner == owner {
+			shares = append(shares, share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if !shares[i].Created.Equal(shares[j].Created) {
+			return shares[i].Created.After(shares[j].Created)
+		}
+		return shares[i].ID < shares[j].ID
+	})
+	return shares, nil
+}
+
+func (fs *fileShareStore) RevokeShare(ctx context.Context, id string, revoked time.Time) error {
+	found, err := fs.store.update(id, func(share *db.Share) {
+		if share.Revoked == nil {
+			share.Revoked = &revoked
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (fs *fileShareStore) CountView(ctx context.Context, id string) (db.Share, error) {
+	var share db.Share
+	usedUp := false
+	found, err := fs.store.update(id, func(stored *db.Share) {
+		if stored.MaxViews > 0 && stored.Views >= stored.MaxViews {
+			usedUp = true
+		} else {
+			stored.Views++
+		}
+		share = *stored
+	})
+	if err != nil {
+		return share, err
+	}
+	if !found {
+		return share, db.ErrNotFound
+	}
+	if usedUp {
+		return share, db.ErrUsedUp
+	}
+	return share, nil
+}
+
+func (fs *fileShareStore) PruneShares(ctx context.Context, now time.Time) error {
+	_, err := fs.store.deleteWhere(func(share db.Share) bool {
+		return !now.Before(share.Expires)
+	})
+	return err
+}
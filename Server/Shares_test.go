@@ -0,0 +1,247 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupShares gives a test the test users, a user without a role, a file
+// share store and a fixed signing key
+func setupShares(t *testing.T) {
+	t.Helper()
+	setupUsers(t)
+	addTestUser(t, "nobody", "", "secret")
+	ShareKey = []byte("test key")
+	shares, err := newFileShareStore(filepath.Join(t.TempDir(), "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Shares = shares
+}
+
+func addTestShare(t *testing.T, share db.Share) db.Share {
+	t.Helper()
+	now := time.Now().UTC().Truncate(time.Second)
+	share.MediaType, share.EntryID, share.Playlist = "video", "entry", "master.m3u8"
+	share.Created = now
+	if share.Owner == "" {
+		share.Owner = RoleViewer
+	}
+	if share.Expires.IsZero() {
+		share.Expires = now.Add(time.Hour)
+	}
+	if err := Shares.AddShare(CTX, share); err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+func TestCheckShareToken(t *testing.T) {
+	setupShares(t)
+	valid := addTestShare(t, db.Share{ID: "valid"})
+	revoked := addTestShare(t, db.Share{ID: "revoked"})
+	if err := Shares.RevokeShare(CTX, revoked.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	orphaned := addTestShare(t, db.Share{ID: "orphaned", Owner: "removed"})
+	demoted := addTestShare(t, db.Share{ID: "demoted", Owner: "nobody"})
+	expired := addTestShare(t, db.Share{ID: "expired", Expires: time.Now().Add(-time.Minute).Truncate(time.Second)})
+	validToken := shareToken(valid)
+	id, rest, _ := strings.Cut(validToken, ".")
+	exp, sig, _ := strings.Cut(rest, ".")
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", validToken, http.StatusOK},
+		{"malformed", "valid", http.StatusNotFound},
+		{"bad expiry", id + ".soon." + sig, http.StatusNotFound},
+		{"changed expiry", fmt.Sprintf("%v.%d.%v", id, valid.Expires.Add(time.Hour).Unix(), sig), http.StatusNotFound},
+		{"bad signature", id + "." + exp + ".AAAA", http.StatusNotFound},
+		{"signed for another share", "revoked." + exp + "." + sig, http.StatusNotFound},
+		{"unknown", "unknown." + exp + "." + sig, http.StatusNotFound},
+		{"expired", shareToken(expired), http.StatusGone},
+		{"revoked", shareToken(revoked), http.StatusGone},
+		{"owner removed", shareToken(orphaned), http.StatusGone},
+		{"owner lost their role", shareToken(demoted), http.StatusGone},
+	}
+	for _, tt := range tests {
+		share, status, err := checkShareToken(tt.token)
+		if status != tt.status {
+			t.Errorf("%v: got status %d (%v), want %d", tt.name, status, err, tt.status)
+		}
+		if status == http.StatusOK && (err != nil || share.ID != valid.ID) {
+			t.Errorf("%v: got share %q, %v", tt.name, share.ID, err)
+		}
+	}
+}
+
+func TestCheckViewToken(t *testing.T) {
+	setupShares(t)
+	share := addTestShare(t, db.Share{ID: "share", Views: 2, Duration: 60})
+	now := time.Now()
+	token := viewToken(share, now)
+	ended := share
+	ended.Duration = -ShareViewGrace.Seconds() - 60
+
+	tests := []struct {
+		name   string
+		share  db.Share
+		token  string
+		status int
+	}{
+		{"valid", share, token, http.StatusOK},
+		{"counted view not recorded", db.Share{ID: "share", Views: 1, Expires: share.Expires}, token, http.StatusNotFound},
+		{"another share", db.Share{ID: "other", Views: 2, Expires: share.Expires}, token, http.StatusNotFound},
+		{"missing prefix", share, strings.TrimPrefix(token, "v"), http.StatusNotFound},
+		{"changed view", share, "v1" + strings.TrimPrefix(token, "v2"), http.StatusNotFound},
+		{"share token", share, shareToken(share), http.StatusNotFound},
+		{"ended", share, viewToken(ended, now), http.StatusGone},
+	}
+	for _, tt := range tests {
+		status, err := checkViewToken(tt.share, tt.token)
+		if status != tt.status {
+			t.Errorf("%v: got status %d (%v), want %d", tt.name, status, err, tt.status)
+		}
+	}
+
+	capped := viewToken(db.Share{ID: "share", Views: 1, Duration: 86400, Expires: share.Expires}, now)
+	if !strings.Contains(capped, fmt.Sprintf(".%d.", share.Expires.Unix())) {
+		t.Errorf("view token %v outlives its share", capped)
+	}
+}
+
+func TestServeSharedMediaViewLimit(t *testing.T) {
+	setupShares(t)
+	share := addTestShare(t, db.Share{ID: "share", MaxViews: 1, Duration: 60})
+	dir := filepath.Join("media", "video", "entry")
+	os.MkdirAll(filepath.Join(dir, "360p"), 0755)
+	os.WriteFile(filepath.Join(dir, "master.m3u8"), []byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",URI=\"subs/en/index.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1\n360p/index.m3u8\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "360p", "index.m3u8"), []byte("#EXTM3U\n"), 0644)
+	token := shareToken(share)
+
+	get := func(file string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serveSharedMedia(w, httptest.NewRequest(http.MethodGet, "/media/share/"+token+"/"+file, nil), token+"/"+file)
+		return w
+	}
+
+	if w := get("360p/index.m3u8"); w.Code != http.StatusNotFound {
+		t.Fatalf("segment playlist without a view: got %d", w.Code)
+	}
+	w := get("master.m3u8")
+	if w.Code != http.StatusOK {
+		t.Fatalf("first view: got %d %v", w.Code, w.Body)
+	}
+	lines := strings.Split(w.Body.String(), "\n")
+	view, _, _ := strings.Cut(lines[3], "/")
+	if !strings.HasPrefix(view, "v1.") || lines[3] != view+"/360p/index.m3u8" {
+		t.Fatalf("variant was not rewritten: %q", lines[3])
+	}
+	if !strings.Contains(lines[1], `URI="`+view+`/subs/en/index.m3u8"`) {
+		t.Fatalf("rendition was not rewritten: %q", lines[1])
+	}
+	if w := get(view + "/360p/index.m3u8"); w.Code != http.StatusOK {
+		t.Fatalf("segment playlist with the view: got %d", w.Code)
+	}
+	if w := get("master.m3u8"); w.Code != http.StatusGone {
+		t.Fatalf("second view: got %d", w.Code)
+	}
+}
+
+func TestRewriteSharedPlaylist(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		in   string
+		want string
+	}{
+		{"top level", "master.m3u8", "#EXTM3U\nv/index.m3u8\n", "#EXTM3U\nV/v/index.m3u8\n"},
+		{"nested", "hls/master.m3u8", "#EXTM3U\nv/index.m3u8\n", "#EXTM3U\n../V/hls/v/index.m3u8\n"},
+		{"attribute", "master.m3u8", `#EXT-X-MAP:URI="init.mp4"`, `#EXT-X-MAP:URI="V/init.mp4"`},
+		{"absolute left alone", "master.m3u8", "https://cdn.example/v.m3u8\n/root.m3u8", "https://cdn.example/v.m3u8\n/root.m3u8"},
+	}
+	for _, tt := range tests {
+		got := string(rewriteSharedPlaylist([]byte(tt.in), tt.file, "V"))
+		if got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func callShares(t *testing.T, catalog db.MediaRepository, user, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	return serveAs(t, user, RequireRole(RoleViewer, SharesHandler(catalog)), r)
+}
+
+func TestSharesHandler(t *testing.T) {
+	setupShares(t)
+	catalog := setupCatalog(t, db.MediaIndexEntry{ID: "a1", Title: "Show", MediaType: "video"})
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"bad media type", `{"mediaType": "image", "entryId": "a1"}`, http.StatusBadRequest},
+		{"bad id", `{"mediaType": "video", "entryId": ".."}`, http.StatusBadRequest},
+		{"bad ttl", `{"mediaType": "video", "entryId": "a1", "ttl": "soon"}`, http.StatusBadRequest},
+		{"negative ttl", `{"mediaType": "video", "entryId": "a1", "ttl": "-1h"}`, http.StatusBadRequest},
+		{"ttl too long", `{"mediaType": "video", "entryId": "a1", "ttl": "10000h"}`, http.StatusBadRequest},
+		{"negative views", `{"mediaType": "video", "entryId": "a1", "maxViews": -1}`, http.StatusBadRequest},
+		{"unknown entry", `{"mediaType": "video", "entryId": "z9"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := callShares(t, catalog, RoleViewer, http.MethodPost, "/shares/", tt.body); w.Code != tt.code {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+
+	w := callShares(t, catalog, RoleViewer, http.MethodPost, "/shares/", `{"mediaType": "video", "entryId": "a1", "ttl": "2h", "maxViews": 3}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %v", w.Code, w.Body)
+	}
+	var link shareLink
+	json.NewDecoder(w.Body).Decode(&link)
+	if link.Owner != RoleViewer || link.MaxViews != 3 || link.Playlist != "output.m3u8" || link.Expires.Sub(link.Created) != 2*time.Hour ||
+		link.URL != "http://example.com/media/share/"+shareToken(link.Share)+"/output.m3u8" {
+		t.Fatalf("got %+v", link)
+	}
+
+	if w := callShares(t, catalog, "other", http.MethodGet, "/shares/"+link.ID, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown user: got %d", w.Code)
+	}
+	if w := callShares(t, catalog, RoleUploader, http.MethodGet, "/shares/"+link.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another user: got %d", w.Code)
+	}
+	if w := callShares(t, catalog, RoleAdmin, http.MethodPost, "/shares/"+link.ID+"/revoke", ""); w.Code != http.StatusOK {
+		t.Errorf("admin revoke: got %d %v", w.Code, w.Body)
+	}
+	if _, status, _ := checkShareToken(shareToken(link.Share)); status != http.StatusGone {
+		t.Errorf("a revoked link: got %d", status)
+	}
+
+	var links []shareLink
+	json.NewDecoder(callShares(t, catalog, RoleViewer, http.MethodGet, "/shares/?revoked=true", "").Body).Decode(&links)
+	if len(links) != 1 || links[0].Revoked == nil {
+		t.Errorf("revoked: got %+v", links)
+	}
+	json.NewDecoder(callShares(t, catalog, RoleViewer, http.MethodGet, "/shares/?revoked=false", "").Body).Decode(&links)
+	if len(links) != 0 {
+		t.Errorf("not revoked: got %+v", links)
+	}
+	if w := callShares(t, catalog, RoleViewer, http.MethodGet, "/shares/?revoked=maybe", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad filter: got %d", w.Code)
+	}
+}
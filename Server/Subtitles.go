@@ -0,0 +1,341 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"Farnsworth/Server/hls"
+	"Farnsworth/Server/subtitle"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Subtitle files converted when they are uploaded or found in a package
+var subtitleExtensions = map[string]bool{".srt": true, ".ass": true, ".ssa": true, ".vtt": true}
+
+const (
+	subtitleGroup          = "subs"
+	subtitleSegmentSeconds = 60
+	MaxSubtitleBytes       = 10 << 20
+)
+
+// Language tags such as en, pt-BR or zh-Hant
+var languagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Language tags at the end of a file name, as in movie.en.srt or movie.pt-BR.forced.ass
+var fileLanguagePattern = regexp.MustCompile(`\.([A-Za-z]{2,3}(?:-[A-Za-z0-9]{2,8})?)(\.forced)?$`)
+
+// timestampMap returns the X-TIMESTAMP-MAP header lining subtitle segments up
+// with the first media segment, or nothing if the segments are not MPEG-TS
+func timestampMap(mie MediaIndexEntry, master *hls.Playlist, masterRel string) []string {
+	for _, v := range master.Variants {
+		rel, ok := hls.Resolve(masterRel, v.URI)
+		if !ok {
+			continue
+		}
+		media, err := hls.ParseFile(filepath.Join(mie.Location, filepath.FromSlash(rel)))
+		if err != nil || len(media.Segments) == 0 {
+			continue
+		}
+		segment, ok := hls.Resolve(rel, media.Segments[0].URI)
+		if !ok {
+			continue
+		}
+		pts, err := hls.FirstPTS(filepath.Join(mie.Location, filepath.FromSlash(segment)))
+		if err != nil {
+			return nil
+		}
+		return []string{fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000", pts)}
+	}
+	return nil
+}
+
+// subtitleTracks lists the subtitle renditions of a master playlist
+func subtitleTracks(master *hls.Playlist, masterRel string) []db.SubtitleTrack {
+	var tracks []db.SubtitleTrack
+	for _, r := range master.Renditions {
+		if r.Type() != "SUBTITLES" {
+			continue
+		}
+		uri, ok := hls.Resolve(masterRel, r.URI())
+		if !ok {
+			continue
+		}
+		tracks = append(tracks, db.SubtitleTrack{
+			Language: r.Attributes["LANGUAGE"],
+			Name:     r.Attributes["NAME"],
+			URI:      uri,
+			Forced:   r.Attributes["FORCED"] == "YES",
+		})
+	}
+	return tracks
+}
+
+// attachSubtitle converts a subtitle file to a segmented WebVTT rendition at
+// subs/<language>/ beside the master playlist and adds it to the master,
+// replacing any rendition already there for the same language
+func attachSubtitle(mie MediaIndexEntry, name string, data []byte, track db.SubtitleTrack) (MediaIndexEntry, error) {
+	cues, err := subtitle.Parse(name, data)
+	if err != nil {
+		return mie, err
+	}
+	if track.Name == "" {
+		track.Name = track.Language
+	}
+
+	renditionMutex.Lock()
+	defer renditionMutex.Unlock()
+	master, masterRel, err := masterPlaylist(mie)
+	if err != nil {
+		return mie, err
+	}
+	// Cues are in start order, so a long cue can end after the last one starts
+	duration := mie.Duration
+	for _, cue := range cues {
+		duration = math.Max(duration, cue.End)
+	}
+
+	// Build the rendition beside its final place and swap it in once complete
+	rel := path.Join(path.Dir(masterRel), subtitleGroup, track.Language)
+	dir := filepath.Join(mie.Location, filepath.FromSlash(rel))
+	workDir := dir + ".tmp"
+	os.RemoveAll(workDir)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return mie, err
+	}
+	defer os.RemoveAll(workDir)
+	header := timestampMap(mie, master, masterRel)
+	playlist := &hls.Playlist{Version: 3, TargetDuration: subtitleSegmentSeconds}
+	for i, segment := range subtitle.Segment(cues, duration, subtitleSegmentSeconds) {
+		var b bytes.Buffer
+		if err := subtitle.WriteVTT(&b, segment, header...); err != nil {
+			return mie, err
+		}
+		segmentName := fmt.Sprintf("segment%d.vtt", i)
+		if err := os.WriteFile(filepath.Join(workDir, segmentName), b.Bytes(), 0644); err != nil {
+			return mie, err
+		}
+		playlist.Segments = append(playlist.Segments, hls.Segment{
+			URI:      segmentName,
+			Duration: math.Min(subtitleSegmentSeconds, duration-float64(i)*subtitleSegmentSeconds),
+		})
+	}
+	if err := playlist.WriteFile(filepath.Join(workDir, "index.m3u8")); err != nil {
+		return mie, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return mie, err
+	}
+	if err := os.Rename(workDir, dir); err != nil {
+		return mie, err
+	}
+
+	attributes := map[string]string{
+		"TYPE":       "SUBTITLES",
+		"GROUP-ID":   subtitleGroup,
+		"LANGUAGE":   track.Language,
+		"NAME":       track.Name,
+		"DEFAULT":    "NO",
+		"AUTOSELECT": "YES",
+		"URI":        path.Join(subtitleGroup, track.Language, "index.m3u8"),
+	}
+	if track.Forced {
+		attributes["FORCED"] = "YES"
+	}
+	master.Renditions = append(removeRenditions(master.Renditions, "SUBTITLES", track.Language), hls.Rendition{Attributes: attributes})
+	for _, v := range master.Variants {
+		v.Attributes["SUBTITLES"] = subtitleGroup
+	}
+	if err := master.WriteFile(filepath.Join(mie.Location, filepath.FromSlash(masterRel))); err != nil {
+		return mie, err
+	}
+	return withRenditions(mie, master, masterRel), nil
+}
+
+// attachPackagedSubtitles converts the subtitle files shipped inside an
+// uploaded package. A file that cannot be read is logged and left alone, it is
+// not worth rejecting the whole upload over
+func attachPackagedSubtitles(mie MediaIndexEntry) MediaIndexEntry {
+	var files []string
+	filepath.WalkDir(mie.Location, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		// WebVTT files next to playlists are usually segments of an existing rendition
+		if !d.IsDir() && subtitleExtensions[ext] && ext != ".vtt" {
+			files = append(files, p)
+		}
+		return nil
+	})
+	untagged := 0
+	for _, file := range files {
+		track := db.SubtitleTrack{Language: "und"}
+		base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if m := fileLanguagePattern.FindStringSubmatch(base); m != nil {
+			track.Language = m[1]
+			track.Forced = m[2] != ""
+		} else {
+			// Renditions are kept per language, so untagged files would replace
+			// each other. Each gets its own, named after the file
+			untagged++
+			if untagged > 1 {
+				track.Language = fmt.Sprintf("und-%02d", untagged)
+			}
+			track.Name = base
+		}
+		data, err := os.ReadFile(file)
+		if err == nil {
+			var attached MediaIndexEntry
+			attached, err = attachSubtitle(mie, file, data, track)
+			if err == nil {
+				mie = attached
+			}
+		}
+		if err != nil {
+			Log.Error(fmt.Sprintf("Skipping subtitle %v of %v: %v", filepath.Base(file), mie.Title, err))
+		}
+	}
+	return mie
+}
+
+// SubtitlesHandler manages the subtitle renditions of an entry. Viewers can list
+// them, changing them needs the uploader role
+//
+//	GET    /subtitles/<type>/<id>                   list the tracks
+//	POST   /subtitles/<type>/<id>/<lang>            multipart "file" upload, or ?source=<file in the package>
+//	DELETE /subtitles/<type>/<id>/<lang>
+//
+// POST also takes ?name= for the label players show and ?forced=true
+func SubtitlesHandler(catalog db.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/subtitles/"), "/"), "/")
+		if len(parts) < 2 || len(parts) > 3 || (parts[0] != "video" && parts[0] != "audio") || !validID(parts[1]) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		language := ""
+		if len(parts) == 3 {
+			language = parts[2]
+			if !languagePattern.MatchString(language) {
+				http.Error(w, "Invalid language tag", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method != http.MethodGet {
+			user, _ := currentUser(r)
+			if roleRank[user.Role] < roleRank[RoleUploader] {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		mie, err := lookupEntry(catalog, parts[0], parts[1])
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && language == "":
+			master, masterRel, err := masterPlaylist(mie)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Unable to read the playlist", http.StatusInternalServerError)
+				return
+			}
+			tracks := subtitleTracks(master, masterRel)
+			if tracks == nil {
+				tracks = []db.SubtitleTrack{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tracks)
+			return
+		case r.Method == http.MethodPost && language != "":
+			name, data, err := subtitleUpload(w, r, mie)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			forced, _ := strconv.ParseBool(r.URL.Query().Get("forced"))
+			track := db.SubtitleTrack{Language: language, Name: r.URL.Query().Get("name"), Forced: forced}
+			mie, err = attachSubtitle(mie, name, data, track)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, fmt.Sprintf("Unable to attach subtitles: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+		case r.Method == http.MethodDelete && language != "":
+			mie, err = detachRendition(mie, "SUBTITLES", subtitleGroup, language)
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "No subtitles for that language", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Unable to remove subtitles", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mie, err = saveRenditions(catalog, mie)
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, "Unable to update the entry", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mie)
+	}
+}
+
+// subtitleUpload reads the subtitle file of a POST, either from the request
+// body or from a file already inside the entry's package
+func subtitleUpload(w http.ResponseWriter, r *http.Request, mie MediaIndexEntry) (string, []byte, error) {
+	if source := r.URL.Query().Get("source"); source != "" {
+		file, ok := safeJoin(mie.Location, filepath.FromSlash(source))
+		if !ok || !subtitleExtensions[strings.ToLower(filepath.Ext(file))] {
+			return "", nil, fmt.Errorf("invalid source %q", source)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to read %q", source)
+		}
+		return file, data, nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxSubtitleBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", nil, fmt.Errorf("missing subtitle file")
+	}
+	defer file.Close()
+	if !subtitleExtensions[strings.ToLower(filepath.Ext(header.Filename))] {
+		return "", nil, fmt.Errorf("subtitles must be .srt, .ass, .ssa or .vtt")
+	}
+	data, err := io.ReadAll(io.LimitReader(file, MaxSubtitleBytes+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(data) > MaxSubtitleBytes {
+		return "", nil, fmt.Errorf("subtitle file is too large")
+	}
+	return header.Filename, data, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"Farnsworth/Server/hls"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttachSubtitleDuration(t *testing.T) {
+	useTempDir(t)
+	dir := filepath.Join("media", "video", "a1")
+	writeHLSPackage(t, dir)
+	mie := MediaIndexEntry{ID: "a1", MediaType: "video", Location: dir, Playlist: "output.m3u8", Duration: 4}
+	// The first cue runs past the start and the end of the last one
+	srt := "1\n00:00:01,000 --> 00:02:30,000\nLong\n\n2\n00:00:02,000 --> 00:00:03,000\nShort\n"
+	if _, err := attachSubtitle(mie, "movie.en.srt", []byte(srt), db.SubtitleTrack{Language: "en"}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := hls.ParseFile(filepath.Join(dir, subtitleGroup, "en", "index.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Segments) != 3 || p.Duration() != 150 {
+		t.Errorf("got %d segments lasting %v, want 3 lasting 150", len(p.Segments), p.Duration())
+	}
+}
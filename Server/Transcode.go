@@ -0,0 +1,380 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"Farnsworth/Server/hls"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FFmpegPath and FFprobePath are the binaries used for transcoding,
+// overridable with FFMPEG_PATH and FFPROBE_PATH
+var FFmpegPath = "ffmpeg"
+var FFprobePath = "ffprobe"
+
+// Source formats accepted for server side transcoding
+var transcodeExtensions = map[string]bool{
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".webm": true, ".avi": true,
+	".mp3": true, ".flac": true, ".wav": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true,
+}
+
+const hlsSegmentSeconds = 6
+
+// Rung is one video rendition of the adaptive bitrate ladder
+type Rung struct {
+	Height       int
+	VideoBitrate int
+}
+
+// TranscodeLadder is the set of video renditions produced for each upload,
+// overridable with TRANSCODE_LADDER, e.g. "1080:5000k,720:2800k,480:1400k"
+var TranscodeLadder = []Rung{
+	{Height: 1080, VideoBitrate: 5000000},
+	{Height: 720, VideoBitrate: 2800000},
+	{Height: 480, VideoBitrate: 1400000},
+}
+
+// AudioBitrate is used for the audio of every rendition, overridable with TRANSCODE_AUDIO_BITRATE
+var AudioBitrate = 128000
+
+// ParseLadder parses a TRANSCODE_LADDER value into rungs, highest first
+func ParseLadder(value string) ([]Rung, error) {
+	var ladder []Rung
+	for _, part := range strings.Split(value, ",") {
+		heightText, bitrateText, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			return nil, fmt.Errorf("rung %q is not height:bitrate", part)
+		}
+		height, err := strconv.Atoi(strings.TrimSuffix(heightText, "p"))
+		if err != nil || height <= 0 || height%2 != 0 {
+			return nil, fmt.Errorf("rung %q has an invalid height", part)
+		}
+		bitrate, err := ParseBitrate(bitrateText)
+		if err != nil {
+			return nil, fmt.Errorf("rung %q: %v", part, err)
+		}
+		ladder = append(ladder, Rung{Height: height, VideoBitrate: bitrate})
+	}
+	sort.Slice(ladder, func(i, j int) bool { return ladder[i].Height > ladder[j].Height })
+	return ladder, nil
+}
+
+// ParseBitrate accepts plain bits per second or a k/M suffix
+func ParseBitrate(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier, value = 1000, value[:len(value)-1]
+	case strings.HasSuffix(value, "M"), strings.HasSuffix(value, "m"):
+		multiplier, value = 1000000, value[:len(value)-1]
+	}
+	bitrate, err := strconv.Atoi(value)
+	if err != nil || bitrate <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", value)
+	}
+	return bitrate * multiplier, nil
+}
+
+// h264Level picks the H.264 level advertised in CODECS for a rendition height
+func h264Level(height int) (string, string) {
+	switch {
+	case height > 1080:
+		return "5.1", "33"
+	case height > 720:
+		return "4.0", "28"
+	case height > 480:
+		return "3.1", "1f"
+	default:
+		return "3.0", "1e"
+	}
+}
+
+// MediaProbe is what transcoding needs to know about a source file
+type MediaProbe struct {
+	Width    int
+	Height   int
+	HasVideo bool
+	HasAudio bool
+	// AudioCodec is the codec of the first audio stream, such as "aac"
+	AudioCodec string
+	Duration   float64
+}
+
+func probeMedia(ctx context.Context, source string) (MediaProbe, error) {
+	var probe MediaProbe
+	cmd := exec.CommandContext(ctx, FFprobePath, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", source)
+	output, err := cmd.Output()
+	if err != nil {
+		return probe, fmt.Errorf("ffprobe failed: %v", err)
+	}
+	var result struct {
+		Streams []struct {
+			CodecType   string            `json:"codec_type"`
+			CodecName   string            `json:"codec_name"`
+			Width       int               `json:"width"`
+			Height      int               `json:"height"`
+			Disposition map[string]int    `json:"disposition"`
+			Tags        map[string]string `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return probe, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+	for _, stream := range result.Streams {
+		switch stream.CodecType {
+		case "video":
+			// Cover art in audio files shows up as a one frame video stream
+			if stream.Disposition["attached_pic"] == 1 || probe.HasVideo {
+				continue
+			}
+			probe.HasVideo = true
+			probe.Width, probe.Height = stream.Width, stream.Height
+		case "audio":
+			if !probe.HasAudio {
+				probe.AudioCodec = stream.CodecName
+			}
+			probe.HasAudio = true
+		}
+	}
+	probe.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	return probe, nil
+}
+
+// ladderFor drops the rungs taller than the source. A source smaller than every
+// rung gets a single rendition at its own height
+func ladderFor(probe MediaProbe) []Rung {
+	var rungs []Rung
+	for _, rung := range TranscodeLadder {
+		if rung.Height <= probe.Height {
+			rungs = append(rungs, rung)
+		}
+	}
+	if len(rungs) == 0 && len(TranscodeLadder) > 0 {
+		lowest := TranscodeLadder[len(TranscodeLadder)-1]
+		rungs = append(rungs, Rung{Height: probe.Height - probe.Height%2, VideoBitrate: lowest.VideoBitrate})
+	}
+	return rungs
+}
+
+func rungName(rung Rung) string {
+	return fmt.Sprintf("%dp", rung.Height)
+}
+
+// ffmpegLadderArgs builds one ffmpeg run producing every rung, plus an audio
+// only rendition when the source has sound, each in its own directory under out
+func ffmpegLadderArgs(source, out string, rungs []Rung, hasAudio bool) []string {
+	args := []string{"-hide_banner", "-nostdin", "-y", "-i", source}
+	for range rungs {
+		args = append(args, "-map", "0:v:0")
+		if hasAudio {
+			args = append(args, "-map", "0:a:0")
+		}
+	}
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+	}
+
+	args = append(args,
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "high", "-pix_fmt", "yuv420p",
+		// Keyframes on segment boundaries so players can switch renditions between any two segments
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+		"-sc_threshold", "0",
+	)
+	var streamMap []string
+	for i, rung := range rungs {
+		level, _ := h264Level(rung.Height)
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), fmt.Sprintf("scale=-2:%d", rung.Height),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprint(rung.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprint(rung.VideoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprint(rung.VideoBitrate*3/2),
+			fmt.Sprintf("-level:v:%d", i), level,
+		)
+		if hasAudio {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%v", i, i, rungName(rung)))
+		} else {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%v", i, rungName(rung)))
+		}
+	}
+	if hasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprint(AudioBitrate), "-ac", "2")
+		streamMap = append(streamMap, fmt.Sprintf("a:%d,name:audio", len(rungs)))
+	}
+
+	return append(args,
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(out, "%v", "segment%d.ts"),
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(out, "%v", "index.m3u8"),
+	)
+}
+
+// ladderMaster describes the renditions ffmpegLadderArgs produced
+func ladderMaster(probe MediaProbe, rungs []Rung) *hls.Playlist {
+	// Every rung is cut on the same forced key frames
+	master := &hls.Playlist{Master: true, Version: 3, IndependentSegments: true}
+	for _, rung := range rungs {
+		_, levelHex := h264Level(rung.Height)
+		width := rung.Height * probe.Width / probe.Height
+		width -= width % 2
+		bandwidth := rung.VideoBitrate * 107 / 100
+		codecs := "avc1.6400" + levelHex
+		if probe.HasAudio {
+			bandwidth += AudioBitrate
+			codecs += ",mp4a.40.2"
+		}
+		master.Variants = append(master.Variants, hls.Variant{
+			URI: rungName(rung) + "/index.m3u8",
+			Attributes: map[string]string{
+				"BANDWIDTH":  fmt.Sprint(bandwidth),
+				"RESOLUTION": fmt.Sprintf("%dx%d", width, rung.Height),
+				"CODECS":     codecs,
+			},
+		})
+	}
+	if probe.HasAudio {
+		master.Variants = append(master.Variants, hls.Variant{
+			URI: "audio/index.m3u8",
+			Attributes: map[string]string{
+				"BANDWIDTH": fmt.Sprint(AudioBitrate * 11 / 10),
+				"CODECS":    "mp4a.40.2",
+			},
+		})
+	}
+	return master
+}
+
+// ffmpegHLSArgs builds the ffmpeg command line that turns an audio source into
+// a single rendition HLS stream at out/output.m3u8
+func ffmpegHLSArgs(source, out string) []string {
+	return []string{"-hide_banner", "-nostdin", "-y", "-i", source,
+		"-map", "0:a:0", "-vn", "-c:a", "aac", "-b:a", "192k",
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(out, "output%d.ts"),
+		filepath.Join(out, "output.m3u8"),
+	}
+}
+
+// runFFmpeg runs ffmpeg until it exits or ctx is cancelled, and folds the tail of
+// its output into the error when it fails. When the duration of the source is
+// known progress is called with the percentage done
+func runFFmpeg(ctx context.Context, args []string, duration float64, progress func(float64)) error {
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("ffmpeg failed to start: %v", err)
+	}
+
+	// -progress writes key=value lines, out_time_us is how far into the source ffmpeg is
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if (key != "out_time_us" && key != "out_time_ms") || duration <= 0 || progress == nil {
+			continue
+		}
+		outTime, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		progress(math.Min(outTime/1e6/duration*100, 99))
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		output := strings.TrimSpace(stderr.String())
+		if len(output) > 2000 {
+			output = output[len(output)-2000:]
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %v", err, output)
+	}
+	return nil
+}
+
+// transcodeVideo produces the bitrate ladder and master.m3u8 in workDir
+func transcodeVideo(ctx context.Context, source, workDir string, probe MediaProbe, progress func(float64)) error {
+	if !probe.HasVideo || probe.Height <= 0 {
+		return fmt.Errorf("source has no video stream")
+	}
+	rungs := ladderFor(probe)
+	for _, rung := range rungs {
+		if err := os.MkdirAll(filepath.Join(workDir, rungName(rung)), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if probe.HasAudio {
+		if err := os.MkdirAll(filepath.Join(workDir, "audio"), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if err := runFFmpeg(ctx, ffmpegLadderArgs(source, workDir, rungs, probe.HasAudio), probe.Duration, progress); err != nil {
+		return err
+	}
+	return ladderMaster(probe, rungs).WriteFile(filepath.Join(workDir, "master.m3u8"))
+}
+
+// transcode is the JobTranscode runner. It turns the job's source file into an
+// HLS package under ./media/<type>/<id> and adds it to the catalog
+func transcode(ctx context.Context, catalog db.MediaRepository, job db.Job, progress func(float64)) (MediaIndexEntry, error) {
+	mie := MediaIndexEntry(job.Metadata)
+	if err := ensureMediaDirectoriesExist(); err != nil {
+		return mie, err
+	}
+	if mie.ID == "" {
+		mie.ID = db.NewEntryID()
+	}
+	mie.Location = mediaLocation(mie)
+	if _, err := os.Stat(mie.Location); err == nil {
+		return mie, ErrEntryExists
+	}
+
+	// Work in a hidden directory beside the final one so the rename stays on the same volume
+	workDir := filepath.Join("./media", mie.MediaType, ".transcode-"+job.ID)
+	os.RemoveAll(workDir)
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		return mie, err
+	}
+	defer os.RemoveAll(workDir)
+
+	probe, err := probeMedia(ctx, job.Source)
+	if err != nil {
+		return mie, err
+	}
+	if mie.MediaType == "video" {
+		err = transcodeVideo(ctx, job.Source, workDir, probe, progress)
+	} else if !probe.HasAudio {
+		err = fmt.Errorf("source has no audio stream")
+	} else {
+		err = runFFmpeg(ctx, ffmpegHLSArgs(job.Source, workDir), probe.Duration, progress)
+	}
+	if err != nil {
+		return mie, err
+	}
+
+	return registerPackage(catalog, workDir, mie)
+}
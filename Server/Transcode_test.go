@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseLadder(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []Rung
+		err   bool
+	}{
+		{value: "720:2800k,1080p:5M, 480:1400000", want: []Rung{{1080, 5000000}, {720, 2800000}, {480, 1400000}}},
+		{value: "360:800K", want: []Rung{{360, 800000}}},
+		{value: "720", err: true},
+		{value: "721:1M", err: true},
+		{value: "-720:1M", err: true},
+		{value: "720:fast", err: true},
+		{value: "720:0", err: true},
+		{value: "720:1M,", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLadder(tt.value)
+		if tt.err != (err != nil) || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseLadder(%q): got %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestLadderFor(t *testing.T) {
+	tests := []struct {
+		height int
+		want   []Rung
+	}{
+		{2160, TranscodeLadder},
+		{1080, TranscodeLadder},
+		{720, TranscodeLadder[1:]},
+		{481, TranscodeLadder[2:]},
+		{361, []Rung{{360, TranscodeLadder[2].VideoBitrate}}},
+	}
+	for _, tt := range tests {
+		if got := ladderFor(MediaProbe{Width: tt.height * 16 / 9, Height: tt.height}); !slices.Equal(got, tt.want) {
+			t.Errorf("%dp source: got %v, want %v", tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestLadderMaster(t *testing.T) {
+	probe := MediaProbe{Width: 1920, Height: 800, HasVideo: true, HasAudio: true}
+	var b strings.Builder
+	if err := ladderMaster(probe, []Rung{{720, 2800000}, {480, 1400000}}).WriteMaster(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3124000,RESOLUTION=1728x720,CODECS=\"avc1.64001f,mp4a.40.2\"\n720p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1626000,RESOLUTION=1152x480,CODECS=\"avc1.64001e,mp4a.40.2\"\n480p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=140800,CODECS=\"mp4a.40.2\"\naudio/index.m3u8\n"
+	if b.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", b.String(), want)
+	}
+}
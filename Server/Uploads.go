@@ -0,0 +1,472 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadSession tracks a resumable chunked upload. It lives in
+// ./chunks/<id>/session.json next to the chunks so it survives restarts
+type UploadSession struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	// Kind is UploadArchive for zipped HLS packages or UploadSource for files the server transcodes
+	Kind        string          `json:"kind"`
+	Filename    string          `json:"filename"`
+	Metadata    MediaIndexEntry `json:"metadata"`
+	TotalChunks int             `json:"totalChunks"`
+	// Checksums maps the index of every received chunk to its SHA-256
+	Checksums  map[int]string `json:"checksums"`
+	Finalizing bool           `json:"finalizing"`
+	Created    time.Time      `json:"created"`
+	Updated    time.Time      `json:"updated"`
+}
+
+type uploadStatus struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Metadata    MediaIndexEntry `json:"metadata"`
+	TotalChunks int             `json:"totalChunks"`
+	Received    []int           `json:"received"`
+	Missing     []int           `json:"missing"`
+	Checksums   map[int]string  `json:"checksums"`
+}
+
+type createUploadRequest struct {
+	Kind        string          `json:"kind"`
+	Filename    string          `json:"filename"`
+	Metadata    MediaIndexEntry `json:"metadata"`
+	TotalChunks int             `json:"totalChunks"`
+}
+
+const (
+	UploadArchive = "archive"
+	UploadSource  = "source"
+)
+
+const chunksRoot = "./chunks"
+const maxUploadChunks = 100000
+
+// MaxChunkBytes caps a single chunk, overridable with MAX_CHUNK_BYTES
+var MaxChunkBytes int64 = 512 << 20
+
+// UploadSessionTTL is how long an untouched upload session is kept before it is pruned
+var UploadSessionTTL = 48 * time.Hour
+
+// uploadsMutex guards reads and writes of every session.json
+var uploadsMutex sync.Mutex
+
+func uploadDir(id string) string {
+	return filepath.Join(chunksRoot, "session-"+id)
+}
+
+func loadUploadSession(id string) (*UploadSession, error) {
+	data, err := os.ReadFile(filepath.Join(uploadDir(id), "session.json"))
+	if err != nil {
+		return nil, err
+	}
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse upload session %v: %v", id, err)
+	}
+	if session.Checksums == nil {
+		session.Checksums = map[int]string{}
+	}
+	return &session, nil
+}
+
+func saveUploadSession(session *UploadSession) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(uploadDir(session.ID), "session.json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *UploadSession) status() uploadStatus {
+	status := uploadStatus{
+		ID:          s.ID,
+		Kind:        s.Kind,
+		Metadata:    s.Metadata,
+		TotalChunks: s.TotalChunks,
+		Received:    []int{},
+		Missing:     []int{},
+		Checksums:   s.Checksums,
+	}
+	for i := 0; i < s.TotalChunks; i++ {
+		if _, ok := s.Checksums[i]; ok {
+			status.Received = append(status.Received, i)
+		} else {
+			status.Missing = append(status.Missing, i)
+		}
+	}
+	return status
+}
+
+// UploadSessionsHandler serves the resumable upload API:
+//
+//	POST   /uploads/                      create a session, returns its id
+//	GET    /uploads/<id>                  report received and missing chunk indexes
+//	PUT    /uploads/<id>/chunks/<index>   store a chunk, its X-Chunk-SHA256 header is required and verified
+//	POST   /uploads/<id>/finalize         assemble the chunks and queue a job to process them
+//	DELETE /uploads/<id>                  abort the upload
+func UploadSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads/"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		createUploadSession(w, r)
+		return
+	}
+
+	id := parts[0]
+	if _, err := hex.DecodeString(id); err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	uploadsMutex.Lock()
+	session, err := loadUploadSession(id)
+	uploadsMutex.Unlock()
+	if os.IsNotExist(err) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to load upload", http.StatusInternalServerError)
+		return
+	}
+	if user, _ := currentUser(r); user.Username != session.Owner && user.Role != RoleAdmin {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session.status())
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		uploadsMutex.Lock()
+		err = os.RemoveAll(uploadDir(id))
+		uploadsMutex.Unlock()
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, "Unable to remove upload", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 3 && parts[1] == "chunks" && r.Method == http.MethodPut:
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 || index >= session.TotalChunks {
+			http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+			return
+		}
+		putUploadChunk(w, r, session, index)
+	case len(parts) == 2 && parts[1] == "finalize" && r.Method == http.MethodPost:
+		finalizeUploadSession(w, session)
+	default:
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+	}
+}
+
+func createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var req createUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid upload JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Metadata.MediaType != "video" && req.Metadata.MediaType != "audio" {
+		http.Error(w, "Invalid media type", http.StatusBadRequest)
+		return
+	}
+	if !validTitle(req.Metadata.Title) {
+		http.Error(w, "Invalid title", http.StatusBadRequest)
+		return
+	}
+	if req.TotalChunks <= 0 || req.TotalChunks > maxUploadChunks {
+		http.Error(w, "Invalid chunk count", http.StatusBadRequest)
+		return
+	}
+	switch req.Kind {
+	case "", UploadArchive:
+		req.Kind = UploadArchive
+	case UploadSource:
+		if !transcodeExtensions[strings.ToLower(filepath.Ext(req.Filename))] {
+			http.Error(w, "Unsupported source format", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid upload kind", http.StatusBadRequest)
+		return
+	}
+	// The id, location and the derived fields are filled in by the server
+	req.Metadata.ID = db.NewEntryID()
+	req.Metadata.Location = ""
+	req.Metadata.Playlist = ""
+	req.Metadata.Duration = 0
+
+	id, err := randomHex(16)
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user, _ := currentUser(r)
+	now := time.Now()
+	session := &UploadSession{
+		ID:          id,
+		Owner:       user.Username,
+		Kind:        req.Kind,
+		Filename:    filepath.Base(req.Filename),
+		Metadata:    req.Metadata,
+		TotalChunks: req.TotalChunks,
+		Checksums:   map[int]string{},
+		Created:     now,
+		Updated:     now,
+	}
+	if err := os.MkdirAll(uploadDir(id), os.ModePerm); err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to create chunk directory", http.StatusInternalServerError)
+		return
+	}
+	uploadsMutex.Lock()
+	err = saveUploadSession(session)
+	uploadsMutex.Unlock()
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session.status())
+}
+
+func putUploadChunk(w http.ResponseWriter, r *http.Request, session *UploadSession, index int) {
+	if session.Finalizing {
+		http.Error(w, "Upload is being finalized", http.StatusConflict)
+		return
+	}
+	expected := strings.ToLower(r.Header.Get("X-Chunk-SHA256"))
+	if len(expected) != sha256.Size*2 {
+		http.Error(w, "X-Chunk-SHA256 must be the hex SHA-256 of the chunk", http.StatusBadRequest)
+		return
+	}
+
+	// Write to a temp file first so a dropped connection never leaves a truncated chunk behind
+	chunkPath := filepath.Join(uploadDir(session.ID), fmt.Sprintf("chunk-%d", index))
+	partPath := chunkPath + ".part"
+	partFile, err := os.Create(partPath)
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to create chunk file", http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(partFile, hash), http.MaxBytesReader(w, r.Body, MaxChunkBytes))
+	partFile.Close()
+	if err != nil {
+		os.Remove(partPath)
+		Log.Error(err.Error())
+		http.Error(w, "Unable to save chunk", http.StatusBadRequest)
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expected != sum {
+		os.Remove(partPath)
+		http.Error(w, fmt.Sprintf("Checksum mismatch for chunk %d: got %v", index, sum), http.StatusBadRequest)
+		return
+	}
+
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	// Reload, other chunks may have landed while this one was streaming
+	current, err := loadUploadSession(session.ID)
+	if err == nil && current.Finalizing {
+		err = errors.New("upload is being finalized")
+	}
+	if err == nil {
+		err = os.Rename(partPath, chunkPath)
+	}
+	if err == nil {
+		current.Checksums[index] = sum
+		current.Updated = time.Now()
+		err = saveUploadSession(current)
+	}
+	if err != nil {
+		os.Remove(partPath)
+		Log.Error(err.Error())
+		http.Error(w, "Unable to record chunk", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"index": index, "sha256": sum})
+}
+
+func finalizeUploadSession(w http.ResponseWriter, session *UploadSession) {
+	uploadsMutex.Lock()
+	current, err := loadUploadSession(session.ID)
+	if err == nil && current.Finalizing {
+		uploadsMutex.Unlock()
+		http.Error(w, "Upload is already being finalized", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		if missing := current.status().Missing; len(missing) > 0 {
+			uploadsMutex.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(current.status())
+			return
+		}
+		current.Finalizing = true
+		current.Updated = time.Now()
+		err = saveUploadSession(current)
+	}
+	uploadsMutex.Unlock()
+	if err != nil {
+		Log.Error(err.Error())
+		http.Error(w, "Unable to load upload", http.StatusInternalServerError)
+		return
+	}
+
+	// The upload moves out of the session directory so the session can go away while the job waits
+	dir := uploadDir(current.ID)
+	sourceDir := filepath.Join(chunksRoot, "source-"+current.ID)
+	job := db.Job{
+		Kind:     JobUnpack,
+		Owner:    current.Owner,
+		Metadata: db.MediaIndexEntry(current.Metadata),
+		Source:   filepath.Join(sourceDir, "upload.zip"),
+	}
+	if current.Kind == UploadSource {
+		job.Kind = JobTranscode
+		job.Source = filepath.Join(sourceDir, "source"+strings.ToLower(filepath.Ext(current.Filename)))
+	}
+	err = os.MkdirAll(sourceDir, os.ModePerm)
+	if err == nil {
+		err = assembleChunks(dir, current.TotalChunks, job.Source)
+	}
+	if err == nil && job.Kind == JobUnpack {
+		// A bad archive is turned away now rather than failing later in its
+		// job. Finalizing again cannot fix it, so the upload goes
+		if archiveErr := checkArchive(job.Source); archiveErr != nil {
+			os.RemoveAll(sourceDir)
+			uploadsMutex.Lock()
+			os.RemoveAll(dir)
+			uploadsMutex.Unlock()
+			Log.Error(archiveErr.Error())
+			http.Error(w, archiveErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err == nil {
+		job, err = Jobs.Submit(job)
+	}
+	if err != nil {
+		os.RemoveAll(sourceDir)
+		// Let the client retry the finalize call
+		uploadsMutex.Lock()
+		current.Finalizing = false
+		if saveErr := saveUploadSession(current); saveErr != nil {
+			Log.Error(saveErr.Error())
+		}
+		uploadsMutex.Unlock()
+		Log.Error(err.Error())
+		http.Error(w, "Unable to queue upload for processing", http.StatusInternalServerError)
+		return
+	}
+
+	uploadsMutex.Lock()
+	os.RemoveAll(dir)
+	uploadsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// pruneUploadSessions removes upload sessions nobody touched within UploadSessionTTL
+func pruneUploadSessions() {
+	entries, err := os.ReadDir(chunksRoot)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-UploadSessionTTL)
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "session-") {
+			ids = append(ids, strings.TrimPrefix(entry.Name(), "session-"))
+		}
+	}
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	for _, id := range ids {
+		session, err := loadUploadSession(id)
+		if err != nil || session.Updated.After(cutoff) {
+			continue
+		}
+		Log.Info(fmt.Sprintf("Pruning stale upload %v (%v)", id, session.Metadata.Title))
+		if err := os.RemoveAll(uploadDir(id)); err != nil {
+			Log.Error(err.Error())
+		}
+	}
+}
+
+func pruneUploadSessionsPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruneUploadSessions()
+		}
+	}
+}
+
+// resetUploadSessions clears the finalizing flag left behind by a crash so those
+// uploads can be finalized again. It must run before the server starts listening
+func resetUploadSessions() {
+	entries, err := os.ReadDir(chunksRoot)
+	if err != nil {
+		return
+	}
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "session-") {
+			continue
+		}
+		session, err := loadUploadSession(strings.TrimPrefix(entry.Name(), "session-"))
+		if err != nil || !session.Finalizing {
+			continue
+		}
+		session.Finalizing = false
+		if err := saveUploadSession(session); err != nil {
+			Log.Error(err.Error())
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// callUploads sends a request to the upload API as username
+func callUploads(t *testing.T, username, method, path string, body []byte, sha string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if sha != "" {
+		r.Header.Set("X-Chunk-SHA256", sha)
+	}
+	return serveAs(t, username, RequireRole(RoleUploader, UploadSessionsHandler), r)
+}
+
+func createTestUpload(t *testing.T, title string, totalChunks int) string {
+	t.Helper()
+	body, _ := json.Marshal(createUploadRequest{
+		Metadata:    MediaIndexEntry{Title: title, MediaType: "video"},
+		TotalChunks: totalChunks,
+	})
+	w := callUploads(t, RoleUploader, http.MethodPost, "/uploads/", body, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create upload: got %d %v", w.Code, w.Body)
+	}
+	var status uploadStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status.ID
+}
+
+func TestCreateUploadSession(t *testing.T) {
+	setupUsers(t)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"valid", `{"metadata": {"title": "Show", "mediaType": "video"}, "totalChunks": 2}`, http.StatusCreated},
+		{"bad media type", `{"metadata": {"title": "Show", "mediaType": "image"}, "totalChunks": 2}`, http.StatusBadRequest},
+		{"title with a slash", `{"metadata": {"title": "AC/DC", "mediaType": "audio"}, "totalChunks": 2}`, http.StatusCreated},
+		{"blank title", `{"metadata": {"title": " ", "mediaType": "video"}, "totalChunks": 2}`, http.StatusBadRequest},
+		{"no chunks", `{"metadata": {"title": "Show", "mediaType": "video"}, "totalChunks": 0}`, http.StatusBadRequest},
+		{"not json", `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := callUploads(t, RoleUploader, http.MethodPost, "/uploads/", []byte(tt.body), "")
+		if w.Code != tt.status {
+			t.Errorf("%v: got %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	if w := callUploads(t, RoleViewer, http.MethodPost, "/uploads/", []byte(tests[0].body), ""); w.Code != http.StatusForbidden {
+		t.Errorf("viewer created an upload: got %d", w.Code)
+	}
+}
+
+func TestPutUploadChunk(t *testing.T) {
+	setupUsers(t)
+	id := createTestUpload(t, "Show", 2)
+	chunk := []byte("chunk data")
+	tests := []struct {
+		name   string
+		user   string
+		index  string
+		sha    string
+		status int
+	}{
+		{"valid", RoleUploader, "0", checksum(chunk), http.StatusOK},
+		{"checksum in upper case", RoleUploader, "0", strings.ToUpper(checksum(chunk)), http.StatusOK},
+		{"checksum mismatch", RoleUploader, "1", checksum([]byte("other")), http.StatusBadRequest},
+		{"no checksum", RoleUploader, "1", "", http.StatusBadRequest},
+		{"checksum is not sha-256", RoleUploader, "1", "abc123", http.StatusBadRequest},
+		{"index past the end", RoleUploader, "2", checksum(chunk), http.StatusBadRequest},
+		{"negative index", RoleUploader, "-1", checksum(chunk), http.StatusBadRequest},
+		{"index is not a number", RoleUploader, "1e0", checksum(chunk), http.StatusBadRequest},
+		{"someone else's upload", "other", "1", checksum(chunk), http.StatusNotFound},
+		{"admin", RoleAdmin, "1", checksum(chunk), http.StatusOK},
+	}
+	addTestUser(t, "other", RoleUploader, "secret")
+	for _, tt := range tests {
+		w := callUploads(t, tt.user, http.MethodPut, "/uploads/"+id+"/chunks/"+tt.index, chunk, tt.sha)
+		if w.Code != tt.status {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+	}
+	if w := callUploads(t, RoleUploader, http.MethodGet, "/uploads/0123", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown upload: got %d", w.Code)
+	}
+	if w := callUploads(t, RoleUploader, http.MethodGet, "/uploads/../x", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("upload id that is not hex: got %d", w.Code)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(uploadDir(id), "*.part")); len(matches) > 0 {
+		t.Errorf("rejected chunks were left behind: %v", matches)
+	}
+}
+
+func TestFinalizeUploadSession(t *testing.T) {
+	setupUsers(t)
+	setupJobs(t)
+	archive := buildArchive(t, []archiveFile{
+		{name: "output.m3u8", mode: 0644, body: "#EXTM3U\n#EXTINF:4,\nsegment0.ts\n#EXT-X-ENDLIST\n"},
+		{name: "segment0.ts", mode: 0644, body: "ts"},
+	})
+	half := len(archive) / 2
+	chunks := [][]byte{archive[:half], archive[half:]}
+	id := createTestUpload(t, "Show", len(chunks))
+
+	if w := callUploads(t, RoleUploader, http.MethodPut, "/uploads/"+id+"/chunks/1", chunks[1], checksum(chunks[1])); w.Code != http.StatusOK {
+		t.Fatalf("chunk 1: got %d %v", w.Code, w.Body)
+	}
+	w := callUploads(t, RoleUploader, http.MethodPost, "/uploads/"+id+"/finalize", nil, "")
+	var status uploadStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if w.Code != http.StatusConflict || !slices.Equal(status.Missing, []int{0}) {
+		t.Fatalf("finalize with a missing chunk: got %d, missing %v", w.Code, status.Missing)
+	}
+
+	if w := callUploads(t, RoleUploader, http.MethodPut, "/uploads/"+id+"/chunks/0", chunks[0], checksum(chunks[0])); w.Code != http.StatusOK {
+		t.Fatalf("chunk 0: got %d %v", w.Code, w.Body)
+	}
+	w = callUploads(t, RoleUploader, http.MethodPost, "/uploads/"+id+"/finalize", nil, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("finalize: got %d %v", w.Code, w.Body)
+	}
+	var job db.Job
+	json.NewDecoder(w.Body).Decode(&job)
+	if _, err := os.Stat(uploadDir(id)); !os.IsNotExist(err) {
+		t.Errorf("the upload was not cleaned up: %v", err)
+	}
+	job, err := Jobs.Get(job.ID)
+	if err != nil || job.Kind != JobUnpack || job.Status != JobQueued || job.Owner != RoleUploader {
+		t.Fatalf("got job %+v, %v", job, err)
+	}
+	if data, err := os.ReadFile(job.Source); err != nil || !bytes.Equal(data, archive) {
+		t.Fatalf("the chunks were not assembled: %v", err)
+	}
+
+	mie, err := unpack(context.Background(), Jobs.catalog, job, func(float64) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Jobs.catalog.GetEntry(CTX, "video", mie.ID); err != nil {
+		t.Errorf("the entry was not added to the catalog: %v", err)
+	}
+	if mie.ID == "" || mie.ID != job.Metadata.ID || mie.Playlist != "output.m3u8" || mie.Duration != 4 {
+		t.Errorf("got entry %+v", mie)
+	}
+	if _, err := os.Stat(filepath.Join("media", "video", mie.ID, "segment0.ts")); err != nil {
+		t.Errorf("the archive was not extracted: %v", err)
+	}
+}
+
+func TestFinalizeUploadSessionBadArchive(t *testing.T) {
+	setupUsers(t)
+	setupJobs(t)
+	archive := buildArchive(t, []archiveFile{{name: "../output.m3u8", mode: 0644, body: "#EXTM3U\n"}})
+	id := createTestUpload(t, "Bad", 1)
+	if w := callUploads(t, RoleUploader, http.MethodPut, "/uploads/"+id+"/chunks/0", archive, checksum(archive)); w.Code != http.StatusOK {
+		t.Fatalf("chunk 0: got %d %v", w.Code, w.Body)
+	}
+	if w := callUploads(t, RoleUploader, http.MethodPost, "/uploads/"+id+"/finalize", nil, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("finalize: got %d %v", w.Code, w.Body)
+	}
+	if jobs, _ := Jobs.List(); len(jobs) != 0 {
+		t.Errorf("a bad archive was queued: %+v", jobs)
+	}
+	if _, err := os.Stat(uploadDir(id)); !os.IsNotExist(err) {
+		t.Errorf("the upload was kept: %v", err)
+	}
+}
+
+func TestPruneAndResetUploadSessions(t *testing.T) {
+	setupUsers(t)
+	stale := createTestUpload(t, "Stale", 1)
+	fresh := createTestUpload(t, "Fresh", 1)
+	session, err := loadUploadSession(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Updated = time.Now().Add(-UploadSessionTTL - time.Minute)
+	saveUploadSession(session)
+	session, err = loadUploadSession(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Finalizing = true
+	saveUploadSession(session)
+
+	pruneUploadSessions()
+	resetUploadSessions()
+	if _, err := loadUploadSession(stale); !os.IsNotExist(err) {
+		t.Errorf("stale upload was not pruned: %v", err)
+	}
+	session, err = loadUploadSession(fresh)
+	if err != nil {
+		t.Fatalf("fresh upload was pruned: %v", err)
+	}
+	if session.Finalizing {
+		t.Error("finalizing flag survived a restart")
+	}
+
+	if w := callUploads(t, RoleUploader, http.MethodDelete, "/uploads/"+fresh, nil, ""); w.Code != http.StatusOK {
+		t.Errorf("delete: got %d", w.Code)
+	}
+	if _, err := os.Stat(uploadDir(fresh)); !os.IsNotExist(err) {
+		t.Errorf("deleted upload is still there: %v", err)
+	}
+}
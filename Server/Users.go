@@ -0,0 +1,322 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleUploader = "uploader"
+	RoleViewer   = "viewer"
+)
+
+// roleRank orders roles so a route requiring a role also admits every role above it
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleUploader: 2,
+	RoleAdmin:    3,
+}
+
+// UserStore persists user accounts. *db.MongoClient implements it when the
+// database is connected, fileUserStore otherwise
+type UserStore interface {
+	AddUser(ctx context.Context, user db.User) error
+	GetUser(ctx context.Context, username string) (db.User, error)
+	ListUsers(ctx context.Context) ([]db.User, error)
+	UpdateUser(ctx context.Context, user db.User) error
+	DeleteUser(ctx context.Context, username string) error
+	CountUsers(ctx context.Context) (int64, error)
+}
+
+var Users UserStore
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+const userContextKey contextKey = "user"
+
+// dummyHash is compared against when a username does not exist so failed
+// logins take the same time either way
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("farnsworth"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	return string(hash), nil
+}
+
+// authenticate checks a username and password against the user store
+func authenticate(ctx context.Context, username, password string) (db.User, bool) {
+	user, err := Users.GetUser(ctx, username)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			Log.Error(err.Error())
+		}
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return user, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return user, false
+	}
+	return user, true
+}
+
+// SeedAdmin creates the first admin account from the old EXPECTED_USER/EXPECTED_KEY
+// pair when the user store is empty
+func SeedAdmin(ctx context.Context, username, password string) error {
+	count, err := Users.CountUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if username == "" || password == "" {
+		return fmt.Errorf("no users exist and EXPECTED_USER/EXPECTED_KEY are not set")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = Users.AddUser(ctx, db.User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         RoleAdmin,
+		Created:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	Log.Info(fmt.Sprintf("Seeded admin account %v", username))
+	return nil
+}
+
+// currentUser returns the user attached to the request by RequireRole
+func currentUser(r *http.Request) (db.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(db.User)
+	return user, ok
+}
+
+// RequireRole only lets the request through if the session's user holds at
+// least the given role. It must be wrapped by CheckToken
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := r.Context().Value(sessionContextKey).(db.Session)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, err := Users.GetUser(CTX, session.Username)
+		if err != nil {
+			if !errors.Is(err, db.ErrNotFound) {
+				Log.Error(err.Error())
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if roleRank[user.Role] < roleRank[role] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users, err := Users.ListUsers(CTX)
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	case http.MethodPost:
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid user JSON", http.StatusBadRequest)
+			return
+		}
+		req.Username = strings.TrimSpace(req.Username)
+		if req.Username == "" || req.Password == "" {
+			http.Error(w, "Username and password are required", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = RoleViewer
+		}
+		if _, ok := roleRank[req.Role]; !ok {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		user := db.User{
+			Username:     req.Username,
+			PasswordHash: hash,
+			Role:         req.Role,
+			Created:      time.Now(),
+		}
+		err = Users.AddUser(CTX, user)
+		if errors.Is(err, db.ErrExists) {
+			http.Error(w, "User already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+	case http.MethodPut, http.MethodPatch:
+		username := r.URL.Query().Get("username")
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid user JSON", http.StatusBadRequest)
+			return
+		}
+		user, err := Users.GetUser(CTX, username)
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.Role != "" {
+			if _, ok := roleRank[req.Role]; !ok {
+				http.Error(w, "Invalid role", http.StatusBadRequest)
+				return
+			}
+			if self, _ := currentUser(r); self.Username == user.Username && req.Role != RoleAdmin {
+				http.Error(w, "You cannot remove your own admin role", http.StatusBadRequest)
+				return
+			}
+			user.Role = req.Role
+		}
+		if req.Password != "" {
+			user.PasswordHash, err = hashPassword(req.Password)
+			if err != nil {
+				Log.Error(err.Error())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		err = Users.UpdateUser(CTX, user)
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	case http.MethodDelete:
+		username := r.URL.Query().Get("username")
+		if self, _ := currentUser(r); self.Username == username {
+			http.Error(w, "You cannot delete your own account", http.StatusBadRequest)
+			return
+		}
+		err := Users.DeleteUser(CTX, username)
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+type fileUserStore struct {
+	store *jsonFileStore[db.User]
+}
+
+func newFileUserStore(path string) (*fileUserStore, error) {
+	store, err := newJSONFileStore[db.User](path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileUserStore{store: store}, nil
+}
+
+func (fs *fileUserStore) AddUser(ctx context.Context, user db.User) error {
+	inserted, err := fs.store.insert(user.Username, user)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return db.ErrExists
+	}
+	return nil
+}
+
+func (fs *fileUserStore) GetUser(ctx context.Context, username string) (db.User, error) {
+	user, ok := fs.store.get(username)
+	if !ok {
+		return user, db.ErrNotFound
+	}
+	return user, nil
+}
+
+func (fs *fileUserStore) ListUsers(ctx context.Context) ([]db.User, error) {
+	users := fs.store.list()
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (fs *fileUserStore) UpdateUser(ctx context.Context, user db.User) error {
+	found, err := fs.store.update(user.Username, func(stored *db.User) {
+		stored.PasswordHash = user.PasswordHash
+		stored.Role = user.Role
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (fs *fileUserStore) DeleteUser(ctx context.Context, username string) error {
+	if _, ok := fs.store.get(username); !ok {
+		return db.ErrNotFound
+	}
+	return fs.store.delete(username)
+}
+
+func (fs *fileUserStore) CountUsers(ctx context.Context) (int64, error) {
+	return int64(len(fs.store.list())), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"Farnsworth/Server/db"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupUsers points the session and user stores at files in a temporary
+// working directory and adds a user for each role, named after it
+func setupUsers(t *testing.T) {
+	t.Helper()
+	path := setupSessions(t)
+	users, err := newFileUserStore(filepath.Join(filepath.Dir(path), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Users = users
+	for _, role := range []string{RoleViewer, RoleUploader, RoleAdmin} {
+		addTestUser(t, role, role, "secret")
+	}
+}
+
+func addTestUser(t *testing.T, username, role, password string) {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Users.AddUser(CTX, db.User{Username: username, PasswordHash: hash, Role: role}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveAs runs a request through handler with a session of the given user
+func serveAs(t *testing.T, username string, handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	token, _, err := NewSession(CTX, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	CheckToken(handler)(w, r)
+	return w
+}
+
+func TestSeedAdmin(t *testing.T) {
+	setupSessions(t)
+	users, err := newFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Users = users
+	if err := SeedAdmin(CTX, "", ""); err == nil {
+		t.Fatal("seeded without credentials")
+	}
+	if err := SeedAdmin(CTX, "root", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := authenticate(CTX, "root", "hunter2"); !ok || user.Role != RoleAdmin {
+		t.Fatalf("seeded admin cannot log in: %+v", user)
+	}
+	// Once there are users the credentials are ignored
+	if err := SeedAdmin(CTX, "other", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := authenticate(CTX, "other", "password"); ok {
+		t.Fatal("seeded a second admin")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	setupUsers(t)
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+	}{
+		{"valid", RoleViewer, "secret", http.StatusFound},
+		{"wrong password", RoleViewer, "guess", http.StatusUnauthorized},
+		{"unknown user", "nobody", "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/login/", nil)
+		r.SetBasicAuth(tt.username, tt.password)
+		w := httptest.NewRecorder()
+		BasicAuth(HandleLogin)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%v: got %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusFound {
+			continue
+		}
+		session, ok := ValidateSession(CTX, w.Header().Get("token"))
+		if !ok || session.Username != tt.username {
+			t.Errorf("%v: login gave session %+v", tt.name, session)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	setupUsers(t)
+	addTestUser(t, "nobody", "", "secret")
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		if user, found := currentUser(r); !found || user.PasswordHash == "" {
+			t.Errorf("the user is not attached to the request")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	tests := []struct {
+		role   string
+		user   string
+		status int
+	}{
+		{RoleViewer, RoleViewer, http.StatusNoContent},
+		{RoleViewer, RoleAdmin, http.StatusNoContent},
+		{RoleUploader, RoleViewer, http.StatusForbidden},
+		{RoleUploader, RoleUploader, http.StatusNoContent},
+		{RoleAdmin, RoleUploader, http.StatusForbidden},
+		{RoleAdmin, RoleAdmin, http.StatusNoContent},
+		{RoleViewer, "nobody", http.StatusForbidden},
+		{RoleViewer, "removed", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := serveAs(t, tt.user, RequireRole(tt.role, ok), httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != tt.status {
+			t.Errorf("%v on a %v route: got %d, want %d", tt.user, tt.role, w.Code, tt.status)
+		}
+	}
+}
+
+func TestUsersHandler(t *testing.T) {
+	setupUsers(t)
+	handler := RequireRole(RoleAdmin, UsersHandler)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"create", http.MethodPost, "/users/", `{"username": " alice ", "password": "pw"}`, http.StatusCreated},
+		{"create existing", http.MethodPost, "/users/", `{"username": "alice", "password": "pw"}`, http.StatusConflict},
+		{"create without password", http.MethodPost, "/users/", `{"username": "bob"}`, http.StatusBadRequest},
+		{"create with unknown role", http.MethodPost, "/users/", `{"username": "bob", "password": "pw", "role": "owner"}`, http.StatusBadRequest},
+		{"promote", http.MethodPatch, "/users/?username=alice", `{"role": "uploader"}`, http.StatusOK},
+		{"change password", http.MethodPatch, "/users/?username=alice", `{"password": "new"}`, http.StatusOK},
+		{"change unknown", http.MethodPatch, "/users/?username=bob", `{"role": "viewer"}`, http.StatusNotFound},
+		{"demote self", http.MethodPatch, "/users/?username=admin", `{"role": "viewer"}`, http.StatusBadRequest},
+		{"delete self", http.MethodDelete, "/users/?username=admin", "", http.StatusBadRequest},
+		{"delete", http.MethodDelete, "/users/?username=viewer", "", http.StatusOK},
+		{"delete unknown", http.MethodDelete, "/users/?username=viewer", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := serveAs(t, RoleAdmin, handler, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%v: got %d %v, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+	}
+
+	user, ok := authenticate(CTX, "alice", "new")
+	if !ok || user.Role != RoleUploader {
+		t.Errorf("alice was not updated: %+v", user)
+	}
+	w := serveAs(t, RoleAdmin, handler, httptest.NewRequest(http.MethodGet, "/users/", nil))
+	var listed []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, u := range listed {
+		for key := range u {
+			if strings.Contains(strings.ToLower(key), "password") {
+				t.Errorf("user list exposes %v", key)
+			}
+		}
+		names = append(names, u["username"].(string))
+	}
+	if strings.Join(names, ",") != "admin,alice,uploader" {
+		t.Errorf("got users %v", names)
+	}
+	if w := serveAs(t, RoleUploader, handler, httptest.NewRequest(http.MethodGet, "/users/", nil)); w.Code != http.StatusForbidden {
+		t.Errorf("uploader listed users: got %d", w.Code)
+	}
+}
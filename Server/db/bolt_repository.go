@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+// BoltRepository is a MediaRepository kept in a single bbolt file, for servers
+// that run without MongoDB. Each media type is a bucket of bson encoded entries
+// keyed by id. Queries are run in Go over the whole bucket, which is fine for the
+// size of a home library
+type BoltRepository struct {
+	db *bbolt.DB
+}
+
+func NewBoltRepository(path string) (*BoltRepository, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %v", err)
+	}
+	return &BoltRepository{db: db}, nil
+}
+
+func (b *BoltRepository) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltRepository) AddEntry(ctx context.Context, entry MediaIndexEntry) error {
+	data, err := bson.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode entry: %v", err)
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(entry.MediaType))
+		if err != nil {
+			return fmt.Errorf("failed to insert entry: %v", err)
+		}
+		if bucket.Get([]byte(entry.ID)) != nil {
+			return ErrExists
+		}
+		return bucket.Put([]byte(entry.ID), data)
+	})
+}
+
+func (b *BoltRepository) GetEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error) {
+	var entry MediaIndexEntry
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		entry, err = getBoltEntry(tx, mediaType, id)
+		return err
+	})
+	return entry, err
+}
+
+func (b *BoltRepository) ListEntries(ctx context.Context, mediaType string) ([]MediaIndexEntry, error) {
+	entries, _, err := b.QueryEntries(ctx, mediaType, EntryQuery{})
+	return entries, err
+}
+
+// UpdateEntry runs update inside a write transaction, so updates never race
+// each other and update is only ever called once
+func (b *BoltRepository) UpdateEntry(ctx context.Context, mediaType string, id string, update func(*MediaIndexEntry) error) (MediaIndexEntry, error) {
+	var entry MediaIndexEntry
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		entry, err = getBoltEntry(tx, mediaType, id)
+		if err != nil {
+			return err
+		}
+		if err := update(&entry); err != nil {
+			return err
+		}
+		// The key of an entry never changes
+		entry.ID, entry.MediaType = id, mediaType
+		entry.Revision++
+		data, err := bson.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode entry: %v", err)
+		}
+		return tx.Bucket([]byte(mediaType)).Put([]byte(id), data)
+	})
+	return entry, err
+}
+
+func (b *BoltRepository) DeleteEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error) {
+	var entry MediaIndexEntry
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		entry, err = getBoltEntry(tx, mediaType, id)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(mediaType)).Delete([]byte(id))
+	})
+	return entry, err
+}
+
+func (b *BoltRepository) QueryEntries(ctx context.Context, mediaType string, query EntryQuery) ([]MediaIndexEntry, string, error) {
+	entries := []MediaIndexEntry{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(mediaType))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, data []byte) error {
+			var entry MediaIndexEntry
+			if err := bson.Unmarshal(data, &entry); err != nil {
+				return fmt.Errorf("failed to decode entry %s: %v", key, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return queryEntries(entries, query)
+}
+
+func getBoltEntry(tx *bbolt.Tx, mediaType string, id string) (MediaIndexEntry, error) {
+	var entry MediaIndexEntry
+	bucket := tx.Bucket([]byte(mediaType))
+	if bucket == nil {
+		return entry, ErrNotFound
+	}
+	data := bucket.Get([]byte(id))
+	if data == nil {
+		return entry, ErrNotFound
+	}
+	if err := bson.Unmarshal(data, &entry); err != nil {
+		return entry, fmt.Errorf("failed to decode entry %v: %v", id, err)
+	}
+	return entry, nil
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryRepository is a MediaRepository that keeps the catalog in memory
+type MemoryRepository struct {
+	mutex   sync.RWMutex
+	entries map[string][]MediaIndexEntry
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{entries: map[string][]MediaIndexEntry{}}
+}
+
+func (m *MemoryRepository) find(mediaType string, id string) int {
+	for i, entry := range m.entries[mediaType] {
+		if entry.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryRepository) AddEntry(ctx context.Context, entry MediaIndexEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.find(entry.MediaType, entry.ID) >= 0 {
+		return ErrExists
+	}
+	m.entries[entry.MediaType] = append(m.entries[entry.MediaType], cloneEntry(entry))
+	return nil
+}
+
+func (m *MemoryRepository) GetEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	i := m.find(mediaType, id)
+	if i < 0 {
+		return MediaIndexEntry{}, ErrNotFound
+	}
+	return cloneEntry(m.entries[mediaType][i]), nil
+}
+
+func (m *MemoryRepository) ListEntries(ctx context.Context, mediaType string) ([]MediaIndexEntry, error) {
+	entries, _, err := m.QueryEntries(ctx, mediaType, EntryQuery{})
+	return entries, err
+}
+
+func (m *MemoryRepository) UpdateEntry(ctx context.Context, mediaType string, id string, update func(*MediaIndexEntry) error) (MediaIndexEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := m.find(mediaType, id)
+	if i < 0 {
+		return MediaIndexEntry{}, ErrNotFound
+	}
+	entry := cloneEntry(m.entries[mediaType][i])
+	if err := update(&entry); err != nil {
+		return entry, err
+	}
+	// The key of an entry never changes
+	entry.ID, entry.MediaType = id, mediaType
+	m.entries[mediaType][i] = cloneEntry(entry)
+	return entry, nil
+}
+
+func (m *MemoryRepository) DeleteEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := m.find(mediaType, id)
+	if i < 0 {
+		return MediaIndexEntry{}, ErrNotFound
+	}
+	entry := m.entries[mediaType][i]
+	m.entries[mediaType] = append(m.entries[mediaType][:i:i], m.entries[mediaType][i+1:]...)
+	return entry, nil
+}
+
+func (m *MemoryRepository) QueryEntries(ctx context.Context, mediaType string, query EntryQuery) ([]MediaIndexEntry, string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entries := make([]MediaIndexEntry, 0, len(m.entries[mediaType]))
+	for _, entry := range m.entries[mediaType] {
+		entries = append(entries, cloneEntry(entry))
+	}
+	return queryEntries(entries, query)
+}
@@ -2,12 +2,18 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
 )
 
+var ErrNotFound = errors.New("entry not found")
+var ErrExists = errors.New("entry already exists")
+
 type MongoClient struct {
 	client *mongo.Client
 	dbName string
@@ -26,132 +32,202 @@ func NewMongoClient(uri, dbName string) (*MongoClient, error) {
 	}, nil
 }
 
-func (mc *MongoClient) AddVideo(ctx context.Context, entry interface{}) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection("video")
-	entryBSON, err := bson.Marshal(entry)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal entry: %v", err)
+func (mc *MongoClient) AddEntry(ctx context.Context, entry MediaIndexEntry) error {
+	collection := mc.client.Database("Media").Collection(entry.MediaType)
+	_, err := collection.InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrExists
 	}
-	result, err := collection.InsertOne(ctx, entryBSON)
 	if err != nil {
-		return nil, fmt.Errorf("failed to insert entry: %v", err)
+		return fmt.Errorf("failed to insert entry: %v", err)
 	}
-	return result.InsertedID, nil
+	return nil
 }
 
-func (mc *MongoClient) GetVideos(ctx context.Context) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection("video")
-	filter := bson.M{}
-	cursor, err := collection.Find(ctx, filter)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find video entries: %v", err)
-	}
-	defer cursor.Close(ctx)
-	var videos []interface{}
-	for cursor.Next(ctx) {
-		var message bson.M
-		if err := cursor.Decode(&message); err != nil {
-			return nil, fmt.Errorf("failed to decode message: %v", err)
-		}
-		videos = append(videos, message)
-	}
-	if err := cursor.Err(); err != nil {
-		return nil, fmt.Errorf("cursor error: %v", err)
-	}
-	return videos, nil
+func (mc *MongoClient) ListEntries(ctx context.Context, mediaType string) ([]MediaIndexEntry, error) {
+	entries, _, err := mc.QueryEntries(ctx, mediaType, EntryQuery{})
+	return entries, err
 }
 
-func (mc *MongoClient) AddAudio(ctx context.Context, entry interface{}) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection("audio")
-	entryBSON, err := bson.Marshal(entry)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal entry: %v", err)
+// titleCollation sorts titles without regard to case
+var titleCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// QueryEntries pages with range queries on the sort field and id rather than
+// skips, so deep pages cost as little as the first one
+func (mc *MongoClient) QueryEntries(ctx context.Context, mediaType string, query EntryQuery) ([]MediaIndexEntry, string, error) {
+	if err := query.validate(); err != nil {
+		return nil, "", err
 	}
-	result, err := collection.InsertOne(ctx, entryBSON)
-	if err != nil {
-		return nil, fmt.Errorf("failed to insert entry: %v", err)
+	field, descending, _ := query.sortOrder()
+	cursor, _ := query.cursor()
+
+	filter := bson.D{}
+	if terms := query.textTerms(); len(terms) > 0 {
+		// Quoting every word makes $text require all of them instead of any
+		search := `"` + strings.Join(terms, `" "`) + `"`
+		filter = append(filter, bson.E{Key: "$text", Value: bson.M{"$search": search}})
+	}
+	if query.Genre != "" {
+		filter = append(filter, bson.E{Key: "genre", Value: query.Genre})
+	}
+	if query.Tag != "" {
+		filter = append(filter, bson.E{Key: "tags", Value: query.Tag})
+	}
+	if query.Directory != "" {
+		filter = append(filter, bson.E{Key: "directory", Value: query.Directory})
+	}
+	order, after := 1, "$gt"
+	if descending {
+		order, after = -1, "$lt"
+	}
+	if cursor != nil {
+		if field == "id" {
+			filter = append(filter, bson.E{Key: "id", Value: bson.M{after: cursor.ID}})
+		} else {
+			value := map[string]interface{}{"title": cursor.Title, "added": cursor.Added, "duration": cursor.Duration}[field]
+			filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+				bson.M{field: bson.M{after: value}},
+				bson.M{field: value, "id": bson.M{after: cursor.ID}},
+			}})
+		}
 	}
-	return result.InsertedID, nil
-}
 
-func (mc *MongoClient) GetAudio(ctx context.Context) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection("audio")
-	filter := bson.M{}
-	cursor, err := collection.Find(ctx, filter)
+	opts := options.Find()
+	if field == "id" {
+		opts.SetSort(bson.D{{Key: "id", Value: order}})
+	} else {
+		opts.SetSort(bson.D{{Key: field, Value: order}, {Key: "id", Value: order}})
+	}
+	// $text cannot run under a collation, so a search sorted by title orders
+	// titles by their bytes, upper case first. The cursor range above compares
+	// the same way, so paging stays consistent
+	if field == "title" && len(query.textTerms()) == 0 {
+		opts.SetCollation(titleCollation)
+	}
+	if query.Limit > 0 {
+		// One more than asked for tells whether there is a next page
+		opts.SetLimit(int64(query.Limit) + 1)
+	}
+	collection := mc.client.Database("Media").Collection(mediaType)
+	results, err := collection.Find(ctx, filter, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find audio entries: %v", err)
-	}
-	defer cursor.Close(ctx)
-	var videos []interface{}
-	for cursor.Next(ctx) {
-		var message bson.M
-		if err := cursor.Decode(&message); err != nil {
-			return nil, fmt.Errorf("failed to decode message: %v", err)
-		}
-		videos = append(videos, message)
+		return nil, "", fmt.Errorf("failed to find %v entries: %v", mediaType, err)
 	}
-	if err := cursor.Err(); err != nil {
-		return nil, fmt.Errorf("cursor error: %v", err)
+	defer results.Close(ctx)
+	entries := []MediaIndexEntry{}
+	if err := results.All(ctx, &entries); err != nil {
+		return nil, "", fmt.Errorf("failed to decode entries: %v", err)
 	}
-	return videos, nil
+	entries, next := page(entries, query)
+	return entries, next, nil
 }
 
-func (mc *MongoClient) DeleteVideo(ctx context.Context, title string) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection("video")
-	filter := bson.M{}
-	filter["title"] = title
-	var result bson.M
-	err := collection.FindOneAndDelete(ctx, filter).Decode(&result)
+func (mc *MongoClient) DeleteEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error) {
+	collection := mc.client.Database("Media").Collection(mediaType)
+	var entry MediaIndexEntry
+	err := collection.FindOneAndDelete(ctx, bson.M{"id": id}).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entry, ErrNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to delete entry")
+		return entry, fmt.Errorf("failed to delete entry: %v", err)
 	}
-	return result, nil
+	return entry, nil
 }
 
-func (mc *MongoClient) DeleteAudio(ctx context.Context, title string) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection("audio")
-	filter := bson.M{}
-	filter["title"] = title
-	var result bson.M
-	err := collection.FindOneAndDelete(ctx, filter).Decode(&result)
+type MediaIndexEntry struct {
+	ID          string          `json:"id"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Genre       []string        `json:"genre"`
+	Tags        []string        `json:"tags"`
+	Directory   string          `json:"directory"`
+	Location    string          `json:"location"`
+	MediaType   string          `json:"mediaType"`
+	Playlist    string          `json:"playlist"`
+	Duration    float64         `json:"duration"`
+	Poster      string          `json:"poster,omitempty"`
+	Sprite      *SpriteSheet    `json:"sprite,omitempty"`
+	Thumbnails  string          `json:"thumbnails,omitempty"`
+	Subtitles   []SubtitleTrack `json:"subtitles,omitempty"`
+	AudioTracks []AudioTrack    `json:"audioTracks,omitempty"`
+	Added       time.Time       `json:"added"`
+	// Missing is set by the media scan when the entry's directory is gone
+	Missing bool `json:"missing,omitempty" bson:"missing,omitempty"`
+	// Revision counts the updates of an entry so concurrent updates do not overwrite each other
+	Revision int64 `json:"-" bson:"revision"`
+}
+
+func (mc *MongoClient) GetEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error) {
+	collection := mc.client.Database("Media").Collection(mediaType)
+	filter := bson.M{"id": id}
+	var entry MediaIndexEntry
+	err := collection.FindOne(ctx, filter).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entry, ErrNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to delete entry")
+		return entry, fmt.Errorf("failed to find entry: %v", err)
 	}
-	return result, nil
+	return entry, nil
 }
 
-type MediaIndexEntry struct {
-	Title       string   `json:"title"`
-	Description string   `json:"description"`
-	Genre       []string `json:"genre"`
-	Tags        []string `json:"tags"`
-	Directory   string   `json:"directory"`
-	Location    string   `json:"location"`
-	MediaType   string   `json:"mediaType"`
+// SpriteSheet describes a grid of preview thumbnails taken every Interval seconds
+type SpriteSheet struct {
+	URI      string  `json:"uri"`
+	Columns  int     `json:"columns"`
+	Rows     int     `json:"rows"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Count    int     `json:"count"`
+	Interval float64 `json:"interval"`
 }
 
-func (mc *MongoClient) UpdateMetaData(ctx context.Context, oldTitle string, newMetadata MediaIndexEntry) (interface{}, error) {
-	collection := mc.client.Database("Media").Collection(newMetadata.MediaType)
-	filter := bson.M{"title": oldTitle}
+// SubtitleTrack is a subtitle rendition of an entry. URI is the rendition's
+// playlist relative to the entry's directory
+type SubtitleTrack struct {
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	URI      string `json:"uri"`
+	Forced   bool   `json:"forced,omitempty"`
+}
 
-	// Create an update document excluding the location field
-	update := bson.M{
-		"$set": bson.M{
-			"title":       newMetadata.Title,
-			"description": newMetadata.Description,
-			"genre":       newMetadata.Genre,
-			"tags":        newMetadata.Tags,
-			"directory":   newMetadata.Directory,
-			// "location" is intentionally excluded
-		},
-	}
+// AudioTrack is an audio rendition of an entry. The track muxed into the video
+// variants has no URI
+type AudioTrack struct {
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name"`
+	URI      string `json:"uri,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+}
 
-	// Perform the update operation
-	result, err := collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		return nil, fmt.Errorf("failed to update metadata: %v", err)
+// UpdateEntry reads, changes and replaces the entry, trying again if another
+// update replaced it in the meantime
+func (mc *MongoClient) UpdateEntry(ctx context.Context, mediaType string, id string, update func(*MediaIndexEntry) error) (MediaIndexEntry, error) {
+	collection := mc.client.Database("Media").Collection(mediaType)
+	for attempt := 0; attempt < 10; attempt++ {
+		entry, err := mc.GetEntry(ctx, mediaType, id)
+		if err != nil {
+			return entry, err
+		}
+		revision := entry.Revision
+		if err := update(&entry); err != nil {
+			return entry, err
+		}
+		entry.ID, entry.MediaType = id, mediaType
+		entry.Revision = revision + 1
+		// Entries written before revisions existed have no revision field at all
+		filter := bson.M{"id": id, "revision": revision}
+		if revision == 0 {
+			filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+		}
+		result, err := collection.ReplaceOne(ctx, filter, entry)
+		if err != nil {
+			return entry, fmt.Errorf("failed to update entry: %v", err)
+		}
+		if result.MatchedCount == 1 {
+			return entry, nil
+		}
 	}
-
-	// Return the number of documents modified
-	return result.ModifiedCount, nil
+	return MediaIndexEntry{}, fmt.Errorf("failed to update entry: it keeps changing")
 }
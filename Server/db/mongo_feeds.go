@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Feed is a podcast feed of the audio entries in a directory, with a tag, or
+// both. SecretHash is the SHA-256 of the secret in the feed's URL
+type Feed struct {
+	ID          string `json:"id" bson:"id"`
+	Owner       string `json:"owner" bson:"owner"`
+	Title       string `json:"title" bson:"title"`
+	Description string `json:"description" bson:"description"`
+	Directory   string `json:"directory,omitempty" bson:"directory,omitempty"`
+	Tag         string `json:"tag,omitempty" bson:"tag,omitempty"`
+	// Order is "title" for series listened to in order, "added" for newest first
+	Order      string    `json:"order" bson:"order"`
+	SecretHash string    `json:"-" bson:"secretHash"`
+	Created    time.Time `json:"created" bson:"created"`
+}
+
+func (mc *MongoClient) EnsureFeedIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("feeds")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "title", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create feed indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) AddFeed(ctx context.Context, feed Feed) error {
+	collection := mc.client.Database("Media").Collection("feeds")
+	_, err := collection.InsertOne(ctx, feed)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert feed: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetFeed(ctx context.Context, id string) (Feed, error) {
+	collection := mc.client.Database("Media").Collection("feeds")
+	var feed Feed
+	err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&feed)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return feed, ErrNotFound
+	}
+	if err != nil {
+		return feed, fmt.Errorf("failed to find feed: %v", err)
+	}
+	return feed, nil
+}
+
+// ListFeeds returns the feeds of owner by title, or everyone's when owner is empty
+func (mc *MongoClient) ListFeeds(ctx context.Context, owner string) ([]Feed, error) {
+	collection := mc.client.Database("Media").Collection("feeds")
+	filter := bson.M{}
+	if owner != "" {
+		filter["owner"] = owner
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "title", Value: 1}, {Key: "id", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list feeds: %v", err)
+	}
+	defer cursor.Close(ctx)
+	feeds := []Feed{}
+	if err := cursor.All(ctx, &feeds); err != nil {
+		return nil, fmt.Errorf("failed to decode feeds: %v", err)
+	}
+	return feeds, nil
+}
+
+// UpdateFeed replaces everything about a feed but its id, owner and creation time
+func (mc *MongoClient) UpdateFeed(ctx context.Context, feed Feed) error {
+	collection := mc.client.Database("Media").Collection("feeds")
+	update := bson.M{"$set": bson.M{
+		"title":       feed.Title,
+		"description": feed.Description,
+		"directory":   feed.Directory,
+		"tag":         feed.Tag,
+		"order":       feed.Order,
+		"secretHash":  feed.SecretHash,
+	}}
+	result, err := collection.UpdateOne(ctx, bson.M{"id": feed.ID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update feed: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (mc *MongoClient) DeleteFeed(ctx context.Context, id string) error {
+	collection := mc.client.Database("Media").Collection("feeds")
+	result, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete feed: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Job is a unit of background work, such as unpacking an uploaded archive or
+// turning a source file into HLS
+type Job struct {
+	ID       string          `json:"id" bson:"id"`
+	Kind     string          `json:"kind" bson:"kind"`
+	Status   string          `json:"status" bson:"status"`
+	Progress float64         `json:"progress" bson:"progress"`
+	Error    string          `json:"error,omitempty" bson:"error"`
+	Owner    string          `json:"owner" bson:"owner"`
+	Metadata MediaIndexEntry `json:"metadata" bson:"metadata"`
+	// Track describes the rendition an audio track job adds to Metadata's entry
+	Track *AudioTrack `json:"track,omitempty" bson:"track,omitempty"`
+	// Source is the file the job works on. It is kept after a failure so the job can be retried
+	Source   string    `json:"-" bson:"source"`
+	Attempts int       `json:"attempts" bson:"attempts"`
+	Created  time.Time `json:"created" bson:"created"`
+	Started  time.Time `json:"started" bson:"started"`
+	Finished time.Time `json:"finished" bson:"finished"`
+}
+
+func (mc *MongoClient) EnsureJobIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("jobs")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create job indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) AddJob(ctx context.Context, job Job) error {
+	collection := mc.client.Database("Media").Collection("jobs")
+	_, err := collection.InsertOne(ctx, job)
+	if err != nil {
+		return fmt.Errorf("failed to insert job: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetJob(ctx context.Context, id string) (Job, error) {
+	collection := mc.client.Database("Media").Collection("jobs")
+	var job Job
+	err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return job, ErrNotFound
+	}
+	if err != nil {
+		return job, fmt.Errorf("failed to find job: %v", err)
+	}
+	return job, nil
+}
+
+// ListJobs returns every job, oldest first
+func (mc *MongoClient) ListJobs(ctx context.Context) ([]Job, error) {
+	collection := mc.client.Database("Media").Collection("jobs")
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find jobs: %v", err)
+	}
+	jobs := []Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to decode jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+func (mc *MongoClient) UpdateJob(ctx context.Context, job Job) error {
+	collection := mc.client.Database("Media").Collection("jobs")
+	result, err := collection.ReplaceOne(ctx, bson.M{"id": job.ID}, job)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (mc *MongoClient) DeleteJob(ctx context.Context, id string) error {
+	collection := mc.client.Database("Media").Collection("jobs")
+	_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete job: %v", err)
+	}
+	return nil
+}
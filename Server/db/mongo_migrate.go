@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewEntryID generates the ID of a new media entry
+func NewEntryID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// EntriesWithoutID returns the entries stored before entries had IDs, keyed by
+// the ID they should get. The ID is derived from the document's _id so a
+// migration that is interrupted picks the same ID when it runs again
+func (mc *MongoClient) EntriesWithoutID(ctx context.Context, mediaType string) (map[string]MediaIndexEntry, error) {
+	collection := mc.client.Database("Media").Collection(mediaType)
+	cursor, err := collection.Find(ctx, bson.M{"id": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find entries without an id: %v", err)
+	}
+	defer cursor.Close(ctx)
+	entries := map[string]MediaIndexEntry{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ObjectID primitive.ObjectID `bson:"_id"`
+		}
+		var entry MediaIndexEntry
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode entry: %v", err)
+		}
+		if err := cursor.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("failed to decode entry: %v", err)
+		}
+		entries[doc.ObjectID.Hex()] = entry
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %v", err)
+	}
+	return entries, nil
+}
+
+// AssignEntryID records the ID and new location of an entry found by EntriesWithoutID
+func (mc *MongoClient) AssignEntryID(ctx context.Context, mediaType string, id string, location string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("failed to parse id: %v", err)
+	}
+	collection := mc.client.Database("Media").Collection(mediaType)
+	update := bson.M{"$set": bson.M{"id": id, "location": location}}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to assign id: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// BackfillAddedDates gives entries from before the added date was recorded the
+// time their document was created, which the ObjectID carries
+func (mc *MongoClient) BackfillAddedDates(ctx context.Context) error {
+	for _, mediaType := range []string{"video", "audio"} {
+		collection := mc.client.Database("Media").Collection(mediaType)
+		filter := bson.M{"added": bson.M{"$exists": false}}
+		update := bson.A{bson.M{"$set": bson.M{"added": bson.M{"$toDate": "$_id"}}}}
+		if _, err := collection.UpdateMany(ctx, filter, update); err != nil {
+			return fmt.Errorf("failed to backfill added dates: %v", err)
+		}
+	}
+	return nil
+}
+
+// EnsureMediaIndexes makes entry IDs unique and backs the queries of
+// QueryEntries. It must run after the ID migration, entries without an ID are
+// left out of the unique index
+func (mc *MongoClient) EnsureMediaIndexes(ctx context.Context) error {
+	for _, mediaType := range []string{"video", "audio"} {
+		collection := mc.client.Database("Media").Collection(mediaType)
+		_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "id", Value: 1}},
+				Options: options.Index().SetUnique(true).SetSparse(true),
+			},
+			{
+				Keys:    bson.D{{Key: "title", Value: "text"}, {Key: "description", Value: "text"}},
+				Options: options.Index().SetWeights(bson.M{"title": 10, "description": 1}),
+			},
+			{
+				Keys:    bson.D{{Key: "title", Value: 1}, {Key: "id", Value: 1}},
+				Options: options.Index().SetCollation(titleCollation),
+			},
+			{Keys: bson.D{{Key: "added", Value: 1}, {Key: "id", Value: 1}}},
+			{Keys: bson.D{{Key: "duration", Value: 1}, {Key: "id", Value: 1}}},
+			{Keys: bson.D{{Key: "genre", Value: 1}, {Key: "id", Value: 1}}},
+			{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "id", Value: 1}}},
+			{Keys: bson.D{{Key: "directory", Value: 1}, {Key: "id", Value: 1}}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %v indexes: %v", mediaType, err)
+		}
+	}
+	return nil
+}
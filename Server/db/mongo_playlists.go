@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// PlaylistItem points at an entry by id. Entry is filled in when a playlist is
+// served and never stored
+type PlaylistItem struct {
+	MediaType string           `json:"mediaType" bson:"mediaType"`
+	EntryID   string           `json:"entryId" bson:"entryId"`
+	Entry     *MediaIndexEntry `json:"entry,omitempty" bson:"-"`
+}
+
+// Playlist is an ordered list of entries belonging to one user
+type Playlist struct {
+	ID      string         `json:"id" bson:"id"`
+	Owner   string         `json:"owner" bson:"owner"`
+	Name    string         `json:"name" bson:"name"`
+	Items   []PlaylistItem `json:"items" bson:"items"`
+	Created time.Time      `json:"created" bson:"created"`
+	Updated time.Time      `json:"updated" bson:"updated"`
+}
+
+func (mc *MongoClient) EnsurePlaylistIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("playlists")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "name", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create playlist indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) AddPlaylist(ctx context.Context, playlist Playlist) error {
+	collection := mc.client.Database("Media").Collection("playlists")
+	_, err := collection.InsertOne(ctx, playlist)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert playlist: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetPlaylist(ctx context.Context, id string) (Playlist, error) {
+	collection := mc.client.Database("Media").Collection("playlists")
+	var playlist Playlist
+	err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&playlist)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return playlist, ErrNotFound
+	}
+	if err != nil {
+		return playlist, fmt.Errorf("failed to find playlist: %v", err)
+	}
+	return playlist, nil
+}
+
+// ListPlaylists returns the playlists of owner by name, or everyone's when
+// owner is empty
+func (mc *MongoClient) ListPlaylists(ctx context.Context, owner string) ([]Playlist, error) {
+	collection := mc.client.Database("Media").Collection("playlists")
+	filter := bson.M{}
+	if owner != "" {
+		filter["owner"] = owner
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "id", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list playlists: %v", err)
+	}
+	defer cursor.Close(ctx)
+	playlists := []Playlist{}
+	if err := cursor.All(ctx, &playlists); err != nil {
+		return nil, fmt.Errorf("failed to decode playlists: %v", err)
+	}
+	return playlists, nil
+}
+
+// UpdatePlaylist replaces the name and items of a playlist
+func (mc *MongoClient) UpdatePlaylist(ctx context.Context, playlist Playlist) error {
+	collection := mc.client.Database("Media").Collection("playlists")
+	update := bson.M{"$set": bson.M{
+		"name":    playlist.Name,
+		"items":   playlist.Items,
+		"updated": playlist.Updated,
+	}}
+	result, err := collection.UpdateOne(ctx, bson.M{"id": playlist.ID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update playlist: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (mc *MongoClient) DeletePlaylist(ctx context.Context, id string) error {
+	collection := mc.client.Database("Media").Collection("playlists")
+	result, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete playlist: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
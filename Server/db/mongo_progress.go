@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Progress is how far a user got into an entry. Position and Duration are in seconds
+type Progress struct {
+	Username  string    `json:"-" bson:"username"`
+	MediaType string    `json:"mediaType" bson:"mediaType"`
+	EntryID   string    `json:"entryId" bson:"entryId"`
+	Position  float64   `json:"position" bson:"position"`
+	Duration  float64   `json:"duration" bson:"duration"`
+	Watched   bool      `json:"watched" bson:"watched"`
+	Updated   time.Time `json:"updated" bson:"updated"`
+}
+
+func progressFilter(username, mediaType, id string) bson.M {
+	return bson.M{"username": username, "mediaType": mediaType, "entryId": id}
+}
+
+func (mc *MongoClient) EnsureProgressIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("progress")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}, {Key: "mediaType", Value: 1}, {Key: "entryId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "updated", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create progress indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) SaveProgress(ctx context.Context, progress Progress) error {
+	collection := mc.client.Database("Media").Collection("progress")
+	filter := progressFilter(progress.Username, progress.MediaType, progress.EntryID)
+	_, err := collection.ReplaceOne(ctx, filter, progress, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save progress: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetProgress(ctx context.Context, username, mediaType, id string) (Progress, error) {
+	collection := mc.client.Database("Media").Collection("progress")
+	var progress Progress
+	err := collection.FindOne(ctx, progressFilter(username, mediaType, id)).Decode(&progress)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return progress, ErrNotFound
+	}
+	if err != nil {
+		return progress, fmt.Errorf("failed to find progress: %v", err)
+	}
+	return progress, nil
+}
+
+// ListProgress returns a user's progress, most recently updated first
+func (mc *MongoClient) ListProgress(ctx context.Context, username string) ([]Progress, error) {
+	collection := mc.client.Database("Media").Collection("progress")
+	opts := options.Find().SetSort(bson.D{{Key: "updated", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"username": username}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list progress: %v", err)
+	}
+	defer cursor.Close(ctx)
+	progress := []Progress{}
+	if err := cursor.All(ctx, &progress); err != nil {
+		return nil, fmt.Errorf("failed to decode progress: %v", err)
+	}
+	return progress, nil
+}
+
+func (mc *MongoClient) DeleteProgress(ctx context.Context, username, mediaType, id string) error {
+	collection := mc.client.Database("Media").Collection("progress")
+	_, err := collection.DeleteOne(ctx, progressFilter(username, mediaType, id))
+	if err != nil {
+		return fmt.Errorf("failed to delete progress: %v", err)
+	}
+	return nil
+}
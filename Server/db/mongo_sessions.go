@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Session is a login session. ID is the SHA-256 of the bearer token so the
+// token itself never touches the database
+type Session struct {
+	ID       string        `json:"id" bson:"id"`
+	Username string        `json:"username" bson:"username"`
+	Created  time.Time     `json:"created" bson:"created"`
+	LastUsed time.Time     `json:"lastUsed" bson:"lastUsed"`
+	TTL      time.Duration `json:"ttl" bson:"ttl"`
+	Expires  time.Time     `json:"expires" bson:"expires"`
+	// Scope limits a media token to the files of these entries, as "<type>/<id>".
+	// Scoped sessions cannot be used with the API
+	Scope []string `json:"scope,omitempty" bson:"scope,omitempty"`
+}
+
+func (mc *MongoClient) EnsureSessionIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("sessions")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// Mongo drops expired sessions on its own
+		{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) AddSession(ctx context.Context, session Session) error {
+	collection := mc.client.Database("Media").Collection("sessions")
+	_, err := collection.InsertOne(ctx, session)
+	if err != nil {
+		return fmt.Errorf("failed to insert session: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetSession(ctx context.Context, id string) (Session, error) {
+	collection := mc.client.Database("Media").Collection("sessions")
+	var session Session
+	err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return session, ErrNotFound
+	}
+	if err != nil {
+		return session, fmt.Errorf("failed to find session: %v", err)
+	}
+	return session, nil
+}
+
+func (mc *MongoClient) TouchSession(ctx context.Context, id string, lastUsed time.Time) error {
+	collection := mc.client.Database("Media").Collection("sessions")
+	_, err := collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"lastUsed": lastUsed}})
+	if err != nil {
+		return fmt.Errorf("failed to update session: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) DeleteSession(ctx context.Context, id string) error {
+	collection := mc.client.Database("Media").Collection("sessions")
+	_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) PruneSessions(ctx context.Context, now time.Time) error {
+	collection := mc.client.Database("Media").Collection("sessions")
+	_, err := collection.DeleteMany(ctx, bson.M{"expires": bson.M{"$lte": now}})
+	if err != nil {
+		return fmt.Errorf("failed to prune sessions: %v", err)
+	}
+	return nil
+}
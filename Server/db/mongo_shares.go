@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+var ErrUsedUp = errors.New("share link has no views left")
+
+// Share is a link that lets anyone play one entry until it expires. A view is
+// a fetch of the entry's playlist, MaxViews 0 means no limit. Duration is the
+// entry's length in seconds, it bounds how long one view can stream. Revoked
+// shares are kept until they expire, they make up the revoke list
+type Share struct {
+	ID        string     `json:"id" bson:"id"`
+	Owner     string     `json:"owner" bson:"owner"`
+	MediaType string     `json:"mediaType" bson:"mediaType"`
+	EntryID   string     `json:"entryId" bson:"entryId"`
+	Playlist  string     `json:"playlist" bson:"playlist"`
+	MaxViews  int        `json:"maxViews" bson:"maxViews"`
+	Views     int        `json:"views" bson:"views"`
+	Duration  float64    `json:"duration" bson:"duration"`
+	Created   time.Time  `json:"created" bson:"created"`
+	Expires   time.Time  `json:"expires" bson:"expires"`
+	Revoked   *time.Time `json:"revoked,omitempty" bson:"revoked,omitempty"`
+}
+
+func (mc *MongoClient) EnsureShareIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("shares")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created", Value: -1}}},
+		// Mongo drops expired shares on its own
+		{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create share indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) AddShare(ctx context.Context, share Share) error {
+	collection := mc.client.Database("Media").Collection("shares")
+	_, err := collection.InsertOne(ctx, share)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert share: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetShare(ctx context.Context, id string) (Share, error) {
+	collection := mc.client.Database("Media").Collection("shares")
+	var share Share
+	err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&share)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return share, ErrNotFound
+	}
+	if err != nil {
+		return share, fmt.Errorf("failed to find share: %v", err)
+	}
+	return share, nil
+}
+
+// ListShares returns the shares of owner, newest first, or everyone's when
+// owner is empty
+func (mc *MongoClient) ListShares(ctx context.Context, owner string) ([]Share, error) {
+	collection := mc.client.Database("Media").Collection("shares")
+	filter := bson.M{}
+	if owner != "" {
+		filter["owner"] = owner
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}, {Key: "id", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shares: %v", err)
+	}
+	defer cursor.Close(ctx)
+	shares := []Share{}
+	if err := cursor.All(ctx, &shares); err != nil {
+		return nil, fmt.Errorf("failed to decode shares: %v", err)
+	}
+	return shares, nil
+}
+
+func (mc *MongoClient) RevokeShare(ctx context.Context, id string, revoked time.Time) error {
+	collection := mc.client.Database("Media").Collection("shares")
+	filter := bson.M{"id": id, "revoked": bson.M{"$exists": false}}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked": revoked}})
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		// Revoking twice is not an error, revoking nothing is
+		if _, err := mc.GetShare(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountView records a view of a share. It fails with ErrUsedUp once the share
+// has had all its views, the count is never taken past MaxViews
+func (mc *MongoClient) CountView(ctx context.Context, id string) (Share, error) {
+	collection := mc.client.Database("Media").Collection("shares")
+	filter := bson.M{"id": id, "$or": bson.A{
+		bson.M{"maxViews": 0},
+		bson.M{"$expr": bson.M{"$lt": bson.A{"$views", "$maxViews"}}},
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var share Share
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"views": 1}}, opts).Decode(&share)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := mc.GetShare(ctx, id); err != nil {
+			return share, err
+		}
+		return share, ErrUsedUp
+	}
+	if err != nil {
+		return share, fmt.Errorf("failed to count share view: %v", err)
+	}
+	return share, nil
+}
+
+func (mc *MongoClient) PruneShares(ctx context.Context, now time.Time) error {
+	collection := mc.client.Database("Media").Collection("shares")
+	_, err := collection.DeleteMany(ctx, bson.M{"expires": bson.M{"$lte": now}})
+	if err != nil {
+		return fmt.Errorf("failed to prune shares: %v", err)
+	}
+	return nil
+}
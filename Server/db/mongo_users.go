@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type User struct {
+	Username     string    `json:"username" bson:"username"`
+	PasswordHash string    `json:"-" bson:"passwordHash"`
+	Role         string    `json:"role" bson:"role"`
+	Created      time.Time `json:"created" bson:"created"`
+}
+
+func (mc *MongoClient) EnsureUserIndexes(ctx context.Context) error {
+	collection := mc.client.Database("Media").Collection("users")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user indexes: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) AddUser(ctx context.Context, user User) error {
+	collection := mc.client.Database("Media").Collection("users")
+	_, err := collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert user: %v", err)
+	}
+	return nil
+}
+
+func (mc *MongoClient) GetUser(ctx context.Context, username string) (User, error) {
+	collection := mc.client.Database("Media").Collection("users")
+	var user User
+	err := collection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, fmt.Errorf("failed to find user: %v", err)
+	}
+	return user, nil
+}
+
+func (mc *MongoClient) ListUsers(ctx context.Context) ([]User, error) {
+	collection := mc.client.Database("Media").Collection("users")
+	opts := options.Find().SetSort(bson.D{{Key: "username", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %v", err)
+	}
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %v", err)
+	}
+	return users, nil
+}
+
+func (mc *MongoClient) UpdateUser(ctx context.Context, user User) error {
+	collection := mc.client.Database("Media").Collection("users")
+	update := bson.M{"$set": bson.M{
+		"passwordHash": user.PasswordHash,
+		"role":         user.Role,
+	}}
+	result, err := collection.UpdateOne(ctx, bson.M{"username": user.Username}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (mc *MongoClient) DeleteUser(ctx context.Context, username string) error {
+	collection := mc.client.Database("Media").Collection("users")
+	result, err := collection.DeleteOne(ctx, bson.M{"username": username})
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (mc *MongoClient) CountUsers(ctx context.Context) (int64, error) {
+	collection := mc.client.Database("Media").Collection("users")
+	count, err := collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %v", err)
+	}
+	return count, nil
+}
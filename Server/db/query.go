@@ -0,0 +1,185 @@
+package db
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// EntryQuery selects, orders and pages the entries of one media type. The zero
+// value lists every entry in id order
+type EntryQuery struct {
+	// Text holds words that must all appear in the title or description. Mongo
+	// matches whole words and their stems through its text index, so "run"
+	// finds "Running" but not "rerun". The memory and bolt repositories match
+	// any case-insensitive substring and find both
+	Text      string
+	Genre     string
+	Tag       string
+	Directory string
+	// Sort is "id", "title", "added" or "duration", prefixed with "-" for
+	// descending order. Ties are broken by id
+	Sort string
+	// Limit caps the number of entries returned, 0 means no cap
+	Limit int
+	// Cursor is the next cursor returned with the previous page
+	Cursor string
+}
+
+// pageCursor is the position after the last entry of a page. It carries the
+// sort it was made for so it cannot be replayed against another order
+type pageCursor struct {
+	Sort     string    `json:"s"`
+	ID       string    `json:"i"`
+	Title    string    `json:"t,omitempty"`
+	Added    time.Time `json:"a,omitempty"`
+	Duration float64   `json:"d,omitempty"`
+}
+
+var sortFields = map[string]bool{"id": true, "title": true, "added": true, "duration": true}
+
+// sortOrder splits Sort into the field to sort by and the direction
+func (q EntryQuery) sortOrder() (string, bool, error) {
+	field, descending := strings.CutPrefix(q.Sort, "-")
+	if field == "" {
+		field = "id"
+	}
+	if !sortFields[field] {
+		return "", false, fmt.Errorf("%w: cannot sort by %q", ErrInvalidQuery, field)
+	}
+	return field, descending, nil
+}
+
+// cursor decodes Cursor, nil when the query starts at the first page
+func (q EntryQuery) cursor() (*pageCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if cursor.Sort != q.Sort {
+		return nil, fmt.Errorf("%w: the cursor belongs to another sort order", ErrInvalidQuery)
+	}
+	return &cursor, nil
+}
+
+func (q EntryQuery) validate() error {
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	if _, _, err := q.sortOrder(); err != nil {
+		return err
+	}
+	_, err := q.cursor()
+	return err
+}
+
+// textTerms lowercases and splits Text into the words to look for
+func (q EntryQuery) textTerms() []string {
+	return strings.Fields(strings.ToLower(strings.ReplaceAll(q.Text, `"`, " ")))
+}
+
+func newPageCursor(sort string, entry MediaIndexEntry) string {
+	data, _ := json.Marshal(pageCursor{
+		Sort:     sort,
+		ID:       entry.ID,
+		Title:    entry.Title,
+		Added:    entry.Added,
+		Duration: entry.Duration,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// page cuts a result fetched with one entry more than the limit down to the
+// limit, and returns the cursor for the next page if there is one
+func page(entries []MediaIndexEntry, q EntryQuery) ([]MediaIndexEntry, string) {
+	if q.Limit == 0 || len(entries) <= q.Limit {
+		return entries, ""
+	}
+	entries = entries[:q.Limit]
+	return entries, newPageCursor(q.Sort, entries[len(entries)-1])
+}
+
+// matches reports whether an entry passes the filters of a query
+func (q EntryQuery) matches(entry MediaIndexEntry) bool {
+	if q.Genre != "" && !slices.Contains(entry.Genre, q.Genre) {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(entry.Tags, q.Tag) {
+		return false
+	}
+	if q.Directory != "" && entry.Directory != q.Directory {
+		return false
+	}
+	text := strings.ToLower(entry.Title + "\n" + entry.Description)
+	for _, term := range q.textTerms() {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareEntries orders two entries by field and then by id. Titles compare
+// without regard to case, like the collation the Mongo queries use
+func compareEntries(a, b MediaIndexEntry, field string) int {
+	var c int
+	switch field {
+	case "title":
+		c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case "added":
+		c = a.Added.Compare(b.Added)
+	case "duration":
+		c = cmp.Compare(a.Duration, b.Duration)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	return c
+}
+
+// queryEntries runs a query over entries held in memory, for the repositories
+// that do not have a query engine of their own
+func queryEntries(entries []MediaIndexEntry, q EntryQuery) ([]MediaIndexEntry, string, error) {
+	if err := q.validate(); err != nil {
+		return nil, "", err
+	}
+	field, descending, _ := q.sortOrder()
+	cursor, _ := q.cursor()
+	var after *MediaIndexEntry
+	if cursor != nil {
+		after = &MediaIndexEntry{ID: cursor.ID, Title: cursor.Title, Added: cursor.Added, Duration: cursor.Duration}
+	}
+	order := func(a, b MediaIndexEntry) int {
+		if descending {
+			return compareEntries(b, a, field)
+		}
+		return compareEntries(a, b, field)
+	}
+
+	selected := []MediaIndexEntry{}
+	for _, entry := range entries {
+		if q.matches(entry) && (after == nil || order(*after, entry) < 0) {
+			selected = append(selected, entry)
+		}
+	}
+	slices.SortFunc(selected, order)
+	if q.Limit > 0 && len(selected) > q.Limit+1 {
+		selected = selected[:q.Limit+1]
+	}
+	selected, next := page(selected, q)
+	return selected, next, nil
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testRepository(t *testing.T) *MemoryRepository {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []MediaIndexEntry{
+		{ID: "a", Title: "delta", Description: "Running late", Duration: 30, Added: base.Add(3 * time.Hour), Tags: []string{"x"}},
+		{ID: "b", Title: "Alpha", Duration: 10, Added: base.Add(1 * time.Hour), Directory: "shows"},
+		{ID: "c", Title: "charlie", Duration: 20, Added: base.Add(5 * time.Hour), Tags: []string{"x"}},
+		{ID: "d", Title: "Bravo", Description: "a late run", Duration: 20, Added: base.Add(2 * time.Hour), Directory: "shows"},
+		{ID: "e", Title: "echo", Duration: 50, Added: base.Add(4 * time.Hour)},
+	}
+	repo := NewMemoryRepository()
+	for _, entry := range entries {
+		entry.MediaType = "video"
+		if err := repo.AddEntry(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func ids(entries []MediaIndexEntry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.ID)
+	}
+	return result
+}
+
+func TestQueryEntriesPaging(t *testing.T) {
+	repo := testRepository(t)
+	tests := []struct {
+		name  string
+		query EntryQuery
+		want  []string
+	}{
+		{"id order", EntryQuery{}, []string{"a", "b", "c", "d", "e"}},
+		{"title ignores case", EntryQuery{Sort: "title"}, []string{"b", "d", "c", "a", "e"}},
+		{"newest first", EntryQuery{Sort: "-added"}, []string{"c", "e", "a", "d", "b"}},
+		{"duration ties by id", EntryQuery{Sort: "duration"}, []string{"b", "c", "d", "a", "e"}},
+		{"longest first ties by id", EntryQuery{Sort: "-duration"}, []string{"e", "a", "d", "c", "b"}},
+		{"tag", EntryQuery{Tag: "x", Sort: "title"}, []string{"c", "a"}},
+		{"directory", EntryQuery{Directory: "shows"}, []string{"b", "d"}},
+		{"text is a substring", EntryQuery{Text: "run"}, []string{"a", "d"}},
+		{"text needs every word", EntryQuery{Text: "LATE running"}, []string{"a"}},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{0, 1, 2, 3} {
+			query := tt.query
+			query.Limit = limit
+			var got []string
+			for pages := 0; ; pages++ {
+				if pages > len(tt.want)+1 {
+					t.Fatalf("%v, limit %d: paging does not end", tt.name, limit)
+				}
+				page, next, err := repo.QueryEntries(context.Background(), "video", query)
+				if err != nil {
+					t.Fatalf("%v, limit %d: %v", tt.name, limit, err)
+				}
+				if limit > 0 && len(page) > limit {
+					t.Fatalf("%v, limit %d: got a page of %d", tt.name, limit, len(page))
+				}
+				got = append(got, ids(page)...)
+				if next == "" {
+					break
+				}
+				query.Cursor = next
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%v, limit %d: got %v, want %v", tt.name, limit, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestQueryEntriesInvalid(t *testing.T) {
+	repo := testRepository(t)
+	_, next, err := repo.QueryEntries(context.Background(), "video", EntryQuery{Sort: "title", Limit: 2})
+	if err != nil || next == "" {
+		t.Fatalf("got cursor %q, %v", next, err)
+	}
+	tests := []struct {
+		name  string
+		query EntryQuery
+	}{
+		{"unknown sort", EntryQuery{Sort: "rating"}},
+		{"negative limit", EntryQuery{Limit: -1}},
+		{"malformed cursor", EntryQuery{Cursor: "not a cursor"}},
+		{"cursor of another sort", EntryQuery{Sort: "-title", Cursor: next}},
+	}
+	for _, tt := range tests {
+		_, _, err := repo.QueryEntries(context.Background(), "video", tt.query)
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%v: got %v, want ErrInvalidQuery", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+)
+
+// MediaRepository is the catalog of media entries. Entries are addressed by
+// media type and id
+type MediaRepository interface {
+	AddEntry(ctx context.Context, entry MediaIndexEntry) error
+	GetEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error)
+	ListEntries(ctx context.Context, mediaType string) ([]MediaIndexEntry, error)
+	// UpdateEntry applies update to the stored entry and saves the result. If
+	// update returns an error nothing is saved. Implementations may call update
+	// more than once when the entry changes underneath them
+	UpdateEntry(ctx context.Context, mediaType string, id string, update func(*MediaIndexEntry) error) (MediaIndexEntry, error)
+	DeleteEntry(ctx context.Context, mediaType string, id string) (MediaIndexEntry, error)
+	// QueryEntries returns one page of the entries matching query and the cursor
+	// for the next page, empty on the last page. Malformed queries return an
+	// error wrapping ErrInvalidQuery
+	QueryEntries(ctx context.Context, mediaType string, query EntryQuery) ([]MediaIndexEntry, string, error)
+}
+
+// cloneEntry copies an entry so callers never share slices with a stored one
+func cloneEntry(entry MediaIndexEntry) MediaIndexEntry {
+	entry.Genre = append([]string(nil), entry.Genre...)
+	entry.Tags = append([]string(nil), entry.Tags...)
+	entry.Subtitles = append([]SubtitleTrack(nil), entry.Subtitles...)
+	entry.AudioTracks = append([]AudioTrack(nil), entry.AudioTracks...)
+	if entry.Sprite != nil {
+		sprite := *entry.Sprite
+		entry.Sprite = &sprite
+	}
+	return entry
+}
+
+var (
+	_ MediaRepository = (*MongoClient)(nil)
+	_ MediaRepository = (*MemoryRepository)(nil)
+	_ MediaRepository = (*BoltRepository)(nil)
+)
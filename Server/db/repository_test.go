@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// repositories returns an empty instance of every backend that runs without a server
+func repositories(t *testing.T) map[string]MediaRepository {
+	t.Helper()
+	bolt, err := NewBoltRepository(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	return map[string]MediaRepository{"memory": NewMemoryRepository(), "bolt": bolt}
+}
+
+func TestRepositories(t *testing.T) {
+	ctx := context.Background()
+	for name, repo := range repositories(t) {
+		for _, entry := range []MediaIndexEntry{
+			{ID: "a1", Title: "Night Run", MediaType: "video", Tags: []string{"one"}},
+			{ID: "b2", Title: "Morning", Description: "A short RUN", MediaType: "video"},
+			{ID: "c3", Title: "Run", MediaType: "audio"},
+		} {
+			if err := repo.AddEntry(ctx, entry); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		}
+		if err := repo.AddEntry(ctx, MediaIndexEntry{ID: "a1", Title: "Copy", MediaType: "video"}); !errors.Is(err, ErrExists) {
+			t.Errorf("%v: adding a duplicate id: got %v, want ErrExists", name, err)
+		}
+
+		if entry, err := repo.GetEntry(ctx, "video", "a1"); err != nil || entry.Title != "Night Run" || len(entry.Tags) != 1 {
+			t.Errorf("%v: got %+v, %v", name, entry, err)
+		}
+		if _, err := repo.GetEntry(ctx, "audio", "a1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: getting an entry of another media type: got %v, want ErrNotFound", name, err)
+		}
+		if entries, err := repo.ListEntries(ctx, "video"); err != nil || len(entries) != 2 {
+			t.Errorf("%v: got %d entries, %v", name, len(entries), err)
+		}
+		if entries, err := repo.ListEntries(ctx, "image"); err != nil || entries == nil || len(entries) != 0 {
+			t.Errorf("%v: an unknown media type: got %v, %v", name, entries, err)
+		}
+		if entries, _, err := repo.QueryEntries(ctx, "video", EntryQuery{Text: "run"}); err != nil || len(entries) != 2 {
+			t.Errorf("%v: search: got %d entries, %v", name, len(entries), err)
+		}
+
+		failed := errors.New("failed")
+		if _, err := repo.UpdateEntry(ctx, "video", "a1", func(entry *MediaIndexEntry) error {
+			entry.Title = "Changed"
+			return failed
+		}); !errors.Is(err, failed) {
+			t.Errorf("%v: got %v, want the error of the update", name, err)
+		}
+		if entry, _ := repo.GetEntry(ctx, "video", "a1"); entry.Title != "Night Run" {
+			t.Errorf("%v: a failed update was saved: %+v", name, entry)
+		}
+		updated, err := repo.UpdateEntry(ctx, "video", "a1", func(entry *MediaIndexEntry) error {
+			entry.Title = "Day Run"
+			entry.ID, entry.MediaType = "z9", "audio"
+			return nil
+		})
+		if err != nil || updated.ID != "a1" || updated.MediaType != "video" || updated.Title != "Day Run" {
+			t.Errorf("%v: got %+v, %v", name, updated, err)
+		}
+		if _, err := repo.UpdateEntry(ctx, "video", "z9", func(*MediaIndexEntry) error { return nil }); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: updating an unknown id: got %v, want ErrNotFound", name, err)
+		}
+
+		if deleted, err := repo.DeleteEntry(ctx, "video", "a1"); err != nil || deleted.Title != "Day Run" {
+			t.Errorf("%v: got %+v, %v", name, deleted, err)
+		}
+		if _, err := repo.DeleteEntry(ctx, "video", "a1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: deleting twice: got %v, want ErrNotFound", name, err)
+		}
+	}
+}
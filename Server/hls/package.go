@@ -0,0 +1,191 @@
+package hls
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Playlist names tried first when picking the entry point of a package
+var preferredNames = []string{"master.m3u8", "output.m3u8", "index.m3u8"}
+
+// FindEntryPoint returns the slash separated path, relative to root, of the
+// playlist a player should load. Master playlists win over media playlists and
+// playlists referenced by another playlist are never chosen
+func FindEntryPoint(root string) (string, error) {
+	var playlists []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".m3u8") {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			playlists = append(playlists, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(playlists) == 0 {
+		return "", fmt.Errorf("no .m3u8 playlist found")
+	}
+
+	referenced := map[string]bool{}
+	masters := map[string]bool{}
+	for _, rel := range playlists {
+		p, err := ParseFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			continue
+		}
+		if p.Master {
+			masters[rel] = true
+			for _, uri := range p.References() {
+				if target, ok := Resolve(rel, uri); ok {
+					referenced[target] = true
+				}
+			}
+		}
+	}
+
+	var candidates []string
+	for _, rel := range playlists {
+		if !referenced[rel] {
+			candidates = append(candidates, rel)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("every playlist is referenced by another playlist")
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if masters[a] != masters[b] {
+			return masters[a]
+		}
+		if da, db := strings.Count(a, "/"), strings.Count(b, "/"); da != db {
+			return da < db
+		}
+		if pa, pb := preferredRank(a), preferredRank(b); pa != pb {
+			return pa < pb
+		}
+		return a < b
+	})
+	return candidates[0], nil
+}
+
+func preferredRank(rel string) int {
+	name := strings.ToLower(path.Base(rel))
+	for i, preferred := range preferredNames {
+		if name == preferred {
+			return i
+		}
+	}
+	return len(preferredNames)
+}
+
+// References returns every URI the playlist points at: variants, renditions and segments
+func (p *Playlist) References() []string {
+	var uris []string
+	for _, v := range p.Variants {
+		uris = append(uris, v.URI)
+	}
+	for _, r := range p.Renditions {
+		if uri := r.URI(); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	for _, s := range p.Segments {
+		uris = append(uris, s.URI)
+	}
+	return append(uris, p.Resources...)
+}
+
+// Resolve turns a URI found in the playlist at rel into a path relative to the
+// package root. It fails for remote URIs and paths that leave the package
+func Resolve(rel, uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	target := path.Join(path.Dir(rel), u.Path)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", false
+	}
+	return target, true
+}
+
+// Check verifies that the entry point and everything it references exists
+// under root. It returns the duration of the longest rendition and a list of
+// problems, which is empty when the package is playable
+func Check(root, entry string) (float64, []string) {
+	var problems []string
+	p, err := ParseFile(filepath.Join(root, filepath.FromSlash(entry)))
+	if os.IsNotExist(err) {
+		return 0, []string{fmt.Sprintf("%v is missing", entry)}
+	}
+	if err != nil {
+		return 0, []string{fmt.Sprintf("%v: %v", entry, err)}
+	}
+	if !p.Master {
+		return p.Duration(), checkMedia(root, entry, p)
+	}
+
+	if len(p.Variants) == 0 {
+		problems = append(problems, fmt.Sprintf("%v: master playlist has no variants", entry))
+	}
+	duration := 0.0
+	for _, uri := range p.References() {
+		target, ok := Resolve(entry, uri)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v: %q is not inside the package", entry, uri))
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(target))); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %q is missing", entry, uri))
+			continue
+		}
+		if !strings.EqualFold(path.Ext(target), ".m3u8") {
+			continue
+		}
+		media, err := ParseFile(filepath.Join(root, filepath.FromSlash(target)))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", target, err))
+			continue
+		}
+		if media.Master {
+			problems = append(problems, fmt.Sprintf("%v: nested master playlists are not supported", target))
+			continue
+		}
+		problems = append(problems, checkMedia(root, target, media)...)
+		if d := media.Duration(); d > duration {
+			duration = d
+		}
+	}
+	return duration, problems
+}
+
+func checkMedia(root, rel string, p *Playlist) []string {
+	var problems []string
+	if len(p.Segments) == 0 {
+		problems = append(problems, fmt.Sprintf("%v: playlist has no segments", rel))
+	}
+	for _, uri := range p.References() {
+		target, ok := Resolve(rel, uri)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v: %q is not inside the package", rel, uri))
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(target))); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: segment %q is missing", rel, uri))
+		}
+	}
+	return problems
+}
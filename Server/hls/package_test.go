@@ -0,0 +1,148 @@
+package hls
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mediaPlaylist = "#EXTM3U\n#EXTINF:6,\nseg0.ts\n#EXTINF:4,\nseg1.ts\n#EXT-X-ENDLIST\n"
+
+// writePackage creates the files of a package below a temporary root. Files
+// without content are written as a placeholder segment
+func writePackage(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if content == "" {
+			content = "segment"
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestFindEntryPoint(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n360p/index.m3u8\n"
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"single playlist", map[string]string{"show/video.m3u8": mediaPlaylist}, "show/video.m3u8"},
+		{"preferred name", map[string]string{"a.m3u8": mediaPlaylist, "output.m3u8": mediaPlaylist}, "output.m3u8"},
+		{"shallowest", map[string]string{"b/index.m3u8": mediaPlaylist, "a.m3u8": mediaPlaylist}, "a.m3u8"},
+		{"master wins", map[string]string{"output.m3u8": mediaPlaylist, "hls/main.m3u8": master, "hls/360p/index.m3u8": mediaPlaylist}, "hls/main.m3u8"},
+		{"variants are skipped", map[string]string{"index.m3u8": master, "360p/index.m3u8": mediaPlaylist}, "index.m3u8"},
+	}
+	for _, tt := range tests {
+		got, err := FindEntryPoint(writePackage(t, tt.files))
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := FindEntryPoint(writePackage(t, map[string]string{"seg0.ts": ""})); err == nil {
+		t.Error("found an entry point without playlists")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		rel  string
+		uri  string
+		want string
+		ok   bool
+	}{
+		{"master.m3u8", "360p/index.m3u8", "360p/index.m3u8", true},
+		{"360p/index.m3u8", "seg0.ts", "360p/seg0.ts", true},
+		{"360p/index.m3u8", "../audio/seg0.ts", "audio/seg0.ts", true},
+		{"360p/index.m3u8", "seg0.ts?token=1", "360p/seg0.ts", true},
+		{"master.m3u8", "../outside.m3u8", "", false},
+		{"a/index.m3u8", "../../outside.ts", "", false},
+		{"master.m3u8", "/etc/passwd", "", false},
+		{"master.m3u8", "https://cdn.example/index.m3u8", "", false},
+		{"master.m3u8", "//cdn.example/index.m3u8", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Resolve(tt.rel, tt.uri)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Resolve(%q, %q): got %q, %v, want %q, %v", tt.rel, tt.uri, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nlow/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2\nhigh/index.m3u8\n"
+	longer := "#EXTM3U\n#EXTINF:6,\nseg0.ts\n#EXTINF:6,\nseg1.ts\n#EXT-X-ENDLIST\n"
+	tests := []struct {
+		name     string
+		entry    string
+		files    map[string]string
+		duration float64
+		problems []string
+	}{
+		{
+			name:     "media playlist",
+			entry:    "output.m3u8",
+			files:    map[string]string{"output.m3u8": mediaPlaylist, "seg0.ts": "", "seg1.ts": ""},
+			duration: 10,
+		},
+		{
+			name:  "master takes the longest variant",
+			entry: "master.m3u8",
+			files: map[string]string{
+				"master.m3u8": master, "low/index.m3u8": mediaPlaylist, "low/seg0.ts": "", "low/seg1.ts": "",
+				"high/index.m3u8": longer, "high/seg0.ts": "", "high/seg1.ts": "",
+			},
+			duration: 12,
+		},
+		{
+			name:     "missing segment",
+			entry:    "output.m3u8",
+			files:    map[string]string{"output.m3u8": mediaPlaylist, "seg0.ts": ""},
+			problems: []string{`output.m3u8: segment "seg1.ts" is missing`},
+		},
+		{
+			name:     "missing variant",
+			entry:    "master.m3u8",
+			files:    map[string]string{"master.m3u8": master, "low/index.m3u8": mediaPlaylist, "low/seg0.ts": "", "low/seg1.ts": ""},
+			problems: []string{`master.m3u8: "high/index.m3u8" is missing`},
+		},
+		{
+			name:     "escaping segment",
+			entry:    "output.m3u8",
+			files:    map[string]string{"output.m3u8": "#EXTM3U\n#EXTINF:6,\n../seg0.ts\n"},
+			problems: []string{`output.m3u8: "../seg0.ts" is not inside the package`},
+		},
+		{
+			name:     "no segments",
+			entry:    "output.m3u8",
+			files:    map[string]string{"output.m3u8": "#EXTM3U\n#EXT-X-ENDLIST\n"},
+			problems: []string{"output.m3u8: playlist has no segments"},
+		},
+		{
+			name:     "missing entry point",
+			entry:    "output.m3u8",
+			files:    map[string]string{"seg0.ts": ""},
+			problems: []string{"output.m3u8 is missing"},
+		},
+	}
+	for _, tt := range tests {
+		duration, problems := Check(writePackage(t, tt.files), tt.entry)
+		if strings.Join(problems, "\n") != strings.Join(tt.problems, "\n") {
+			t.Errorf("%v: got problems %q, want %q", tt.name, problems, tt.problems)
+			continue
+		}
+		if tt.problems == nil && duration != tt.duration {
+			t.Errorf("%v: got duration %v, want %v", tt.name, duration, tt.duration)
+		}
+	}
+}
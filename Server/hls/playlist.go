@@ -0,0 +1,303 @@
+package hls
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Playlist is a parsed master or media playlist. Only the tags Farnsworth
+// cares about are interpreted, everything else is skipped
+type Playlist struct {
+	Master         bool
+	Version        int
+	TargetDuration float64
+	// IndependentSegments is set by EXT-X-INDEPENDENT-SEGMENTS, which says every
+	// segment starts with a key frame
+	IndependentSegments bool
+	Variants            []Variant
+	Renditions          []Rendition
+	Segments            []Segment
+	// Resources holds URIs referenced from tags rather than segment lines, such as EXT-X-MAP
+	Resources []string
+	// Tags holds the lines of tags that are not interpreted, such as
+	// EXT-X-I-FRAME-STREAM-INF, so WriteMaster can write them back unchanged
+	Tags []string
+}
+
+// Variant is an EXT-X-STREAM-INF entry of a master playlist
+type Variant struct {
+	URI        string
+	Attributes map[string]string
+}
+
+// Rendition is an EXT-X-MEDIA entry of a master playlist
+type Rendition struct {
+	Attributes map[string]string
+}
+
+type Segment struct {
+	URI      string
+	Duration float64
+}
+
+// Duration is the sum of the segment durations of a media playlist
+func (p *Playlist) Duration() float64 {
+	total := 0.0
+	for _, s := range p.Segments {
+		total += s.Duration
+	}
+	return total
+}
+
+func (v Variant) Bandwidth() int {
+	bandwidth, _ := strconv.Atoi(v.Attributes["BANDWIDTH"])
+	return bandwidth
+}
+
+func (r Rendition) Type() string {
+	return r.Attributes["TYPE"]
+}
+
+func (r Rendition) URI() string {
+	return r.Attributes["URI"]
+}
+
+func ParseFile(path string) (*Playlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+func Parse(r io.Reader) (*Playlist, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	p := &Playlist{}
+	first := true
+	var pendingDuration float64
+	var pendingVariant map[string]string
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			if line != "#EXTM3U" {
+				return nil, fmt.Errorf("missing #EXTM3U header")
+			}
+			first = false
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			if pendingVariant != nil {
+				p.Variants = append(p.Variants, Variant{URI: line, Attributes: pendingVariant})
+				pendingVariant = nil
+			} else {
+				p.Segments = append(p.Segments, Segment{URI: line, Duration: pendingDuration})
+				pendingDuration = 0
+			}
+			continue
+		}
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-VERSION":
+			p.Version, _ = strconv.Atoi(value)
+		case "#EXT-X-TARGETDURATION":
+			p.TargetDuration, _ = strconv.ParseFloat(value, 64)
+		case "#EXTINF":
+			durationText, _, _ := strings.Cut(value, ",")
+			duration, err := strconv.ParseFloat(strings.TrimSpace(durationText), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid EXTINF duration %q", lineNo, durationText)
+			}
+			pendingDuration = duration
+		case "#EXT-X-STREAM-INF":
+			p.Master = true
+			pendingVariant = ParseAttributes(value)
+		case "#EXT-X-MEDIA":
+			p.Master = true
+			p.Renditions = append(p.Renditions, Rendition{Attributes: ParseAttributes(value)})
+		case "#EXT-X-I-FRAME-STREAM-INF":
+			p.Master = true
+			if uri := ParseAttributes(value)["URI"]; uri != "" {
+				p.Resources = append(p.Resources, uri)
+			}
+			p.Tags = append(p.Tags, line)
+		case "#EXT-X-MAP", "#EXT-X-KEY":
+			if uri := ParseAttributes(value)["URI"]; uri != "" && !strings.HasPrefix(uri, "skd:") && !strings.HasPrefix(uri, "data:") {
+				p.Resources = append(p.Resources, uri)
+			}
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		default:
+			// Lines starting with # but not #EXT are comments
+			if strings.HasPrefix(tag, "#EXT") {
+				p.Tags = append(p.Tags, line)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, fmt.Errorf("empty playlist")
+	}
+	if p.Master && len(p.Segments) > 0 {
+		return nil, fmt.Errorf("playlist mixes master and media tags")
+	}
+	return p, nil
+}
+
+// ParseAttributes splits an attribute list such as BANDWIDTH=800000,CODECS="avc1,mp4a"
+// into a map, removing the quotes around quoted values
+func ParseAttributes(list string) map[string]string {
+	attrs := map[string]string{}
+	for len(list) > 0 {
+		key, rest, found := strings.Cut(list, "=")
+		if !found {
+			break
+		}
+		key = strings.TrimSpace(key)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, list = rest[1:], ""
+			} else {
+				value, list = rest[1:end+1], rest[end+2:]
+			}
+			list = strings.TrimPrefix(list, ",")
+		} else {
+			value, list, _ = strings.Cut(rest, ",")
+		}
+		attrs[key] = value
+	}
+	return attrs
+}
+
+// Attributes whose values are written as quoted strings
+var quotedAttributes = map[string]bool{
+	"URI": true, "GROUP-ID": true, "LANGUAGE": true, "ASSOC-LANGUAGE": true, "NAME": true,
+	"INSTREAM-ID": true, "CHARACTERISTICS": true, "CHANNELS": true, "CODECS": true,
+	"AUDIO": true, "VIDEO": true, "SUBTITLES": true,
+}
+
+// Attributes written first, in this order, to keep playlists readable
+var attributeOrder = []string{
+	"TYPE", "GROUP-ID", "LANGUAGE", "NAME", "DEFAULT", "AUTOSELECT", "FORCED", "CHANNELS",
+	"BANDWIDTH", "AVERAGE-BANDWIDTH", "RESOLUTION", "FRAME-RATE", "CODECS",
+	"AUDIO", "SUBTITLES", "CLOSED-CAPTIONS", "URI",
+}
+
+// FormatAttributes is the inverse of ParseAttributes
+func FormatAttributes(attrs map[string]string) string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, key := range attributeOrder {
+		if _, ok := attrs[key]; ok {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+	var rest []string
+	for key := range attrs {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	keys = append(keys, rest...)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := attrs[key]
+		if quotedAttributes[key] {
+			value = `"` + value + `"`
+		}
+		parts = append(parts, key+"="+value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// WriteMaster writes the renditions and variants of a master playlist, then
+// the tags it did not interpret in the order they were parsed
+func (p *Playlist) WriteMaster(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	version := p.Version
+	if version == 0 {
+		version = 3
+	}
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	for _, r := range p.Renditions {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:%v\n", FormatAttributes(r.Attributes))
+	}
+	for _, v := range p.Variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%v\n%v\n", FormatAttributes(v.Attributes), v.URI)
+	}
+	for _, tag := range p.Tags {
+		b.WriteString(tag + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMedia writes the segments of a complete VOD media playlist
+func (p *Playlist) WriteMedia(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	version := p.Version
+	if version == 0 {
+		version = 3
+	}
+	target := p.TargetDuration
+	for _, s := range p.Segments {
+		target = math.Max(target, s.Duration)
+	}
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for _, s := range p.Segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%v\n", s.Duration, s.URI)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteFile writes the playlist to path, replacing it atomically
+func (p *Playlist) WriteFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if p.Master {
+		err = p.WriteMaster(f)
+	} else {
+		err = p.WriteMedia(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,155 @@
+package hls
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		err       bool
+		master    bool
+		variants  []string
+		segments  []string
+		duration  float64
+		resources []string
+	}{
+		{
+			name:     "media",
+			text:     "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg0.ts\n#EXTINF:4.5,title\nseg1.ts\n#EXT-X-ENDLIST\n",
+			segments: []string{"seg0.ts", "seg1.ts"},
+			duration: 10.5,
+		},
+		{
+			name:     "byte order mark and blank lines",
+			text:     "\ufeff#EXTM3U\n\n#EXTINF:2,\r\nseg0.ts\r\n",
+			segments: []string{"seg0.ts"},
+			duration: 2,
+		},
+		{
+			name:      "fmp4 media",
+			text:      "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:6,\nseg0.m4s\n",
+			segments:  []string{"seg0.m4s"},
+			duration:  6,
+			resources: []string{"init.mp4", "key.bin"},
+		},
+		{
+			name:      "master",
+			text:      "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",URI=\"en/index.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS=\"avc1,mp4a\"\n360p/index.m3u8\n#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,URI=\"iframes.m3u8\"\n",
+			master:    true,
+			variants:  []string{"360p/index.m3u8"},
+			resources: []string{"iframes.m3u8"},
+		},
+		{name: "empty", text: "", err: true},
+		{name: "missing header", text: "#EXTINF:6,\nseg0.ts\n", err: true},
+		{name: "bad duration", text: "#EXTM3U\n#EXTINF:six,\nseg0.ts\n", err: true},
+		{name: "mixed", text: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nv.m3u8\n#EXTINF:6,\nseg0.ts\n", err: true},
+	}
+	for _, tt := range tests {
+		p, err := Parse(strings.NewReader(tt.text))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		var variants, segments []string
+		for _, v := range p.Variants {
+			variants = append(variants, v.URI)
+		}
+		for _, s := range p.Segments {
+			segments = append(segments, s.URI)
+		}
+		if p.Master != tt.master || !slices.Equal(variants, tt.variants) || !slices.Equal(segments, tt.segments) {
+			t.Errorf("%v: got master %v, variants %v, segments %v", tt.name, p.Master, variants, segments)
+		}
+		if p.Duration() != tt.duration {
+			t.Errorf("%v: got duration %v, want %v", tt.name, p.Duration(), tt.duration)
+		}
+		if !slices.Equal(p.Resources, tt.resources) {
+			t.Errorf("%v: got resources %v, want %v", tt.name, p.Resources, tt.resources)
+		}
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attrs := ParseAttributes(`BANDWIDTH=800000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=640x360,NAME="a=b"`)
+	want := map[string]string{"BANDWIDTH": "800000", "CODECS": "avc1.64001f,mp4a.40.2", "RESOLUTION": "640x360", "NAME": "a=b"}
+	if len(attrs) != len(want) {
+		t.Fatalf("got %v", attrs)
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("%v: got %q, want %q", key, attrs[key], value)
+		}
+	}
+}
+
+func TestFormatAttributes(t *testing.T) {
+	attrs := map[string]string{"URI": "en/index.m3u8", "TYPE": "AUDIO", "GROUP-ID": "aud", "X-CUSTOM": "1", "DEFAULT": "YES", "NAME": "English"}
+	got := FormatAttributes(attrs)
+	want := `TYPE=AUDIO,GROUP-ID="aud",NAME="English",DEFAULT=YES,URI="en/index.m3u8",X-CUSTOM=1`
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	parsed := ParseAttributes(got)
+	if len(parsed) != len(attrs) {
+		t.Fatalf("got %v", parsed)
+	}
+	for key, value := range attrs {
+		if parsed[key] != value {
+			t.Errorf("%v: got %q after a round trip, want %q", key, parsed[key], value)
+		}
+	}
+}
+
+func TestWriteMaster(t *testing.T) {
+	text := "#EXTM3U\n#EXT-X-VERSION:4\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",URI=\"en/index.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS=\"avc1.64001e,mp4a.40.2\",AUDIO=\"aud\"\n360p/index.m3u8\n"
+	p, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := p.WriteMaster(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:4\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",URI=\"en/index.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS=\"avc1.64001e,mp4a.40.2\",AUDIO=\"aud\"\n360p/index.m3u8\n"
+	if b.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", b.String(), want)
+	}
+}
+
+func TestWriteMasterKeepsTags(t *testing.T) {
+	text := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-INDEPENDENT-SEGMENTS\n# a comment\n" +
+		"#EXT-X-SESSION-DATA:DATA-ID=\"com.example\",VALUE=\"1\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000\n360p/index.m3u8\n" +
+		"#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,URI=\"iframes.m3u8\"\n"
+	p, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Renditions = append(p.Renditions, Rendition{Attributes: map[string]string{"TYPE": "SUBTITLES", "GROUP-ID": "subs", "URI": "subs/en/index.m3u8"}})
+	var b strings.Builder
+	if err := p.WriteMaster(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",URI=\"subs/en/index.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000\n360p/index.m3u8\n" +
+		"#EXT-X-SESSION-DATA:DATA-ID=\"com.example\",VALUE=\"1\"\n" +
+		"#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,URI=\"iframes.m3u8\"\n"
+	if b.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", b.String(), want)
+	}
+}
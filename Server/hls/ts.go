@@ -0,0 +1,61 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const tsPacketSize = 188
+
+// FirstPTS returns the presentation timestamp, in 90kHz ticks, of the first
+// audio or video frame in an MPEG-TS segment. WebVTT subtitle segments need it
+// in their X-TIMESTAMP-MAP header to line up with the media
+func FirstPTS(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	packet := make([]byte, tsPacketSize)
+	// The first frame is always near the start, give up after a couple of megabytes
+	for i := 0; i < 10000; i++ {
+		if _, err := io.ReadFull(f, packet); err != nil {
+			return 0, fmt.Errorf("no timestamp found in %v", name)
+		}
+		if packet[0] != 0x47 {
+			return 0, fmt.Errorf("%v is not an MPEG-TS segment", name)
+		}
+		// Only packets starting a PES packet carry its header
+		if packet[1]&0x40 == 0 {
+			continue
+		}
+		adaptation := packet[3] >> 4 & 0x3
+		if adaptation&0x1 == 0 {
+			continue
+		}
+		payload := packet[4:]
+		if adaptation == 0x3 {
+			skip := int(payload[0]) + 1
+			if skip >= len(payload) {
+				continue
+			}
+			payload = payload[skip:]
+		}
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			continue
+		}
+		// Audio and video stream ids, everything else has no use for us
+		if streamID := payload[3]; streamID < 0xC0 || streamID > 0xEF {
+			continue
+		}
+		if payload[7]&0x80 == 0 {
+			continue
+		}
+		p := payload[9:14]
+		pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+		return pts, nil
+	}
+	return 0, fmt.Errorf("no timestamp found in %v", name)
+}
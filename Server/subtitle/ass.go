@@ -0,0 +1,71 @@
+package subtitle
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var assOverride = regexp.MustCompile(`\{[^}]*\}`)
+
+// parseASS reads the Dialogue lines of the [Events] section. Styling and
+// positioning are dropped, WebVTT cannot express most of it anyway
+func parseASS(text string) ([]Cue, error) {
+	var cues []Cue
+	var format []string
+	inEvents := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			format = nil
+			for _, field := range strings.Split(value, ",") {
+				format = append(format, strings.ToLower(strings.TrimSpace(field)))
+			}
+		case "Dialogue":
+			if format == nil {
+				return nil, fmt.Errorf("dialogue before the events format line")
+			}
+			// Text is always last and may itself contain commas
+			fields := strings.SplitN(value, ",", len(format))
+			if len(fields) != len(format) {
+				continue
+			}
+			event := map[string]string{}
+			for i, name := range format {
+				event[name] = strings.TrimSpace(fields[i])
+			}
+			start, err := parseTimestamp(event["start"])
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseTimestamp(event["end"])
+			if err != nil {
+				return nil, err
+			}
+			text := assText(fields[len(fields)-1])
+			if text == "" || end <= start {
+				continue
+			}
+			cues = append(cues, Cue{Start: start, End: end, Text: text})
+		}
+	}
+	return cues, nil
+}
+
+func assText(text string) string {
+	text = assOverride.ReplaceAllString(text, "")
+	text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(text)
+	return strings.TrimSpace(escape(text))
+}
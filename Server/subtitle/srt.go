@@ -0,0 +1,62 @@
+package subtitle
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Tags SRT files use that WebVTT understands
+var srtTag = regexp.MustCompile(`(?i)</?(b|i|u)>`)
+
+// Anything else that looks like a tag, such as <font color=...>, and leftover ASS overrides
+var strayMarkup = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+
+// Cues are separated by blank lines, which may still hold spaces or tabs
+var srtBlockSeparator = regexp.MustCompile(`\n[ \t]*\n`)
+
+func parseSRT(text string) ([]Cue, error) {
+	var cues []Cue
+	for _, block := range srtBlockSeparator.Split(text, -1) {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		timing := -1
+		for i, line := range lines {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		// A block without a timing line is a stray counter or garbage, skip it
+		if timing < 0 {
+			continue
+		}
+		start, end, err := parseTiming(lines[timing])
+		if err != nil {
+			return nil, err
+		}
+		text := srtText(strings.Join(lines[timing+1:], "\n"))
+		if text == "" || end <= start {
+			continue
+		}
+		cues = append(cues, Cue{Start: start, End: end, Text: text})
+	}
+	return cues, nil
+}
+
+// srtText keeps bold, italic and underline and escapes everything else
+func srtText(text string) string {
+	var kept []string
+	text = srtTag.ReplaceAllStringFunc(text, func(tag string) string {
+		kept = append(kept, strings.ToLower(tag))
+		return "\x00"
+	})
+	text = escape(strayMarkup.ReplaceAllString(text, ""))
+	for _, tag := range kept {
+		text = strings.Replace(text, "\x00", tag, 1)
+	}
+	return strings.TrimSpace(text)
+}
+
+// escape makes plain text safe to use as WebVTT cue text
+func escape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
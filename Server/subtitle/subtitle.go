@@ -0,0 +1,144 @@
+// Package subtitle reads SRT, ASS/SSA and WebVTT subtitles and writes them back
+// out as WebVTT, split into segments for HLS subtitle renditions
+package subtitle
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cue is a single subtitle. Times are in seconds from the start of the media
+// and Text is WebVTT cue text
+type Cue struct {
+	Start float64
+	End   float64
+	Text  string
+}
+
+// Parse decodes a subtitle file, picking the format from the extension of name
+func Parse(name string, data []byte) ([]Cue, error) {
+	text := decode(data)
+	var cues []Cue
+	var err error
+	switch strings.ToLower(path.Ext(name)) {
+	case ".srt":
+		cues, err = parseSRT(text)
+	case ".ass", ".ssa":
+		cues, err = parseASS(text)
+	case ".vtt":
+		cues, err = parseVTT(text)
+	default:
+		return nil, fmt.Errorf("unsupported subtitle format %q", path.Ext(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("no cues found")
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+// decode strips the byte order mark and line endings, and treats anything that
+// is not valid UTF-8 as Latin-1, which is what most old SRT files are
+func decode(data []byte) string {
+	var text string
+	if utf8.Valid(data) {
+		text = string(data)
+	} else {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// parseTimestamp reads hh:mm:ss.fff, mm:ss.fff or h:mm:ss.cc, with either a dot or a comma
+func parseTimestamp(s string) (float64, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", ".")
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	total := 0.0
+	for _, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		total = total*60 + value
+	}
+	return total, nil
+}
+
+// parseTiming reads a "start --> end" line, ignoring any cue settings after it
+func parseTiming(line string) (float64, float64, error) {
+	start, rest, found := strings.Cut(line, "-->")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid timing line %q", line)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("invalid timing line %q", line)
+	}
+	s, err := parseTimestamp(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	e, err := parseTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	return s, e, nil
+}
+
+// FormatTimestamp formats seconds as hh:mm:ss.ttt
+func FormatTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// WriteVTT writes cues as a WebVTT file. Header lines, such as X-TIMESTAMP-MAP,
+// go straight after the signature
+func WriteVTT(w io.Writer, cues []Cue, header ...string) error {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, line := range header {
+		b.WriteString(line + "\n")
+	}
+	for _, c := range cues {
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", FormatTimestamp(c.Start), FormatTimestamp(c.End), c.Text)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Segment splits cues into consecutive windows of length seconds covering
+// duration. A cue that spans a boundary is repeated in every window it touches,
+// as players drop the duplicates
+func Segment(cues []Cue, duration, length float64) [][]Cue {
+	count := int(math.Ceil(duration / length))
+	if count < 1 {
+		count = 1
+	}
+	segments := make([][]Cue, count)
+	for _, c := range cues {
+		first := int(c.Start / length)
+		last := int(math.Ceil(c.End/length)) - 1
+		for i := max(first, 0); i <= last && i < count; i++ {
+			segments[i] = append(segments[i], c)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,144 @@
+package subtitle
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		text string
+		want []Cue
+		err  bool
+	}{
+		{
+			name: "srt",
+			file: "movie.en.srt",
+			text: "1\r\n00:00:01,000 --> 00:00:02,500\r\n<i>Hello</i> & <font color=\"red\">bye</font>\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\nTwo\r\nlines\r\n",
+			want: []Cue{{1, 2.5, "<i>Hello</i> &amp; bye"}, {3, 4, "Two\nlines"}},
+		},
+		{
+			name: "srt out of order with a byte order mark",
+			file: "movie.SRT",
+			text: "\ufeff2\n00:00:05,000 --> 00:00:06,000\nLater\n\n1\n00:00:01,000 --> 00:00:02,000\nEarlier\n",
+			want: []Cue{{1, 2, "Earlier"}, {5, 6, "Later"}},
+		},
+		{
+			name: "srt skips empty and backwards cues",
+			file: "movie.srt",
+			text: "1\n00:00:01,000 --> 00:00:02,000\n\n\n2\n00:00:04,000 --> 00:00:03,000\nBackwards\n\n3\n00:00:05,000 --> 00:00:06,000\nKept\n",
+			want: []Cue{{5, 6, "Kept"}},
+		},
+		{
+			name: "srt with spaces on the blank lines",
+			file: "movie.srt",
+			text: "1\n00:00:01,000 --> 00:00:02,000\nOne\n \t\n2\n00:00:03,000 --> 00:00:04,000\nTwo\n",
+			want: []Cue{{1, 2, "One"}, {3, 4, "Two"}},
+		},
+		{
+			name: "ass",
+			file: "movie.ass",
+			text: "[Script Info]\nTitle: x\n\n[Events]\nFormat: Layer, Start, End, Style, Text\n" +
+				"Dialogue: 0,0:00:01.50,0:00:03.00,Default,{\\i1}Hi{\\i0}, there\\Nfriend <3\n" +
+				"Comment: 0,0:00:04.00,0:00:05.00,Default,ignored\n",
+			want: []Cue{{1.5, 3, "Hi, there\nfriend &lt;3"}},
+		},
+		{
+			name: "vtt",
+			file: "movie.vtt",
+			text: "WEBVTT\n\nNOTE a comment\n\ncue-1\n00:01.000 --> 00:02.000 align:start\n<b>Bold</b>\n\n00:00:03.000 --> 00:00:04.000\nPlain\n",
+			want: []Cue{{1, 2, "<b>Bold</b>"}, {3, 4, "Plain"}},
+		},
+		{
+			name: "latin-1",
+			file: "movie.srt",
+			text: "1\n00:00:01,000 --> 00:00:02,000\nCaf\xe9\n",
+			want: []Cue{{1, 2, "Café"}},
+		},
+		{name: "unsupported format", file: "movie.sub", text: "{1}{2}Hi", err: true},
+		{name: "vtt without header", file: "movie.vtt", text: "00:01.000 --> 00:02.000\nHi\n", err: true},
+		{name: "bad timestamp", file: "movie.srt", text: "1\n00:00:aa,000 --> 00:00:02,000\nHi\n", err: true},
+		{name: "ass dialogue before format", file: "movie.ass", text: "[Events]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,Hi\n", err: true},
+		{name: "no cues", file: "movie.srt", text: "just text\n", err: true},
+	}
+	for _, tt := range tests {
+		cues, err := Parse(tt.file, []byte(tt.text))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v", tt.name, cues)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(cues, tt.want) {
+			t.Errorf("%v: got %+v, want %+v", tt.name, cues, tt.want)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		err  bool
+	}{
+		{in: "01:02:03.456", want: 3723.456},
+		{in: "01:02:03,456", want: 3723.456},
+		{in: "02:03.5", want: 123.5},
+		{in: "0:00:01.25", want: 1.25},
+		{in: "3", err: true},
+		{in: "1:2:3:4", err: true},
+		{in: "00:-1:00", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if tt.err != (err != nil) || got != tt.want {
+			t.Errorf("parseTimestamp(%q): got %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestWriteVTT(t *testing.T) {
+	var b strings.Builder
+	cues := []Cue{{1, 2.5, "One"}, {3661.001, 3662, "Two"}}
+	if err := WriteVTT(&b, cues, "X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000"); err != nil {
+		t.Fatal(err)
+	}
+	want := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n" +
+		"\n00:00:01.000 --> 00:00:02.500\nOne\n" +
+		"\n01:01:01.001 --> 01:01:02.000\nTwo\n"
+	if b.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", b.String(), want)
+	}
+	parsed, err := Parse("out.vtt", []byte(b.String()))
+	if err != nil || !slices.Equal(parsed, cues) {
+		t.Errorf("round trip: got %v, %v", parsed, err)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	cues := []Cue{{1, 2, "a"}, {5, 7, "spans"}, {12, 13, "last"}, {20, 21, "after the end"}}
+	got := Segment(cues, 14, 6)
+	want := [][]string{{"a", "spans"}, {"spans"}, {"last"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(got), len(want))
+	}
+	for i, segment := range got {
+		var texts []string
+		for _, c := range segment {
+			texts = append(texts, c.Text)
+		}
+		if !slices.Equal(texts, want[i]) {
+			t.Errorf("segment %d: got %v, want %v", i, texts, want[i])
+		}
+	}
+	if got := Segment(nil, 0, 6); len(got) != 1 {
+		t.Errorf("empty media: got %d segments", len(got))
+	}
+}
@@ -0,0 +1,39 @@
+package subtitle
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseVTT reads the cues of a WebVTT file. Cue text is already WebVTT so it is kept as is
+func parseVTT(text string) ([]Cue, error) {
+	blocks := strings.Split(text, "\n\n")
+	if !strings.HasPrefix(blocks[0], "WEBVTT") {
+		return nil, fmt.Errorf("missing WEBVTT header")
+	}
+	var cues []Cue
+	for _, block := range blocks[1:] {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// NOTE, STYLE and REGION blocks have no timing line and are dropped
+		timing := -1
+		for i, line := range lines {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 || timing > 1 {
+			continue
+		}
+		start, end, err := parseTiming(lines[timing])
+		if err != nil {
+			return nil, err
+		}
+		text := strings.TrimSpace(strings.Join(lines[timing+1:], "\n"))
+		if text == "" || end <= start {
+			continue
+		}
+		cues = append(cues, Cue{Start: start, End: end, Text: text})
+	}
+	return cues, nil
+}
@@ -3,7 +3,7 @@ import React, { useState, useEffect } from 'react';
 import logo from './Ancom_flag.svg';
 import './App.css';
 import { Button } from "@mui/material";
-import { login } from "./api";
+import { login, logout } from "./api";
 import { ThemeProvider, createTheme } from '@mui/material/styles';
 import CssBaseline from '@mui/material/CssBaseline';
 import MediaManager from "./components/MediaManager";
@@ -34,7 +34,8 @@ function App() {
     };
 
     const handleLogout = () => {
-        // Clear the auth-token cookie
+        // Revoke the session on the server, then clear the auth-token cookie
+        logout().catch(e => console.error("Logout failed", e));
         document.cookie = 'auth-token=; expires=Thu, 01 Jan 1970 00:00:00 UTC; path=/;';
         setIsLoggedIn(false);
     };
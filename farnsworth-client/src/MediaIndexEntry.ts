@@ -1,3 +1,27 @@
+export interface SpriteSheet {
+    uri: string;
+    columns: number;
+    rows: number;
+    width: number;
+    height: number;
+    count: number;
+    interval: number;
+}
+
+export interface SubtitleTrack {
+    language: string;
+    name: string;
+    uri: string;
+    forced?: boolean;
+}
+
+export interface AudioTrack {
+    language?: string;
+    name: string;
+    uri?: string;
+    default?: boolean;
+}
+
 export interface MediaIndexEntry {
     id: string | number;
     title: string;
@@ -7,5 +31,14 @@ export interface MediaIndexEntry {
     directory: string;
     location: string;
     mediaType: string;
+    playlist?: string;
+    duration?: number;
+    poster?: string;
+    sprite?: SpriteSheet;
+    thumbnails?: string;
+    subtitles?: SubtitleTrack[];
+    audioTracks?: AudioTrack[];
+    added?: string;
+    missing?: boolean;
     isDirectory?: boolean;
 }
\ No newline at end of file
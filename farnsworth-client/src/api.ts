@@ -83,11 +83,45 @@ export async function listEntries(mediaType: string): Promise<MediaIndexEntry[]>
     if (Array.isArray(data) && data.every(item => typeof item === 'string')) {
         return data.map((item, index) => objectifyDir(item, index,mediaType));
     } else if (Array.isArray(data)) { // Assuming it's an array of objects otherwise
-        return data.map((item, index)=>{return {...item, id: index}});
+        return data.map((item, index)=>{return {...item, id: item.id ?? index}});
     } else {
         throw new Error('Invalid data format received from server');
     }
 }
+export interface EntryQuery {
+    q?: string;
+    genre?: string;
+    tag?: string;
+    directory?: string;
+    sort?: string;
+    limit?: number;
+    cursor?: string;
+}
+
+export interface EntryPage {
+    entries: MediaIndexEntry[];
+    nextCursor?: string;
+}
+
+// Searches, filters and pages entries on the server
+export async function queryEntries(mediaType: string, query: EntryQuery): Promise<EntryPage> {
+    const params = new URLSearchParams({mType: mediaType, limit: String(query.limit ?? 100)});
+    Object.entries(query).forEach(([key, value]) => {
+        if (value !== undefined && value !== '') {
+            params.set(key, String(value));
+        }
+    });
+    const response = await fetch(`${API_BASE_URL}/dir/?${params}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    const page: EntryPage = await response.json();
+    return {...page, entries: page.entries ?? []};
+}
 function objectifyDir(dir: string, index: number, mType: string) :MediaIndexEntry {
     return {
         id:index,
@@ -104,6 +138,15 @@ export function login() {
     window.location.href = `${API_BASE_URL}/login/`;
 }
 
+export async function logout(): Promise<void> {
+    await fetch(`${API_BASE_URL}/logout/`, {
+        method: 'POST',
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+}
+
 export function savePlaylistToLocalStorage(urls: string[]): void {
     localStorage.setItem('playlistUrls', JSON.stringify(urls));
 }
@@ -121,9 +164,350 @@ export function extractDirectoryName(url: string): string {
     return parts[dirIndex] || url;
 }
 
-export async function deleteEntry(title: string, mType: string): Promise<void> {
-    const encodedTitle = encodeURIComponent(title); // Encode the title for URLs
-    const url = `${API_BASE_URL}/delete/?mType=${mType}&title=${encodedTitle}`;
+export async function fetchArtwork(mediaType: string, dir: string, file: string): Promise<string> {
+    const response = await fetch(`${API_BASE_URL}/artwork/${mediaType}/${encodeURIComponent(dir)}/${file}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error('Failed to fetch artwork');
+    }
+    return URL.createObjectURL(await response.blob());
+}
+
+export interface ThumbnailCue {
+    start: number;
+    end: number;
+    image: string;
+    x: number;
+    y: number;
+    w: number;
+    h: number;
+}
+
+function parseVttTime(t: string): number {
+    const parts = t.trim().split(':').map(parseFloat);
+    return parts.reduce((acc, p) => acc * 60 + p, 0);
+}
+
+// Loads the thumbnails.vtt track of a package and resolves its sprite sheets to blob urls
+export async function loadThumbnailTrack(packageUrl: string): Promise<ThumbnailCue[]> {
+    const headers = { 'Authorization': `Bearer ${getAuthToken() || ''}` };
+    const trackUrl = new URL('thumbnails.vtt', packageUrl);
+    const response = await fetch(trackUrl.toString(), { headers });
+    if (!response.ok) {
+        return [];
+    }
+    const text = await response.text();
+    const images = new Map<string, string>();
+    const cues: ThumbnailCue[] = [];
+    for (const block of text.split(/\r?\n\r?\n/)) {
+        const lines = block.trim().split(/\r?\n/);
+        const timing = lines.findIndex(l => l.includes('-->'));
+        if (timing < 0 || !lines[timing + 1]) {
+            continue;
+        }
+        const [start, end] = lines[timing].split('-->');
+        const [file, fragment] = lines[timing + 1].split('#xywh=');
+        if (!fragment) {
+            continue;
+        }
+        const [x, y, w, h] = fragment.split(',').map(Number);
+        const imageUrl = new URL(file, trackUrl).toString();
+        if (!images.has(imageUrl)) {
+            const image = await fetch(imageUrl, { headers });
+            images.set(imageUrl, image.ok ? URL.createObjectURL(await image.blob()) : '');
+        }
+        cues.push({ start: parseVttTime(start), end: parseVttTime(end), image: images.get(imageUrl) || '', x, y, w, h });
+    }
+    return cues;
+}
+
+export interface FolderInfo {
+    name: string;
+    path: string;
+    entries: number;
+    total: number;
+}
+
+export interface FolderListing {
+    path: string;
+    folders: FolderInfo[];
+    entries: MediaIndexEntry[];
+}
+
+export async function listFolder(mediaType: string, folder: string): Promise<FolderListing> {
+    const response = await fetch(`${API_BASE_URL}/folders/?mType=${mediaType}&path=${encodeURIComponent(folder)}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+// Moves entries and whole folders into the folder `to`, returns how many entries moved
+export async function moveToFolder(mediaType: string, to: string, entries: string[], folders: string[] = []): Promise<number> {
+    return postFolderChange(`move?mType=${mediaType}`, {entries, folders, to});
+}
+
+export async function renameFolder(mediaType: string, folder: string, name: string): Promise<number> {
+    return postFolderChange(`rename?mType=${mediaType}`, {path: folder, name});
+}
+
+async function postFolderChange(action: string, body: object): Promise<number> {
+    const response = await fetch(`${API_BASE_URL}/folders/${action}`, {
+        method: 'POST',
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`,
+            'Content-Type': 'application/json'
+        },
+        body: JSON.stringify(body)
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    const result = await response.json();
+    return result.moved;
+}
+
+export interface Progress {
+    mediaType: string;
+    entryId: string;
+    position: number;
+    duration: number;
+    watched: boolean;
+    updated: string;
+}
+
+export interface ContinueItem extends Progress {
+    entry: MediaIndexEntry;
+}
+
+// Finds the entry a /media/<type>/<id>/... playlist URL belongs to
+export function entryFromMediaUrl(url: string): { mediaType: string, id: string } | null {
+    const match = url.match(/\/media\/([^/]+)\/([^/]+)\//);
+    return match ? { mediaType: match[1], id: decodeURIComponent(match[2]) } : null;
+}
+
+export async function getProgress(mediaType: string, id: string): Promise<Progress> {
+    const response = await fetch(`${API_BASE_URL}/progress/${mediaType}/${encodeURIComponent(id)}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+export async function saveProgress(mediaType: string, id: string, position: number, duration?: number, watched?: boolean): Promise<Progress> {
+    const response = await fetch(`${API_BASE_URL}/progress/${mediaType}/${encodeURIComponent(id)}`, {
+        method: 'PUT',
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`,
+            'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({position, duration, watched})
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+export async function continueWatching(limit = 20): Promise<ContinueItem[]> {
+    const response = await fetch(`${API_BASE_URL}/progress/continue?limit=${limit}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+export interface PlaylistItem {
+    mediaType: string;
+    entryId: string;
+    entry?: MediaIndexEntry;
+}
+
+export interface ServerPlaylist {
+    id: string;
+    owner: string;
+    name: string;
+    items: PlaylistItem[];
+    created: string;
+    updated: string;
+}
+
+async function playlistRequest<T>(path: string, method = 'GET', body?: unknown): Promise<T> {
+    const response = await fetch(`${API_BASE_URL}/playlists/${path}`, {
+        method,
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`,
+            'Content-Type': 'application/json'
+        },
+        body: body === undefined ? undefined : JSON.stringify(body)
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.status === 204 ? (undefined as T) : response.json();
+}
+
+export function listPlaylists(): Promise<ServerPlaylist[]> {
+    return playlistRequest('');
+}
+
+export function getPlaylist(id: string): Promise<ServerPlaylist> {
+    return playlistRequest(encodeURIComponent(id));
+}
+
+export function createPlaylist(name: string, items: PlaylistItem[]): Promise<ServerPlaylist> {
+    return playlistRequest('', 'POST', {name, items});
+}
+
+export function updatePlaylist(id: string, name: string, items: PlaylistItem[]): Promise<ServerPlaylist> {
+    return playlistRequest(encodeURIComponent(id), 'PUT', {name, items});
+}
+
+export function deletePlaylist(id: string): Promise<void> {
+    return playlistRequest(encodeURIComponent(id), 'DELETE');
+}
+
+// Uploads a playlist.json URL array, such as the one kept in localStorage, as a server playlist
+export function importPlaylist(name: string, urls: string[]): Promise<{ playlist: ServerPlaylist, unresolved: string[] }> {
+    return playlistRequest(`import?name=${encodeURIComponent(name)}`, 'POST', urls);
+}
+
+export function exportPlaylist(id: string): Promise<string[]> {
+    return playlistRequest(`${encodeURIComponent(id)}/export`);
+}
+
+// Downloads a playlist file for external players. params picks what goes in it:
+// {playlist: id}, or {mType, folder, q, genre, tag, directory, sort}
+export async function downloadPlaylistFile(format: 'm3u' | 'm3u8' | 'xspf', params: Record<string, string>): Promise<Blob> {
+    const query = new URLSearchParams({...params, format});
+    const response = await fetch(`${API_BASE_URL}/export/?${query}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.blob();
+}
+
+export interface Feed {
+    id: string;
+    owner: string;
+    title: string;
+    description: string;
+    directory?: string;
+    tag?: string;
+    order: 'title' | 'added';
+    created: string;
+    // Only present when the feed is created or its secret rotated
+    url?: string;
+}
+
+async function feedRequest<T>(path: string, method = 'GET', body?: unknown): Promise<T> {
+    const response = await fetch(`${API_BASE_URL}/feeds/${path}`, {
+        method,
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`,
+            'Content-Type': 'application/json'
+        },
+        body: body === undefined ? undefined : JSON.stringify(body)
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.status === 204 ? (undefined as T) : response.json();
+}
+
+export function listFeeds(): Promise<Feed[]> {
+    return feedRequest('');
+}
+
+export function createFeed(feed: Pick<Feed, 'title' | 'description' | 'directory' | 'tag' | 'order'>): Promise<Feed> {
+    return feedRequest('', 'POST', feed);
+}
+
+export function rotateFeed(id: string): Promise<Feed> {
+    return feedRequest(`${encodeURIComponent(id)}/rotate`, 'POST');
+}
+
+export function deleteFeed(id: string): Promise<void> {
+    return feedRequest(encodeURIComponent(id), 'DELETE');
+}
+
+export interface ShareLink {
+    id: string;
+    owner: string;
+    mediaType: string;
+    entryId: string;
+    playlist: string;
+    maxViews: number;
+    views: number;
+    created: string;
+    expires: string;
+    revoked?: string;
+    url: string;
+}
+
+// Makes a link anyone can play the entry with, for ttl (such as "48h") and at most maxViews times, 0 for unlimited
+export async function shareEntry(mediaType: string, entryId: string, ttl?: string, maxViews = 0): Promise<ShareLink> {
+    const response = await fetch(`${API_BASE_URL}/shares/`, {
+        method: 'POST',
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`,
+            'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({mediaType, entryId, ttl, maxViews})
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+export async function listShares(revoked?: boolean): Promise<ShareLink[]> {
+    const query = revoked === undefined ? '' : `?revoked=${revoked}`;
+    const response = await fetch(`${API_BASE_URL}/shares/${query}`, {
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+export async function revokeShare(id: string): Promise<ShareLink> {
+    const response = await fetch(`${API_BASE_URL}/shares/${encodeURIComponent(id)}/revoke`, {
+        method: 'POST',
+        headers: {
+            'Authorization': `Bearer ${getAuthToken() || ''}`
+        }
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+export async function deleteEntry(id: string, mType: string): Promise<void> {
+    const url = `${API_BASE_URL}/delete/?mType=${mType}&id=${encodeURIComponent(id)}`;
 
     const response = await fetch(url, {
         headers: {
@@ -1,6 +1,6 @@
 import React, {useRef, useEffect, useState} from 'react';
 import Hls from 'hls.js';
-import { Dialog, DialogContent } from '@mui/material';
+import { Box, Dialog, DialogContent, MenuItem, Select } from '@mui/material';
 import * as API from "../api"
 
 interface HLSPlayerProps {
@@ -14,6 +14,44 @@ interface HLSPlayerProps {
 const HLSPlayer: React.FC<HLSPlayerProps> = ({ src, visible, onClose, onEnded }) => {
     const videoRef = useRef<HTMLVideoElement | null>(null);
     const [isVideoReady, setVideoReady] = useState(false);
+    const hlsRef = useRef<Hls | null>(null);
+    const [audioTracks, setAudioTracks] = useState<{ id: number, name: string }[]>([]);
+    const [audioTrack, setAudioTrack] = useState(0);
+    const [thumbnails, setThumbnails] = useState<API.ThumbnailCue[]>([]);
+    const [preview, setPreview] = useState<{ cue: API.ThumbnailCue, left: number } | null>(null);
+
+    useEffect(() => {
+        setThumbnails([]);
+        // The thumbnail track sits at the root of the package, next to the poster
+        const packageUrl = src.match(/^.*\/media\/[^/]+\/[^/]+\//);
+        if (!visible || !packageUrl) {
+            return;
+        }
+        API.loadThumbnailTrack(packageUrl[0]).then(setThumbnails).catch(e => console.log(e));
+    }, [src, visible]);
+
+    function scrubTime(event: React.MouseEvent<HTMLDivElement>): { time: number, left: number } | null {
+        const video = videoRef.current;
+        if (!video || !video.duration) {
+            return null;
+        }
+        const rect = event.currentTarget.getBoundingClientRect();
+        const left = Math.min(Math.max(event.clientX - rect.left, 0), rect.width);
+        return { time: (left / rect.width) * video.duration, left };
+    }
+
+    function handleScrubMove(event: React.MouseEvent<HTMLDivElement>): void {
+        const pos = scrubTime(event);
+        const cue = pos && thumbnails.find(c => pos.time >= c.start && pos.time < c.end);
+        setPreview(pos && cue ? { cue, left: pos.left } : null);
+    }
+
+    function handleScrubClick(event: React.MouseEvent<HTMLDivElement>): void {
+        const pos = scrubTime(event);
+        if (pos && videoRef.current) {
+            videoRef.current.currentTime = pos.time;
+        }
+    }
 
     useEffect(() => {
         if (videoRef.current) {
@@ -41,6 +79,44 @@ const HLSPlayer: React.FC<HLSPlayerProps> = ({ src, visible, onClose, onEnded })
     }, [src, visible, isVideoReady]);
 
 
+    // Resume where the user left off and keep the server posted on the position
+    useEffect(() => {
+        const entry = API.entryFromMediaUrl(src);
+        const video = videoRef.current;
+        if (!visible || !entry || !video) {
+            return;
+        }
+        let lastSaved = 0;
+        const save = () => {
+            if (video.currentTime > 0) {
+                lastSaved = Date.now();
+                API.saveProgress(entry.mediaType, entry.id, video.currentTime, video.duration || undefined).catch(e => console.log(e));
+            }
+        };
+        const onTimeUpdate = () => {
+            if (Date.now() - lastSaved > 10000) {
+                save();
+            }
+        };
+        API.getProgress(entry.mediaType, entry.id).then(progress => {
+            if (progress.position > 0 && !progress.watched) {
+                const seek = () => { video.currentTime = progress.position; };
+                if (video.readyState >= 1) {
+                    seek();
+                } else {
+                    video.addEventListener('loadedmetadata', seek, { once: true });
+                }
+            }
+        }).catch(e => console.log(e));
+        video.addEventListener('timeupdate', onTimeUpdate);
+        video.addEventListener('pause', save);
+        return () => {
+            save();
+            video.removeEventListener('timeupdate', onTimeUpdate);
+            video.removeEventListener('pause', save);
+        };
+    }, [src, visible, isVideoReady]);
+
     function handleVideoOpen(): void {
         if (src && videoRef.current) {
             videoRef.current.addEventListener('ended', onEnded);
@@ -51,6 +127,13 @@ const HLSPlayer: React.FC<HLSPlayerProps> = ({ src, visible, onClose, onEnded })
                         console.log('Authorization header set');
                     },
                 });
+                hlsRef.current?.destroy();
+                hlsRef.current = hls;
+                hls.on(Hls.Events.AUDIO_TRACKS_UPDATED, (_, data) => {
+                    setAudioTracks(data.audioTracks.map((t, i) => ({ id: i, name: t.name || t.lang || `Track ${i + 1}` })));
+                    setAudioTrack(hls.audioTrack);
+                });
+                hls.on(Hls.Events.AUDIO_TRACK_SWITCHED, (_, data) => setAudioTrack(data.id));
                 hls.loadSource(src);
                 hls.attachMedia(videoRef.current);
                 hls.on(Hls.Events.MANIFEST_PARSED, () => {
@@ -81,6 +164,42 @@ const HLSPlayer: React.FC<HLSPlayerProps> = ({ src, visible, onClose, onEnded })
                     handleVideoOpen();
                 }} controls style={{ width: '100%', height: 'auto' }}>
                 </video>
+                {audioTracks.length > 1 && (
+                    <Select
+                        size="small"
+                        value={audioTrack}
+                        onChange={(event) => {
+                            if (hlsRef.current) {
+                                hlsRef.current.audioTrack = Number(event.target.value);
+                            }
+                        }}
+                        sx={{ mt: 1 }}
+                    >
+                        {audioTracks.map(t => <MenuItem key={t.id} value={t.id}>{t.name}</MenuItem>)}
+                    </Select>
+                )}
+                {thumbnails.length > 0 && (
+                    <Box
+                        sx={{ position: 'relative', height: 12, mt: 1, bgcolor: 'grey.300', cursor: 'pointer' }}
+                        onMouseMove={handleScrubMove}
+                        onMouseLeave={() => setPreview(null)}
+                        onClick={handleScrubClick}
+                    >
+                        {preview && (
+                            <Box sx={{
+                                position: 'absolute',
+                                bottom: 16,
+                                left: preview.left - preview.cue.w / 2,
+                                width: preview.cue.w,
+                                height: preview.cue.h,
+                                backgroundImage: `url(${preview.cue.image})`,
+                                backgroundPosition: `-${preview.cue.x}px -${preview.cue.y}px`,
+                                border: '1px solid #fff',
+                                pointerEvents: 'none',
+                            }}/>
+                        )}
+                    </Box>
+                )}
             </DialogContent>
         </Dialog>
     );
@@ -1,8 +1,10 @@
 import React, { useState, useEffect } from 'react';
 import {
     listEntries,
+    queryEntries,
     extractDirectoryName,
     deleteEntry,
+    fetchArtwork,
     API_BASE_URL
 } from '../api';
 import {DataGrid, GridColDef, GridRowSelectionModel, GridActionsCellItem, GridRowParams} from '@mui/x-data-grid';
@@ -28,6 +30,22 @@ interface MediaLibraryProps {
     setPlaylistUrls: React.Dispatch<React.SetStateAction<string[]>>;
 }
 
+// The artwork route needs the bearer token, so posters are fetched rather than linked
+const Poster: React.FC<{ entry: MediaIndexEntry }> = ({ entry }) => {
+    const [src, setSrc] = useState<string | null>(null);
+    useEffect(() => {
+        if (!entry.poster || !entry.location) {
+            return;
+        }
+        let url = '';
+        fetchArtwork(entry.mediaType || 'video', extractDirectoryName(entry.location), entry.poster)
+            .then(u => { url = u; setSrc(u); })
+            .catch(e => console.log(e));
+        return () => { if (url) URL.revokeObjectURL(url); };
+    }, [entry.poster, entry.location, entry.mediaType]);
+    return src ? <img src={src} alt={entry.title} style={{height: 48}}/> : null;
+};
+
 const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist, playlistUrls, setPlaylistUrls }) => {
     const [mediaType, setMediaType] = useState<'video' | 'audio'>('video');
     const [entries, setEntries] = useState<MediaIndexEntry[]>([]);
@@ -37,6 +55,7 @@ const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist
     const [searchQuery, setSearchQuery] = useState('');  // State for search query
     const [currentDirectory, setCurrentDirectory] = useState('');  // State for search query
     const [filteredEntries, setFilteredEntries] = useState<MediaIndexEntry[]>([]); // State for filtered entries
+    const [searchResults, setSearchResults] = useState<MediaIndexEntry[]>([]); // Matches the server found for searchQuery
     const [showDeleteConfirmation, setShowDeleteConfirmation] = useState(false);
     const [entryToDelete, setEntryToDelete] = useState<MediaIndexEntry | null>(null);
 
@@ -55,15 +74,23 @@ const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist
     useEffect(() => {
         fetchDirectories().catch(e => console.log(e));
     }, [mediaType]);
+    useEffect(() => {
+        if (!searchQuery) {
+            setSearchResults([]);
+            return;
+        }
+        // Wait for a pause in typing before asking the server
+        const timer = setTimeout(() => {
+            queryEntries(mediaType, {q: searchQuery})
+                .then(page => setSearchResults(page.entries))
+                .catch(() => setError('Search failed'));
+        }, 300);
+        return () => clearTimeout(timer);
+    }, [searchQuery, mediaType, entries]);
     useEffect(() => {
         const filterEntries = () => {
             if (searchQuery) {
-                const filtered = entries.filter((entry) =>
-                    Object.values(entry).some((value) =>
-                        value && value.toString().toLowerCase().includes(searchQuery.toLowerCase())
-                    )
-                );
-                setFilteredEntries(filtered);
+                setFilteredEntries(searchResults);
             } else {
                 const filtered = entries.filter((entry) => {
                     // Filter by current directory and add directory entries
@@ -97,11 +124,11 @@ const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist
         };
 
         filterEntries(); // Call filterEntries whenever entries or searchQuery changes
-    }, [entries, searchQuery, currentDirectory, mediaType]);
+    }, [entries, searchResults, searchQuery, currentDirectory, mediaType]);
 
-    const handleDeleteEntry = async (title: string, mType: string) => {
+    const handleDeleteEntry = async (id: string, mType: string) => {
         try {
-            await deleteEntry(title, mType);
+            await deleteEntry(id, mType);
             fetchDirectories().catch(e => console.log(e));
         } catch (error) {
             console.error("Error deleting entry:", error);
@@ -114,8 +141,7 @@ const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist
 
     const handleConfirmDelete = () => {
         if (entryToDelete) {
-            // @ts-ignore
-            handleDeleteEntry(entryToDelete.title, entryToDelete.mediatype).then(setShowDeleteConfirmation(false));
+            handleDeleteEntry(String(entryToDelete.id), mediaType).then(() => setShowDeleteConfirmation(false));
         }
     };
 
@@ -159,6 +185,15 @@ const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist
         setUploadModalOpen(false);
     };
     const columns: GridColDef[] = [
+        {
+            field: 'poster',
+            headerName: '',
+            width: 90,
+            sortable: false,
+            renderCell: (params) => (
+                params.row.isDirectory ? null : <Poster entry={{...params.row, mediaType}}/>
+            ),
+        },
         {
             field: 'title',
             headerName: 'Title',
@@ -226,7 +261,7 @@ const MediaLibrary: React.FC<MediaLibraryProps> = ({ handleLogout, addToPlaylist
         const selectedRows = filteredEntries.filter((entry) => newSelectionModel.includes(entry.id));
         selectedRows.forEach(row => {
             if (row.location) {
-                addToPlaylist(`${API_BASE_URL}/media/${mediaType}/${extractDirectoryName(row.location)}/output.m3u8`);
+                addToPlaylist(`${API_BASE_URL}/media/${mediaType}/${extractDirectoryName(row.location)}/${row.playlist || 'output.m3u8'}`);
             }
         });
 
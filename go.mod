@@ -4,7 +4,9 @@ go 1.23.4
 
 require (
 	github.com/joho/godotenv v1.5.1
+	go.etcd.io/bbolt v1.4.0
 	go.mongodb.org/mongo-driver v1.17.1
+	golang.org/x/crypto v0.26.0
 )
 
 require (
@@ -15,7 +17,7 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
-	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 )